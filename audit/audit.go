@@ -0,0 +1,166 @@
+package audit
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Action is a repository mutation
+type Action string
+
+const (
+	// ActionPush is an upload of a new chart version
+	ActionPush Action = "push"
+	// ActionOverwrite is an upload replacing an existing chart version
+	ActionOverwrite Action = "overwrite"
+	// ActionDelete is the removal of a chart version
+	ActionDelete Action = "delete"
+	// ActionReindex is a reindex of the repository
+	ActionReindex Action = "reindex"
+)
+
+// Outcome is the result of a mutation
+type Outcome string
+
+const (
+	// OutcomeSuccess means the mutation was applied
+	OutcomeSuccess Outcome = "success"
+	// OutcomeDenied means the mutation was rejected by authorization
+	OutcomeDenied Outcome = "denied"
+	// OutcomeFailure means the mutation was attempted and failed
+	OutcomeFailure Outcome = "failure"
+)
+
+// Event is a single audit log record
+type Event struct {
+	Time       time.Time `json:"time"`
+	Action     Action    `json:"action"`
+	Outcome    Outcome   `json:"outcome"`
+	Repository string    `json:"repository,omitempty"`
+	Identity   string    `json:"identity,omitempty"`
+	ClientIP   string    `json:"clientIp,omitempty"`
+	Filename   string    `json:"filename,omitempty"`
+	Chart      string    `json:"chart,omitempty"`
+	Version    string    `json:"version,omitempty"`
+	Digest     string    `json:"digest,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// A Sink persists audit events
+type Sink interface {
+	Write(event *Event) error
+}
+
+// Logger records audit events to every sink
+type Logger struct {
+	sinks []Sink
+}
+
+// NewLogger creates a Logger writing to the sinks
+func NewLogger(sinks ...Sink) *Logger {
+	return &Logger{sinks: sinks}
+}
+
+// Log records an event. Sink failures are logged and otherwise ignored so they never fail
+// the mutation being audited.
+func (l *Logger) Log(event *Event) {
+
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	for _, sink := range l.sinks {
+		err := sink.Write(event)
+		if err != nil {
+			log.Errorf("failed writing audit event: %s", err.Error())
+		}
+	}
+}
+
+type writerSink struct {
+	lock *sync.Mutex
+	w    io.Writer
+}
+
+// NewWriterSink creates a Sink writing events as json lines
+func NewWriterSink(w io.Writer) Sink {
+	return &writerSink{
+		lock: &sync.Mutex{},
+		w:    w,
+	}
+}
+
+// NewFileSink creates a Sink appending json lines to the file, "-" writes to stdout
+func NewFileSink(filename string) (Sink, error) {
+
+	if filename == "-" {
+		return NewWriterSink(os.Stdout), nil
+	}
+
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("failed opening audit log: %s", err.Error())
+	}
+
+	return NewWriterSink(file), nil
+}
+
+func (s *writerSink) Write(event *Event) error {
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	_, err = s.w.Write(append(data, '\n'))
+	return err
+}
+
+// FileStore is where a store sink keeps events, satisfied by backend.Store
+type FileStore interface {
+	PutFile(name string, data []byte) error
+}
+
+type storeSink struct {
+	store  FileStore
+	prefix string
+}
+
+// NewStoreSink creates a Sink writing every event to its own file under prefix in the store.
+// Files are never rewritten, so the log is append-only even on object storage.
+func NewStoreSink(store FileStore, prefix string) Sink {
+	return &storeSink{
+		store:  store,
+		prefix: prefix,
+	}
+}
+
+func (s *storeSink) Write(event *Event) error {
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	// names sort by time
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	name := path.Join(
+		s.prefix,
+		event.Time.Format("2006/01/02"),
+		fmt.Sprintf("%s-%s.json", event.Time.Format("20060102T150405.000000000Z"), hex.EncodeToString(suffix)))
+
+	return s.store.PutFile(name, data)
+}
@@ -0,0 +1,87 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogger_Log_WriterSink(t *testing.T) {
+
+	buf := &bytes.Buffer{}
+	l := NewLogger(NewWriterSink(buf))
+
+	// run
+	l.Log(&Event{Action: ActionPush, Outcome: OutcomeSuccess, Chart: "a", Version: "1.0.0"})
+	l.Log(&Event{Action: ActionReindex, Outcome: OutcomeDenied, Identity: "bob"})
+
+	// check
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if assert.Len(t, lines, 2) {
+		event := &Event{}
+		err := json.Unmarshal([]byte(lines[0]), event)
+		assert.Nil(t, err, "expected json line")
+		assert.Equal(t, ActionPush, event.Action)
+		assert.Equal(t, "a", event.Chart)
+		assert.False(t, event.Time.IsZero(), "expected time to be set")
+
+		assert.Contains(t, lines[1], `"identity":"bob"`)
+		assert.Contains(t, lines[1], `"outcome":"denied"`)
+	}
+}
+
+func TestLogger_Log_SinkFailure(t *testing.T) {
+
+	buf := &bytes.Buffer{}
+	l := NewLogger(&failingSink{}, NewWriterSink(buf))
+
+	// run
+	l.Log(&Event{Action: ActionPush})
+
+	// check
+	assert.NotEmpty(t, buf.String(), "expected remaining sinks to be written")
+}
+
+func TestStoreSink_Write(t *testing.T) {
+
+	store := &fileStoreStub{files: map[string][]byte{}}
+	s := NewStoreSink(store, "audit")
+	eventTime := time.Date(2017, 7, 4, 12, 30, 0, 0, time.UTC)
+
+	// run
+	s.Write(&Event{Time: eventTime, Action: ActionPush})
+	s.Write(&Event{Time: eventTime, Action: ActionDelete})
+
+	// check
+	assert.Len(t, store.files, 2, "expected a file per event")
+	for name, data := range store.files {
+		assert.True(t,
+			strings.HasPrefix(name, "audit/2017/07/04/20170704T123000.000000000Z-"),
+			"unexpected name %s", name)
+		assert.Contains(t, string(data), `"time":"2017-07-04T12:30:00Z"`)
+	}
+}
+
+//
+// helpers
+//
+
+type failingSink struct{}
+
+func (s *failingSink) Write(event *Event) error {
+	return errors.New("fail")
+}
+
+type fileStoreStub struct {
+	files map[string][]byte
+}
+
+func (s *fileStoreStub) PutFile(name string, data []byte) error {
+	s.files[name] = data
+	return nil
+}
@@ -0,0 +1,23 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+)
+
+var (
+	// ErrInvalidCredentials is returned when a request carries credentials that don't check out
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// An Identity is an authenticated user
+type Identity struct {
+	Name   string
+	Groups []string
+}
+
+// An Authenticator resolves the identity of a request. It returns a nil identity and nil
+// error if the request carries no credentials it understands.
+type Authenticator interface {
+	Authenticate(req *http.Request) (*Identity, error)
+}
@@ -0,0 +1,327 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	log "github.com/sirupsen/logrus"
+	"github.com/zlangbert/hrp/config"
+)
+
+var (
+	// minimum time between fetches of the jwks when tokens reference unknown keys
+	jwksRefreshInterval = time.Minute
+)
+
+// JWTAuthenticator authenticates requests carrying a bearer token issued by an oidc
+// provider, such as the tokens ci systems hand to their jobs
+type JWTAuthenticator struct {
+	cfg    config.JWTConfig
+	client *http.Client
+
+	keysLock  *sync.Mutex
+	keys      map[string]interface{}
+	refreshed time.Time
+
+	// closed once the key set being loaded is swapped in, nil when not loading
+	refreshing chan struct{}
+}
+
+// NewJWTAuthenticator creates a JWTAuthenticator and loads its signing keys
+func NewJWTAuthenticator(cfg config.JWTConfig) (*JWTAuthenticator, error) {
+
+	// validate config
+	if cfg.Issuer == "" {
+		return nil, errors.New("jwt config - issuer missing")
+	}
+	if cfg.Audience == "" {
+		return nil, errors.New("jwt config - audience missing")
+	}
+	if cfg.JWKSURL == "" && cfg.JWKSFile == "" {
+		return nil, errors.New("jwt config - jwks url or file missing")
+	}
+
+	a := &JWTAuthenticator{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+
+		keysLock: &sync.Mutex{},
+		keys:     map[string]interface{}{},
+	}
+
+	err := a.refreshKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// Authenticate validates the request's bearer token and maps its claims to an identity
+func (a *JWTAuthenticator) Authenticate(req *http.Request) (*Identity, error) {
+
+	header := req.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return nil, nil
+	}
+
+	token, err := jwt.Parse(strings.TrimPrefix(header, "Bearer "), a.key)
+	if err != nil || !token.Valid {
+		log.Debugf("rejected bearer token: %v", err)
+		return nil, ErrInvalidCredentials
+	}
+
+	// tokens without an expiry would be valid forever
+	claims := token.Claims.(jwt.MapClaims)
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		log.Debug("rejected bearer token: no exp claim")
+		return nil, ErrInvalidCredentials
+	}
+	if !claims.VerifyIssuer(a.cfg.Issuer, true) || !hasAudience(claims, a.cfg.Audience) {
+		log.Debug("rejected bearer token: wrong issuer or audience")
+		return nil, ErrInvalidCredentials
+	}
+
+	name, _ := claims[a.cfg.UsernameClaim].(string)
+	if name == "" {
+		log.Debugf("rejected bearer token: no %s claim", a.cfg.UsernameClaim)
+		return nil, ErrInvalidCredentials
+	}
+
+	return &Identity{
+		Name:   name,
+		Groups: stringsClaim(claims[a.cfg.GroupsClaim]),
+	}, nil
+}
+
+/*
+ * resolve the key a token is signed with, refreshing the key set once if
+ * the token references a key we don't know yet
+ */
+func (a *JWTAuthenticator) key(token *jwt.Token) (interface{}, error) {
+
+	switch token.Method.(type) {
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+	default:
+		return nil, fmt.Errorf("unexpected signing method %s", token.Header["alg"])
+	}
+
+	kid, _ := token.Header["kid"].(string)
+
+	a.keysLock.Lock()
+	key, ok := a.keys[kid]
+	refresh := a.cfg.JWKSURL != "" && (a.refreshing != nil || time.Since(a.refreshed) > jwksRefreshInterval)
+	a.keysLock.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	if refresh {
+		err := a.refreshKeys()
+		if err != nil {
+			return nil, err
+		}
+
+		a.keysLock.Lock()
+		key, ok = a.keys[kid]
+		a.keysLock.Unlock()
+		if ok {
+			return key, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+/*
+ * load the key set and swap it in, or wait for the load in progress. The
+ * keys lock isn't held while loading, so tokens signed with known keys are
+ * verified meanwhile.
+ */
+func (a *JWTAuthenticator) refreshKeys() error {
+
+	a.keysLock.Lock()
+	if done := a.refreshing; done != nil {
+		a.keysLock.Unlock()
+		<-done
+		return nil
+	}
+	done := make(chan struct{})
+	a.refreshing = done
+	a.refreshed = time.Now()
+	a.keysLock.Unlock()
+
+	keys, err := a.loadKeys()
+
+	a.keysLock.Lock()
+	if err == nil {
+		a.keys = keys
+	}
+	a.refreshing = nil
+	a.keysLock.Unlock()
+	close(done)
+
+	return err
+}
+
+func (a *JWTAuthenticator) loadKeys() (map[string]interface{}, error) {
+
+	var data []byte
+	var err error
+	if a.cfg.JWKSFile != "" {
+		data, err = ioutil.ReadFile(a.cfg.JWKSFile)
+	} else {
+		data, err = a.fetchKeys()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed loading jwks: %s", err.Error())
+	}
+
+	return ParseJWKS(data)
+}
+
+func (a *JWTAuthenticator) fetchKeys() ([]byte, error) {
+
+	resp, err := a.client.Get(a.cfg.JWKSURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %d", a.cfg.JWKSURL, resp.StatusCode)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// ParseJWKS parses the rsa and ec signing keys of a json web key set, by key id
+func ParseJWKS(data []byte) (map[string]interface{}, error) {
+
+	set := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	err := json.Unmarshal(data, &set)
+	if err != nil {
+		return nil, fmt.Errorf("invalid jwks: %s", err.Error())
+	}
+
+	keys := map[string]interface{}{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		var key interface{}
+		switch k.Kty {
+		case "RSA":
+			key, err = rsaKey(k)
+		case "EC":
+			key, err = ecKey(k)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid jwks key %q: %s", k.Kid, err.Error())
+		}
+		keys[k.Kid] = key
+	}
+
+	return keys, nil
+}
+
+func rsaKey(k jwk) (*rsa.PublicKey, error) {
+
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}, nil
+}
+
+func ecKey(k jwk) (*ecdsa.PublicKey, error) {
+
+	var curve elliptic.Curve
+	switch k.Crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+	}
+
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := base64.RawURLEncoding.DecodeString(k.Y)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ecdsa.PublicKey{
+		Curve: curve,
+		X:     new(big.Int).SetBytes(x),
+		Y:     new(big.Int).SetBytes(y),
+	}, nil
+}
+
+// the aud claim may be a single string or a list
+func hasAudience(claims jwt.MapClaims, audience string) bool {
+	for _, aud := range stringsClaim(claims["aud"]) {
+		if aud == audience {
+			return true
+		}
+	}
+	return false
+}
+
+func stringsClaim(claim interface{}) []string {
+	switch v := claim.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		values := []string{}
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
@@ -0,0 +1,372 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/zlangbert/hrp/config"
+)
+
+func TestNewJWTAuthenticator_ConfigVerify(t *testing.T) {
+
+	cases := map[string]config.JWTConfig{
+		"issuer missing":   {Audience: "hrp", JWKSURL: "http://jwks"},
+		"audience missing": {Issuer: "https://issuer", JWKSURL: "http://jwks"},
+		"jwks url or file": {Issuer: "https://issuer", Audience: "hrp"},
+	}
+
+	for expected, cfg := range cases {
+		_, err := NewJWTAuthenticator(cfg)
+		if assert.Error(t, err, "expected error") {
+			assert.Contains(t, err.Error(), expected)
+		}
+	}
+}
+
+func TestJWTAuthenticator_Authenticate(t *testing.T) {
+
+	keys := newTestKeys(t)
+	a := keys.authenticator(t)
+
+	// run
+	identity, err := a.Authenticate(bearerRequest(keys.sign(t, "rsa", jwt.MapClaims{
+		"iss":    "https://issuer",
+		"aud":    "hrp",
+		"sub":    "repo:payments/api",
+		"groups": []string{"payments", "ci"},
+		"exp":    time.Now().Add(time.Minute).Unix(),
+	})))
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+	if assert.NotNil(t, identity, "expected identity") {
+		assert.Equal(t, "repo:payments/api", identity.Name)
+		assert.Equal(t, []string{"payments", "ci"}, identity.Groups)
+	}
+}
+
+func TestJWTAuthenticator_Authenticate_ECAndAudienceList(t *testing.T) {
+
+	keys := newTestKeys(t)
+	a := keys.authenticator(t)
+
+	// run
+	identity, err := a.Authenticate(bearerRequest(keys.sign(t, "ec", jwt.MapClaims{
+		"iss": "https://issuer",
+		"aud": []string{"other", "hrp"},
+		"sub": "ci",
+		"exp": time.Now().Add(time.Minute).Unix(),
+	})))
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+	if assert.NotNil(t, identity, "expected identity") {
+		assert.Equal(t, "ci", identity.Name)
+	}
+}
+
+func TestJWTAuthenticator_Authenticate_ClaimMapping(t *testing.T) {
+
+	keys := newTestKeys(t)
+	a := keys.authenticator(t)
+	a.cfg.UsernameClaim = "repository"
+	a.cfg.GroupsClaim = "repository_owner"
+
+	// run
+	identity, err := a.Authenticate(bearerRequest(keys.sign(t, "rsa", jwt.MapClaims{
+		"iss":              "https://issuer",
+		"aud":              "hrp",
+		"repository":       "payments/api",
+		"repository_owner": "payments",
+		"exp":              time.Now().Add(time.Minute).Unix(),
+	})))
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+	if assert.NotNil(t, identity, "expected identity") {
+		assert.Equal(t, "payments/api", identity.Name)
+		assert.Equal(t, []string{"payments"}, identity.Groups)
+	}
+}
+
+func TestJWTAuthenticator_Authenticate_Rejected(t *testing.T) {
+
+	keys := newTestKeys(t)
+	a := keys.authenticator(t)
+	valid := jwt.MapClaims{
+		"iss": "https://issuer",
+		"aud": "hrp",
+		"sub": "ci",
+		"exp": time.Now().Add(time.Minute).Unix(),
+	}
+	with := func(key string, value interface{}) jwt.MapClaims {
+		claims := jwt.MapClaims{}
+		for k, v := range valid {
+			claims[k] = v
+		}
+		claims[key] = value
+		return claims
+	}
+
+	cases := map[string]string{
+		"expired":         keys.sign(t, "rsa", with("exp", time.Now().Add(-time.Minute).Unix())),
+		"wrong issuer":    keys.sign(t, "rsa", with("iss", "https://evil")),
+		"wrong audience":  keys.sign(t, "rsa", with("aud", "other")),
+		"missing subject": keys.sign(t, "rsa", with("sub", "")),
+		"unknown key":     keys.sign(t, "unknown", valid),
+		"hmac":            keys.sign(t, "hmac", valid),
+		"garbage":         "not.a.token",
+	}
+
+	for name, token := range cases {
+		identity, err := a.Authenticate(bearerRequest(token))
+		assert.Nil(t, identity, "nil identity for %s", name)
+		assert.Equal(t, ErrInvalidCredentials, err, "invalid credentials for %s", name)
+	}
+}
+
+func TestJWTAuthenticator_Authenticate_NoExpiry(t *testing.T) {
+
+	keys := newTestKeys(t)
+	a := keys.authenticator(t)
+	token := keys.sign(t, "rsa", jwt.MapClaims{
+		"iss": "https://issuer",
+		"aud": "hrp",
+		"sub": "ci",
+	})
+
+	// run
+	identity, err := a.Authenticate(bearerRequest(token))
+
+	// check
+	assert.Nil(t, identity, "nil identity")
+	assert.Equal(t, ErrInvalidCredentials, err)
+}
+
+func TestJWTAuthenticator_Authenticate_NoBearer(t *testing.T) {
+
+	keys := newTestKeys(t)
+	a := keys.authenticator(t)
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.SetBasicAuth("user", "password")
+
+	identity, err := a.Authenticate(req)
+
+	assert.Nil(t, identity, "nil identity")
+	assert.Nil(t, err, "nil err")
+}
+
+func TestJWTAuthenticator_JWKSFile(t *testing.T) {
+
+	keys := newTestKeys(t)
+
+	file, _ := ioutil.TempFile("", "jwks")
+	defer os.Remove(file.Name())
+	file.Write(keys.jwks(t))
+	file.Close()
+
+	a, err := NewJWTAuthenticator(config.JWTConfig{
+		Issuer:        "https://issuer",
+		Audience:      "hrp",
+		JWKSFile:      file.Name(),
+		UsernameClaim: "sub",
+		GroupsClaim:   "groups",
+	})
+
+	assert.Nil(t, err, "expected nil err")
+	assert.Len(t, a.keys, 2)
+}
+
+func TestJWTAuthenticator_RefreshesOnUnknownKey(t *testing.T) {
+
+	keys := newTestKeys(t)
+	a := keys.authenticator(t)
+
+	// rotate in a new key after the authenticator loaded the old set
+	rotated, _ := rsa.GenerateKey(rand.Reader, 2048)
+	keys.rsa["rotated"] = rotated
+	a.refreshed = time.Time{}
+
+	identity, err := a.Authenticate(bearerRequest(keys.sign(t, "rotated", jwt.MapClaims{
+		"iss": "https://issuer",
+		"aud": "hrp",
+		"sub": "ci",
+		"exp": time.Now().Add(time.Minute).Unix(),
+	})))
+
+	assert.Nil(t, err, "expected nil err")
+	assert.NotNil(t, identity, "expected identity")
+}
+
+func TestJWTAuthenticator_KnownKeysDuringRefresh(t *testing.T) {
+
+	keys := newTestKeys(t)
+	a := keys.authenticator(t)
+	claims := jwt.MapClaims{
+		"iss": "https://issuer",
+		"aud": "hrp",
+		"sub": "ci",
+		"exp": time.Now().Add(time.Minute).Unix(),
+	}
+
+	// a token with an unknown key starts a refresh that hangs
+	block := keys.blockJWKS()
+	a.refreshed = time.Time{}
+	unknown := keys.sign(t, "unknown", claims)
+	refreshed := make(chan error, 1)
+	go func() {
+		_, err := a.Authenticate(bearerRequest(unknown))
+		refreshed <- err
+	}()
+	for refreshing := false; !refreshing; time.Sleep(time.Millisecond) {
+		a.keysLock.Lock()
+		refreshing = a.refreshing != nil
+		a.keysLock.Unlock()
+	}
+
+	// run
+	identity, err := a.Authenticate(bearerRequest(keys.sign(t, "rsa", claims)))
+	close(block)
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+	assert.NotNil(t, identity, "expected identity while the key set is fetched")
+	assert.Equal(t, ErrInvalidCredentials, <-refreshed)
+}
+
+//
+// helpers
+//
+
+type testKeys struct {
+	rsa    map[string]*rsa.PrivateKey
+	ec     *ecdsa.PrivateKey
+	server *httptest.Server
+
+	// when set, jwks requests wait for it to be closed
+	lock  sync.Mutex
+	block chan struct{}
+}
+
+func newTestKeys(t *testing.T) *testKeys {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := &testKeys{rsa: map[string]*rsa.PrivateKey{"rsa": rsaKey}, ec: ecKey}
+	keys.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		keys.lock.Lock()
+		block := keys.block
+		keys.lock.Unlock()
+		if block != nil {
+			<-block
+		}
+		w.Write(keys.jwks(t))
+	}))
+
+	return keys
+}
+
+// make jwks requests wait until the returned channel is closed
+func (k *testKeys) blockJWKS() chan struct{} {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	k.block = make(chan struct{})
+	return k.block
+}
+
+func (k *testKeys) authenticator(t *testing.T) *JWTAuthenticator {
+	a, err := NewJWTAuthenticator(config.JWTConfig{
+		Issuer:        "https://issuer",
+		Audience:      "hrp",
+		JWKSURL:       k.server.URL,
+		UsernameClaim: "sub",
+		GroupsClaim:   "groups",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func (k *testKeys) jwks(t *testing.T) []byte {
+	encode := func(b []byte) string {
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+
+	keys := []map[string]string{}
+	for kid, key := range k.rsa {
+		keys = append(keys, map[string]string{
+			"kid": kid,
+			"kty": "RSA",
+			"use": "sig",
+			"n":   encode(key.N.Bytes()),
+			"e":   encode(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+	keys = append(keys, map[string]string{
+		"kid": "ec",
+		"kty": "EC",
+		"crv": "P-256",
+		"x":   encode(k.ec.X.Bytes()),
+		"y":   encode(k.ec.Y.Bytes()),
+	})
+
+	data, err := json.Marshal(map[string]interface{}{"keys": keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// sign a token with the named key, "unknown" and "hmac" sign with keys not in the set
+func (k *testKeys) sign(t *testing.T, kid string, claims jwt.MapClaims) string {
+	var token *jwt.Token
+	var key interface{}
+
+	switch kid {
+	case "ec":
+		token, key = jwt.NewWithClaims(jwt.SigningMethodES256, claims), k.ec
+	case "hmac":
+		token, key = jwt.NewWithClaims(jwt.SigningMethodHS256, claims), []byte("secret")
+	case "unknown":
+		unknown, _ := rsa.GenerateKey(rand.Reader, 2048)
+		token, key = jwt.NewWithClaims(jwt.SigningMethodRS256, claims), unknown
+	default:
+		token, key = jwt.NewWithClaims(jwt.SigningMethodRS256, claims), k.rsa[kid]
+	}
+	token.Header["kid"] = kid
+
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func bearerRequest(token string) *http.Request {
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
+}
@@ -0,0 +1,182 @@
+package auth
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+// Permission is an action on a chart
+type Permission string
+
+const (
+	// PermissionRead allows reading the index and downloading charts
+	PermissionRead Permission = "read"
+	// PermissionPush allows uploading charts
+	PermissionPush Permission = "push"
+	// PermissionDelete allows deleting charts
+	PermissionDelete Permission = "delete"
+	// PermissionReindex allows reindexing the repository
+	PermissionReindex Permission = "reindex"
+)
+
+const (
+	// Anyone in a rule's groups matches every request, including anonymous ones. In a
+	// rule's users it matches every authenticated user.
+	Anyone = "*"
+
+	// AllCharts is the chart name repository wide operations are authorized against
+	AllCharts = "*"
+)
+
+// Policy maps users and groups to permissions on chart name globs
+type Policy struct {
+	Users []User `yaml:"users"`
+	Rules []Rule `yaml:"rules"`
+}
+
+// User is a user authenticated with http basic auth
+type User struct {
+	Name         string   `yaml:"name"`
+	PasswordHash string   `yaml:"passwordHash"`
+	Groups       []string `yaml:"groups"`
+}
+
+// Rule grants permissions on the charts matching any of the globs to the listed users and groups
+type Rule struct {
+	Users       []string     `yaml:"users"`
+	Groups      []string     `yaml:"groups"`
+	Charts      []string     `yaml:"charts"`
+	Permissions []Permission `yaml:"permissions"`
+}
+
+// LoadPolicy reads a yaml policy file
+func LoadPolicy(filename string) (*Policy, error) {
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParsePolicy(data)
+}
+
+// ParsePolicy parses and validates a yaml policy
+func ParsePolicy(data []byte) (*Policy, error) {
+
+	policy := &Policy{}
+	err := yaml.Unmarshal(data, policy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy: %s", err.Error())
+	}
+
+	for _, rule := range policy.Rules {
+		for _, pattern := range rule.Charts {
+			_, err := path.Match(pattern, "")
+			if err != nil {
+				return nil, fmt.Errorf("invalid policy: bad chart pattern %q", pattern)
+			}
+		}
+		for _, permission := range rule.Permissions {
+			switch permission {
+			case PermissionRead, PermissionPush, PermissionDelete, PermissionReindex:
+			default:
+				return nil, fmt.Errorf("invalid policy: unknown permission %q", permission)
+			}
+		}
+	}
+
+	return policy, nil
+}
+
+// Authenticate resolves http basic auth credentials against the policy's users
+func (p *Policy) Authenticate(req *http.Request) (*Identity, error) {
+
+	username, password, ok := req.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+
+	for _, user := range p.Users {
+		if user.Name != username {
+			continue
+		}
+		err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password))
+		if err != nil {
+			return nil, ErrInvalidCredentials
+		}
+		return &Identity{Name: user.Name, Groups: user.Groups}, nil
+	}
+
+	return nil, ErrInvalidCredentials
+}
+
+// Allowed returns true if the identity has the permission on the chart. A nil identity is an
+// anonymous request. Repository wide operations are checked against AllCharts, which only
+// rules covering every chart match.
+func (p *Policy) Allowed(identity *Identity, permission Permission, chart string) bool {
+
+	for _, rule := range p.Rules {
+		if rule.grants(permission) && rule.appliesTo(identity) && rule.covers(chart) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *Rule) grants(permission Permission) bool {
+	for _, p := range r.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rule) appliesTo(identity *Identity) bool {
+
+	for _, group := range r.Groups {
+		if group == Anyone {
+			return true
+		}
+		if identity == nil {
+			continue
+		}
+		for _, g := range identity.Groups {
+			if g == group {
+				return true
+			}
+		}
+	}
+
+	if identity == nil {
+		return false
+	}
+	for _, user := range r.Users {
+		if user == Anyone || user == identity.Name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *Rule) covers(chart string) bool {
+	for _, pattern := range r.Charts {
+		if pattern == AllCharts {
+			return true
+		}
+		if chart == AllCharts {
+			continue
+		}
+		if ok, _ := path.Match(pattern, chart); ok {
+			return true
+		}
+	}
+	return false
+}
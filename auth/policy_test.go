@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testPolicy = `
+users:
+- name: alice
+  passwordHash: "%s"
+  groups: [payments]
+- name: bob
+  passwordHash: "%s"
+rules:
+- groups: [payments]
+  charts: ["payments-*"]
+  permissions: [read, push, delete]
+- users: [bob]
+  charts: ["*"]
+  permissions: [reindex]
+- groups: ["*"]
+  charts: ["public-*"]
+  permissions: [read]
+`
+
+func TestParsePolicy_UnknownPermission(t *testing.T) {
+
+	_, err := ParsePolicy([]byte("rules:\n- charts: ['*']\n  permissions: [write]\n"))
+
+	if assert.Error(t, err, "expected error") {
+		assert.Contains(t, err.Error(), "unknown permission")
+	}
+}
+
+func TestParsePolicy_InvalidPattern(t *testing.T) {
+
+	_, err := ParsePolicy([]byte("rules:\n- charts: ['[']\n  permissions: [read]\n"))
+
+	if assert.Error(t, err, "expected error") {
+		assert.Contains(t, err.Error(), "bad chart pattern")
+	}
+}
+
+func TestPolicy_Authenticate(t *testing.T) {
+
+	p := testPolicyWithPasswords(t)
+
+	// run
+	identity, err := p.Authenticate(testBasicAuthRequest("alice", "alice-password"))
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+	if assert.NotNil(t, identity, "expected identity") {
+		assert.Equal(t, "alice", identity.Name)
+		assert.Equal(t, []string{"payments"}, identity.Groups)
+	}
+}
+
+func TestPolicy_Authenticate_WrongPassword(t *testing.T) {
+
+	p := testPolicyWithPasswords(t)
+
+	identity, err := p.Authenticate(testBasicAuthRequest("alice", "wrong"))
+
+	assert.Nil(t, identity, "nil identity")
+	assert.Equal(t, ErrInvalidCredentials, err)
+}
+
+func TestPolicy_Authenticate_UnknownUser(t *testing.T) {
+
+	p := testPolicyWithPasswords(t)
+
+	identity, err := p.Authenticate(testBasicAuthRequest("mallory", "alice-password"))
+
+	assert.Nil(t, identity, "nil identity")
+	assert.Equal(t, ErrInvalidCredentials, err)
+}
+
+func TestPolicy_Authenticate_NoCredentials(t *testing.T) {
+
+	p := testPolicyWithPasswords(t)
+	req, _ := http.NewRequest("GET", "/", nil)
+
+	identity, err := p.Authenticate(req)
+
+	assert.Nil(t, identity, "nil identity")
+	assert.Nil(t, err, "nil err")
+}
+
+func TestPolicy_Allowed(t *testing.T) {
+
+	p := testPolicyWithPasswords(t)
+	alice := &Identity{Name: "alice", Groups: []string{"payments"}}
+	bob := &Identity{Name: "bob"}
+
+	cases := []struct {
+		identity   *Identity
+		permission Permission
+		chart      string
+		allowed    bool
+	}{
+		{alice, PermissionPush, "payments-api", true},
+		{alice, PermissionPush, "orders-api", false},
+		{alice, PermissionReindex, AllCharts, false},
+		{alice, PermissionRead, "public-nginx", true},
+		{bob, PermissionPush, "payments-api", false},
+		{bob, PermissionReindex, AllCharts, true},
+		{nil, PermissionRead, "public-nginx", true},
+		{nil, PermissionRead, "payments-api", false},
+		{nil, PermissionPush, "public-nginx", false},
+	}
+
+	for _, c := range cases {
+		name := "anonymous"
+		if c.identity != nil {
+			name = c.identity.Name
+		}
+		assert.Equal(t,
+			c.allowed,
+			p.Allowed(c.identity, c.permission, c.chart),
+			"%s %s %s", name, c.permission, c.chart)
+	}
+}
+
+//
+// helpers
+//
+
+func testPolicyWithPasswords(t *testing.T) *Policy {
+	aliceHash, _ := bcrypt.GenerateFromPassword([]byte("alice-password"), bcrypt.MinCost)
+	bobHash, _ := bcrypt.GenerateFromPassword([]byte("bob-password"), bcrypt.MinCost)
+
+	p, err := ParsePolicy([]byte(fmt.Sprintf(testPolicy, string(aliceHash), string(bobHash))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func testBasicAuthRequest(username string, password string) *http.Request {
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.SetBasicAuth(username, password)
+	return req
+}
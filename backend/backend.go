@@ -5,7 +5,7 @@ import (
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"github.com/zlangbert/hrp/config"
-	"mime/multipart"
+	"io"
 )
 
 // A Backend is a generic interface for chart storage
@@ -13,10 +13,63 @@ type Backend interface {
 	Initialize() error
 	GetIndex() ([]byte, error)
 	GetChart(string) ([]byte, error)
-	PutChart(filename string, file multipart.File) error
+	PutChart(filename string, file io.Reader, size int64) error
+	DeleteCharts(filenames ...string) error
 	Reindex() error
 }
 
+// A Store is a Backend that can also hold arbitrary files, without touching the index. GetFile
+// returns ErrFileNotFound for a file that was never put.
+type Store interface {
+	GetFile(name string) ([]byte, error)
+	PutFile(name string, data []byte) error
+}
+
+// A BatchBackend can store several charts at once, updating its index a single time
+type BatchBackend interface {
+	// PutCharts returns an error per chart, in order, nil for every chart stored. An atomic
+	// batch either stores every chart or none of them.
+	PutCharts(charts []*ChartFile, atomic bool) []error
+}
+
+// ChartFile is a chart archive to store, read from File which holds Size bytes
+type ChartFile struct {
+	Filename string
+	File     io.Reader
+	Size     int64
+
+	// the chart's provenance file, stored along with the chart by a Store, or nil
+	Provenance []byte
+}
+
+// ErrFileNotFound is returned by a Store for a file it doesn't hold
+var ErrFileNotFound = errors.New("file not found")
+
+// ErrBatchAborted is returned for the charts of an atomic batch that weren't stored because
+// another chart in it failed
+var ErrBatchAborted = errors.New("batch aborted, another chart in it failed")
+
+// NewAuditStore returns the Store the audit log is kept in, next to the root repository
+func NewAuditStore(cfg *config.AppConfig) (Store, error) {
+	return newStore(cfg.ForAudit())
+}
+
+// a Store of files outside any repository, for backends that can hold files
+func newStore(cfg *config.AppConfig) (Store, error) {
+
+	b, err := NewBackend(cfg, false)
+	if err != nil {
+		return nil, err
+	}
+
+	store, ok := b.(Store)
+	if !ok {
+		return nil, fmt.Errorf("%s backend can't store files", cfg.BackendName)
+	}
+
+	return store, nil
+}
+
 // NewBackend is a factory that returns a new Backend based on the config
 func NewBackend(cfg *config.AppConfig, init bool) (Backend, error) {
 	var backend Backend
@@ -27,6 +80,12 @@ func NewBackend(cfg *config.AppConfig, init bool) (Backend, error) {
 			return nil, err
 		}
 		backend = b
+	case "oci":
+		b, err := newOCI(cfg)
+		if err != nil {
+			return nil, err
+		}
+		backend = b
 	default:
 		return nil, fmt.Errorf(fmt.Sprintf("unrecognized storage backend: %s", cfg.BackendName))
 	}
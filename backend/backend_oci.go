@@ -0,0 +1,551 @@
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zlangbert/hrp/config"
+	"github.com/zlangbert/hrp/util"
+)
+
+const (
+	helmConfigMediaType = "application/vnd.cncf.helm.config.v1+json"
+	helmChartMediaType  = "application/vnd.cncf.helm.chart.content.v1.tar+gzip"
+)
+
+// errProvenanceUnsupported is returned for charts put with a provenance file
+var errProvenanceUnsupported = errors.New("oci backend can't store provenance files")
+
+type ociBackend struct {
+	config   *config.AppConfig
+	registry util.RegistryUtil
+
+	reindexLock *tryMutex
+
+	// the index is built from registry tags and held in memory
+	indexLock  *sync.RWMutex
+	index      *util.IndexFile
+	charts     map[string]ociChartRef
+	generation int64
+}
+
+// location of a chart layer in the registry
+type ociChartRef struct {
+	repository string
+	tag        string
+	digest     string
+}
+
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int    `json:"size"`
+}
+
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+func newOCI(config *config.AppConfig) (*ociBackend, error) {
+
+	// validate config
+	if config.OCI.Registry == "" {
+		return nil, errors.New("oci config - registry missing")
+	}
+
+	return &ociBackend{
+		config: config,
+		registry: util.NewRegistryUtil(
+			config.OCI.Registry,
+			config.OCI.Username,
+			config.OCI.Password,
+			config.OCI.PlainHTTP,
+			config.OCI.Timeout,
+			config.Debug),
+
+		reindexLock: newTryMutex(),
+		indexLock:   &sync.RWMutex{},
+		charts:      map[string]ociChartRef{},
+	}, nil
+}
+
+/*
+ * Initialize backend
+ */
+func (b *ociBackend) Initialize() error {
+
+	log.Info("initializing...")
+
+	return b.Reindex()
+}
+
+/*
+ * Get index:
+ *
+ * serialize the index built from registry tags
+ */
+func (b *ociBackend) GetIndex() ([]byte, error) {
+
+	b.indexLock.RLock()
+	defer b.indexLock.RUnlock()
+
+	if b.index == nil {
+		return nil, errors.New("index has not been built")
+	}
+
+	return b.index.Marshal()
+}
+
+/*
+ * Get index with generation:
+ *
+ * serialize the index along with the number of times it has been rebuilt
+ */
+func (b *ociBackend) GetIndexWithGeneration() ([]byte, int64, error) {
+
+	b.indexLock.RLock()
+	defer b.indexLock.RUnlock()
+
+	if b.index == nil {
+		return nil, 0, errors.New("index has not been built")
+	}
+
+	data, err := b.index.Marshal()
+	return data, b.generation, err
+}
+
+/*
+ * Get chart:
+ *
+ * pull the chart layer from the registry
+ */
+func (b *ociBackend) GetChart(name string) ([]byte, error) {
+
+	b.indexLock.RLock()
+	ref, ok := b.charts[name]
+	b.indexLock.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("chart not found: %s", name)
+	}
+
+	return b.registry.GetBlob(ref.repository, ref.digest)
+}
+
+/*
+ * Put chart:
+ *
+ * 1. push chart layer and config blobs
+ * 2. tag a manifest with the chart version
+ * 3. add the chart to the index
+ */
+func (b *ociBackend) PutChart(filename string, file io.Reader, size int64) error {
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return err
+	}
+
+	md, err := util.LoadChartMetadata(data)
+	if err != nil {
+		return err
+	}
+	if md.ChartFilename() != filename {
+		log.Warnf("chart uploaded as %s will be stored as %s", filename, md.ChartFilename())
+	}
+
+	_, ref, err := b.pushChart(md, data)
+	if err != nil {
+		return err
+	}
+
+	return b.indexCharts([]*util.ChartMetadata{md}, []ociChartRef{ref})
+}
+
+/*
+ * Put charts:
+ *
+ * push every chart like putting a single one, then index them at once. An
+ * atomic batch that fails deletes the manifests it tagged for new versions
+ * and tags the replaced manifests of existing versions again.
+ */
+func (b *ociBackend) PutCharts(charts []*ChartFile, atomic bool) []error {
+
+	errs := make([]error, len(charts))
+	archives := make([][]byte, len(charts))
+	mds := make([]*util.ChartMetadata, len(charts))
+	for n, chart := range charts {
+		if chart.Provenance != nil {
+			errs[n] = errProvenanceUnsupported
+			continue
+		}
+		archives[n], errs[n] = ioutil.ReadAll(chart.File)
+		if errs[n] == nil {
+			mds[n], errs[n] = util.LoadChartMetadata(archives[n])
+		}
+	}
+
+	type pushed struct {
+		md     *util.ChartMetadata
+		digest string
+		ref    ociChartRef
+
+		// the manifest the chart replaced, to put back if the batch aborts
+		previous []byte
+	}
+	done := []pushed{}
+	failed := anyFailed(errs)
+	for n := range charts {
+		if errs[n] != nil || (atomic && failed) {
+			continue
+		}
+
+		b.indexLock.RLock()
+		existing, exists := b.charts[mds[n].ChartFilename()]
+		b.indexLock.RUnlock()
+
+		var previous []byte
+		if atomic && exists {
+			previous, errs[n] = b.registry.GetManifest(existing.repository, existing.tag)
+			if errs[n] != nil {
+				failed = true
+				continue
+			}
+		}
+
+		var digest string
+		var ref ociChartRef
+		digest, ref, errs[n] = b.pushChart(mds[n], archives[n])
+		if errs[n] != nil {
+			failed = true
+			continue
+		}
+		done = append(done, pushed{md: mds[n], digest: digest, ref: ref, previous: previous})
+	}
+
+	if atomic && failed {
+		for _, p := range done {
+			repository := b.repository(p.md.Name)
+			if p.previous != nil {
+				err := b.registry.PutManifest(repository, versionTag(p.md.Version), p.previous)
+				if err != nil {
+					log.Errorf("failed restoring chart %s replaced by an aborted batch, reupload it to repair: %s",
+						p.md.ChartFilename(), err.Error())
+				}
+				continue
+			}
+			err := b.registry.DeleteManifest(repository, p.digest)
+			if err != nil {
+				log.Errorf("failed deleting manifest of aborted chart %s: %s", p.md.ChartFilename(), err.Error())
+			}
+		}
+		for n := range errs {
+			if errs[n] == nil {
+				errs[n] = ErrBatchAborted
+			}
+		}
+		return errs
+	}
+
+	if len(done) > 0 {
+		pushedMds := []*util.ChartMetadata{}
+		refs := []ociChartRef{}
+		for _, p := range done {
+			pushedMds = append(pushedMds, p.md)
+			refs = append(refs, p.ref)
+		}
+		err := b.indexCharts(pushedMds, refs)
+		if err != nil {
+			for n := range errs {
+				if errs[n] == nil {
+					errs[n] = err
+				}
+			}
+		}
+	}
+
+	return errs
+}
+
+func anyFailed(errs []error) bool {
+	for _, err := range errs {
+		if err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * push a chart's blobs and tag its manifest, returning the manifest digest
+ * and where the chart is
+ */
+func (b *ociBackend) pushChart(md *util.ChartMetadata, data []byte) (string, ociChartRef, error) {
+
+	repository := b.repository(md.Name)
+
+	// push blobs
+	layerDigest, err := b.registry.PushBlob(repository, data)
+	if err != nil {
+		return "", ociChartRef{}, err
+	}
+
+	configData, err := json.Marshal(md)
+	if err != nil {
+		return "", ociChartRef{}, err
+	}
+	configDigest, err := b.registry.PushBlob(repository, configData)
+	if err != nil {
+		return "", ociChartRef{}, err
+	}
+
+	// push manifest
+	manifest, err := json.Marshal(&ociManifest{
+		SchemaVersion: 2,
+		MediaType:     util.OCIManifestMediaType,
+		Config: ociDescriptor{
+			MediaType: helmConfigMediaType,
+			Digest:    configDigest,
+			Size:      len(configData),
+		},
+		Layers: []ociDescriptor{{
+			MediaType: helmChartMediaType,
+			Digest:    layerDigest,
+			Size:      len(data),
+		}},
+	})
+	if err != nil {
+		return "", ociChartRef{}, err
+	}
+
+	tag := versionTag(md.Version)
+	err = b.registry.PutManifest(repository, tag, manifest)
+	if err != nil {
+		return "", ociChartRef{}, err
+	}
+
+	ref := ociChartRef{repository: repository, tag: tag, digest: layerDigest}
+	return "sha256:" + util.Digest(manifest), ref, nil
+}
+
+/*
+ * add pushed charts to the index, without going through the registry again.
+ * Waits for a reindex in progress, so it can't swap in an index missing
+ * them. Without an index yet, the whole registry is indexed.
+ */
+func (b *ociBackend) indexCharts(mds []*util.ChartMetadata, refs []ociChartRef) error {
+
+	b.reindexLock.Lock()
+	defer b.reindexLock.Unlock()
+
+	b.indexLock.RLock()
+	indexed := b.index != nil
+	b.indexLock.RUnlock()
+	if !indexed {
+		return b.reindex()
+	}
+
+	b.indexLock.Lock()
+	defer b.indexLock.Unlock()
+
+	for n, md := range mds {
+		filename := md.ChartFilename()
+		b.index.Add(md, util.ChartURL(b.config.BaseURL, filename), strings.TrimPrefix(refs[n].digest, "sha256:"))
+		b.charts[filename] = refs[n]
+	}
+	b.index.SortEntries()
+	b.generation++
+
+	return nil
+}
+
+/*
+ * Delete charts:
+ *
+ * 1. delete the manifest of every chart version
+ * 2. reindex
+ */
+func (b *ociBackend) DeleteCharts(filenames ...string) error {
+
+	for _, filename := range filenames {
+		b.indexLock.RLock()
+		ref, ok := b.charts[filename]
+		b.indexLock.RUnlock()
+
+		if !ok {
+			log.Warnf("not deleting unknown chart %s", filename)
+			continue
+		}
+
+		// manifests are deleted by digest, not tag
+		manifest, err := b.registry.GetManifest(ref.repository, ref.tag)
+		if err != nil {
+			return err
+		}
+		err = b.registry.DeleteManifest(ref.repository, "sha256:"+util.Digest(manifest))
+		if err != nil {
+			return err
+		}
+	}
+
+	return b.Reindex()
+}
+
+/*
+ * Reindex repository, waiting for a reindex in progress
+ */
+func (b *ociBackend) Reindex() error {
+
+	b.reindexLock.Lock()
+	defer b.reindexLock.Unlock()
+
+	return b.reindex()
+}
+
+/*
+ * Reindex repository, unless a reindex is in progress
+ */
+func (b *ociBackend) TryReindex() (bool, error) {
+
+	if !b.reindexLock.TryLock() {
+		return false, nil
+	}
+	defer b.reindexLock.Unlock()
+
+	return true, b.reindex()
+}
+
+/*
+ * Reindex repository:
+ *
+ * 1. list chart repositories under the namespace
+ * 2. read chart metadata from every tag
+ * 3. swap in the new index
+ */
+func (b *ociBackend) reindex() error {
+
+	log.Info("reindexing...")
+
+	repositories, err := b.registry.Catalog()
+	if err != nil {
+		return err
+	}
+
+	index := util.NewIndexFile()
+	charts := map[string]ociChartRef{}
+
+	for _, repository := range repositories {
+		if !b.ownsRepository(repository) {
+			continue
+		}
+
+		tags, err := b.registry.Tags(repository)
+		if err != nil {
+			return err
+		}
+
+		for _, tag := range tags {
+			md, layer, err := b.readChart(repository, tag)
+			if err != nil {
+				return err
+			}
+			if md == nil {
+				continue
+			}
+
+			filename := md.ChartFilename()
+			index.Add(md, util.ChartURL(b.config.BaseURL, filename), strings.TrimPrefix(layer.Digest, "sha256:"))
+			charts[filename] = ociChartRef{repository: repository, tag: tag, digest: layer.Digest}
+		}
+	}
+
+	index.SortEntries()
+
+	b.indexLock.Lock()
+	b.index = index
+	b.charts = charts
+	b.generation++
+	b.indexLock.Unlock()
+
+	log.Info("done reindexing")
+
+	return nil
+}
+
+/*
+ * read chart metadata and the chart layer descriptor for a tag, returns
+ * nil metadata if the tag is not a helm chart
+ */
+func (b *ociBackend) readChart(repository string, tag string) (*util.ChartMetadata, *ociDescriptor, error) {
+
+	data, err := b.registry.GetManifest(repository, tag)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	manifest := &ociManifest{}
+	err = json.Unmarshal(data, manifest)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if manifest.Config.MediaType != helmConfigMediaType {
+		log.Debugf("skipping non chart artifact %s:%s", repository, tag)
+		return nil, nil, nil
+	}
+
+	var layer *ociDescriptor
+	for n := range manifest.Layers {
+		if manifest.Layers[n].MediaType == helmChartMediaType {
+			layer = &manifest.Layers[n]
+		}
+	}
+	if layer == nil {
+		log.Warnf("chart %s:%s has no chart layer", repository, tag)
+		return nil, nil, nil
+	}
+
+	configData, err := b.registry.GetBlob(repository, manifest.Config.Digest)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	md := &util.ChartMetadata{}
+	err = json.Unmarshal(configData, md)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return md, layer, nil
+}
+
+func (b *ociBackend) repository(chart string) string {
+	return path.Join(b.config.OCI.Namespace, chart)
+}
+
+// only repositories directly under the namespace hold charts
+func (b *ociBackend) ownsRepository(repository string) bool {
+
+	namespace := strings.Trim(b.config.OCI.Namespace, "/")
+	if namespace == "" {
+		return !strings.Contains(repository, "/")
+	}
+
+	name := strings.TrimPrefix(repository, namespace+"/")
+	return name != repository && !strings.Contains(name, "/")
+}
+
+// oci tags can't contain '+', so build metadata is stored with '_' as helm does
+func versionTag(version string) string {
+	return strings.Replace(version, "+", "_", -1)
+}
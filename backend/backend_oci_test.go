@@ -0,0 +1,483 @@
+package backend
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zlangbert/hrp/config"
+	"github.com/zlangbert/hrp/util"
+)
+
+func TestOCI_New(t *testing.T) {
+
+	cfg := config.New()
+	cfg.OCI.Registry = "localhost:5000"
+
+	b, err := newOCI(cfg)
+
+	assert.NotNil(t, b, "backend not nil")
+	assert.Nil(t, err, "err nil")
+}
+
+func TestOCI_New_ConfigVerify_MissingRegistry(t *testing.T) {
+
+	cfg := config.New()
+
+	_, err := newOCI(cfg)
+
+	assert.Error(t, err, "missing config returns error")
+	assert.Contains(t,
+		err.Error(),
+		"registry missing",
+		"expected registry missing error")
+}
+
+func TestOCIBackend_PutChart(t *testing.T) {
+
+	registry := newRegistryStub()
+	server := httptest.NewServer(registry)
+	defer server.Close()
+
+	b := testOCIBackend(server)
+	chart := testChartArchive("my-chart", "1.2.3+build.1")
+
+	// run
+	err := b.PutChart("my-chart-1.2.3+build.1.tgz", bytes.NewReader(chart), int64(len(chart)))
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+	assert.Contains(t, registry.manifests, "charts/my-chart:1.2.3_build.1", "expected tagged manifest")
+
+	manifest := &ociManifest{}
+	json.Unmarshal(registry.manifests["charts/my-chart:1.2.3_build.1"], manifest)
+	assert.Equal(t, helmConfigMediaType, manifest.Config.MediaType)
+	if assert.Len(t, manifest.Layers, 1) {
+		assert.Equal(t, helmChartMediaType, manifest.Layers[0].MediaType)
+		assert.Equal(t, "sha256:"+util.Digest(chart), manifest.Layers[0].Digest)
+	}
+}
+
+func TestOCIBackend_PutChart_UpdatesIndex(t *testing.T) {
+
+	registry := newRegistryStub()
+	server := httptest.NewServer(registry)
+	defer server.Close()
+
+	b := testOCIBackend(server)
+	putTestChart(b, "a-1.0.0.tgz", testChartArchive("a", "1.0.0"))
+	catalogRequests := registry.catalogRequests
+	chart := testChartArchive("a", "1.1.0")
+
+	// run
+	err := putTestChart(b, "a-1.1.0.tgz", chart)
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+	assert.Equal(t, catalogRequests, registry.catalogRequests, "expected no reindex")
+
+	data, err := b.GetIndex()
+	assert.Nil(t, err, "expected nil err")
+	index, err := util.ParseIndex(data)
+	assert.Nil(t, err, "expected nil err")
+	if assert.Len(t, index.Entries["a"], 2, "expected both versions") {
+		assert.Equal(t, "1.1.0", index.Entries["a"][0].Version, "expected newest version first")
+		assert.Equal(t, util.Digest(chart), index.Entries["a"][0].Digest, "expected chart digest")
+	}
+
+	served, err := b.GetChart("a-1.1.0.tgz")
+	assert.Nil(t, err, "expected nil err")
+	assert.Equal(t, chart, served, "expected pushed chart served")
+}
+
+func TestOCIBackend_GetIndex(t *testing.T) {
+
+	registry := newRegistryStub()
+	server := httptest.NewServer(registry)
+	defer server.Close()
+
+	b := testOCIBackend(server)
+	putTestChart(b, "a-1.0.0.tgz", testChartArchive("a", "1.0.0"))
+	putTestChart(b, "a-1.1.0.tgz", testChartArchive("a", "1.1.0"))
+	putTestChart(b, "b-0.1.0.tgz", testChartArchive("b", "0.1.0"))
+
+	// a repository outside the namespace is ignored
+	registry.manifests["other/c:1.0.0"] = registry.manifests["charts/b:0.1.0"]
+
+	// run
+	b.Reindex()
+	data, err := b.GetIndex()
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+
+	index, err := util.ParseIndex(data)
+	assert.Nil(t, err, "expected valid index")
+	assert.Len(t, index.Entries, 2)
+	if assert.Len(t, index.Entries["a"], 2) {
+		assert.Equal(t, "1.1.0", index.Entries["a"][0].Version, "expected newest version first")
+		assert.Equal(t, []string{"http://localhost:1323/a-1.1.0.tgz"}, index.Entries["a"][0].URLs)
+	}
+	assert.Equal(t,
+		util.Digest(testChartArchive("b", "0.1.0")),
+		index.Entries["b"][0].Digest,
+		"expected digest of chart archive")
+}
+
+func TestOCIBackend_GetIndexWithGeneration(t *testing.T) {
+
+	registry := newRegistryStub()
+	server := httptest.NewServer(registry)
+	defer server.Close()
+
+	b := testOCIBackend(server)
+
+	// run
+	b.Reindex()
+	_, first, err := b.GetIndexWithGeneration()
+	assert.Nil(t, err, "expected nil err")
+
+	putTestChart(b, "a-1.0.0.tgz", testChartArchive("a", "1.0.0"))
+	_, second, _ := b.GetIndexWithGeneration()
+
+	// check
+	assert.True(t, second > first, "expected generation incremented by reindex")
+}
+
+func TestOCIBackend_GetChart(t *testing.T) {
+
+	registry := newRegistryStub()
+	server := httptest.NewServer(registry)
+	defer server.Close()
+
+	b := testOCIBackend(server)
+	chart := testChartArchive("my-chart", "1.2.3")
+	b.PutChart("my-chart-1.2.3.tgz", bytes.NewReader(chart), int64(len(chart)))
+
+	// run
+	result, err := b.GetChart("my-chart-1.2.3.tgz")
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+	assert.Equal(t, chart, result)
+}
+
+func TestOCIBackend_GetChart_NotFound(t *testing.T) {
+
+	registry := newRegistryStub()
+	server := httptest.NewServer(registry)
+	defer server.Close()
+
+	b := testOCIBackend(server)
+	b.Initialize()
+
+	// run
+	result, err := b.GetChart("missing-1.0.0.tgz")
+
+	// check
+	assert.Nil(t, result, "nil result")
+	if assert.Error(t, err, "expected error") {
+		assert.Contains(t, err.Error(), "chart not found")
+	}
+}
+
+func TestOCIBackend_DeleteCharts(t *testing.T) {
+
+	registry := newRegistryStub()
+	server := httptest.NewServer(registry)
+	defer server.Close()
+
+	b := testOCIBackend(server)
+	putTestChart(b, "a-1.0.0.tgz", testChartArchive("a", "1.0.0"))
+	putTestChart(b, "a-1.1.0.tgz", testChartArchive("a", "1.1.0"))
+
+	// run
+	err := b.DeleteCharts("a-1.0.0.tgz", "missing-1.0.0.tgz")
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+	assert.NotContains(t, registry.manifests, "charts/a:1.0.0", "expected deleted manifest")
+	assert.Contains(t, registry.manifests, "charts/a:1.1.0", "expected kept manifest")
+
+	_, err = b.GetChart("a-1.0.0.tgz")
+	assert.Error(t, err, "expected chart removed from index")
+}
+
+func TestOCIBackend_PutChart_InvalidArchive(t *testing.T) {
+
+	registry := newRegistryStub()
+	server := httptest.NewServer(registry)
+	defer server.Close()
+
+	b := testOCIBackend(server)
+
+	// run
+	err := putTestChart(b, "bad.tgz", []byte("not a chart"))
+
+	// check
+	assert.Error(t, err, "expected error")
+	assert.Empty(t, registry.manifests, "expected nothing pushed")
+}
+
+func TestOCIBackend_PutCharts(t *testing.T) {
+
+	registry := newRegistryStub()
+	server := httptest.NewServer(registry)
+	defer server.Close()
+
+	b := testOCIBackend(server)
+
+	// run
+	errs := b.PutCharts([]*ChartFile{
+		testChartFile("a-1.0.0.tgz", testChartArchive("a", "1.0.0")),
+		testChartFile("bad.tgz", []byte("not a chart")),
+		testChartFile("b-0.1.0.tgz", testChartArchive("b", "0.1.0")),
+	}, false)
+
+	// check
+	assert.Nil(t, errs[0], "expected first chart stored")
+	assert.Error(t, errs[1], "expected invalid archive error")
+	assert.Nil(t, errs[2], "expected last chart stored")
+
+	_, err := b.GetChart("b-0.1.0.tgz")
+	assert.Nil(t, err, "expected chart in index")
+}
+
+func TestOCIBackend_PutCharts_Atomic(t *testing.T) {
+
+	registry := newRegistryStub()
+	server := httptest.NewServer(registry)
+	defer server.Close()
+
+	b := testOCIBackend(server)
+
+	// run
+	errs := b.PutCharts([]*ChartFile{
+		testChartFile("a-1.0.0.tgz", testChartArchive("a", "1.0.0")),
+		testChartFile("bad.tgz", []byte("not a chart")),
+	}, true)
+
+	// check
+	assert.Equal(t, ErrBatchAborted, errs[0])
+	assert.Error(t, errs[1], "expected invalid archive error")
+	assert.Empty(t, registry.manifests, "expected nothing pushed")
+}
+
+func TestOCIBackend_PutCharts_AtomicRestoresReplaced(t *testing.T) {
+
+	registry := newRegistryStub()
+	server := httptest.NewServer(registry)
+	defer server.Close()
+
+	b := testOCIBackend(server)
+	assert.Nil(t, putTestChart(b, "a-1.0.0.tgz", testChartArchive("a", "1.0.0")), "expected chart put")
+	original := registry.manifests["charts/a:1.0.0"]
+	registry.rejected["charts/b:0.1.0"] = true
+
+	// run
+	errs := b.PutCharts([]*ChartFile{
+		testChartFile("a-1.0.0.tgz", testChartArchiveWithFiles("a", map[string]string{
+			"Chart.yaml": "name: a\nversion: 1.0.0\ndescription: replaced\n",
+		})),
+		testChartFile("b-0.1.0.tgz", testChartArchive("b", "0.1.0")),
+	}, true)
+
+	// check
+	assert.Equal(t, ErrBatchAborted, errs[0])
+	assert.Error(t, errs[1], "expected push error")
+	assert.Equal(t, original, registry.manifests["charts/a:1.0.0"], "expected replaced manifest restored")
+	assert.Len(t, registry.manifests, 1, "expected nothing else tagged")
+}
+
+//
+// helpers
+//
+
+func testOCIBackend(server *httptest.Server) *ociBackend {
+	cfg := config.New()
+	cfg.BaseURL = "http://localhost:1323"
+	cfg.OCI.Registry = strings.TrimPrefix(server.URL, "http://")
+	cfg.OCI.Namespace = "charts"
+	cfg.OCI.PlainHTTP = true
+
+	b, _ := newOCI(cfg)
+	return b
+}
+
+// testChartArchive builds a minimal packaged chart
+func testChartArchive(name string, version string) []byte {
+	return testChartArchiveWithFiles(name, map[string]string{
+		"Chart.yaml":  fmt.Sprintf("name: %s\nversion: %s\ndescription: test chart\n", name, version),
+		"values.yaml": "replicas: 1\n",
+	})
+}
+
+func testChartArchiveWithFiles(name string, files map[string]string) []byte {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+
+	filenames := []string{}
+	for filename := range files {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+
+	for _, filename := range filenames {
+		content := files[filename]
+		tw.WriteHeader(&tar.Header{
+			Name:     name + "/" + filename,
+			Mode:     0644,
+			Size:     int64(len(content)),
+			Typeflag: tar.TypeReg,
+		})
+		tw.Write([]byte(content))
+	}
+
+	tw.Close()
+	gz.Close()
+
+	return buf.Bytes()
+}
+
+// put a chart held in memory
+func putTestChart(b Backend, filename string, data []byte) error {
+	return b.PutChart(filename, bytes.NewReader(data), int64(len(data)))
+}
+
+func testChartFile(filename string, data []byte) *ChartFile {
+	return &ChartFile{Filename: filename, File: bytes.NewReader(data), Size: int64(len(data))}
+}
+
+// registryStub is an in-process registry implementing the subset of the
+// distribution api used by the oci backend
+type registryStub struct {
+	lock      sync.Mutex
+	blobs     map[string][]byte
+	manifests map[string][]byte
+
+	// manifest references that fail to be put
+	rejected map[string]bool
+
+	// how often the catalog was listed
+	catalogRequests int
+}
+
+func newRegistryStub() *registryStub {
+	return &registryStub{
+		blobs:     map[string][]byte{},
+		manifests: map[string][]byte{},
+		rejected:  map[string]bool{},
+	}
+}
+
+func (r *registryStub) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	p := strings.TrimPrefix(req.URL.Path, "/v2/")
+
+	switch {
+	case p == "_catalog":
+		r.catalogRequests++
+		repositories := map[string]bool{}
+		for ref := range r.manifests {
+			repositories[strings.SplitN(ref, ":", 2)[0]] = true
+		}
+		result := []string{}
+		for repository := range repositories {
+			result = append(result, repository)
+		}
+		sort.Strings(result)
+		json.NewEncoder(w).Encode(map[string][]string{"repositories": result})
+
+	case strings.HasSuffix(p, "/tags/list"):
+		repository := strings.TrimSuffix(p, "/tags/list")
+		tags := []string{}
+		for ref := range r.manifests {
+			parts := strings.SplitN(ref, ":", 2)
+			if parts[0] == repository {
+				tags = append(tags, parts[1])
+			}
+		}
+		sort.Strings(tags)
+		json.NewEncoder(w).Encode(map[string]interface{}{"name": repository, "tags": tags})
+
+	case strings.Contains(p, "/manifests/"):
+		parts := strings.SplitN(p, "/manifests/", 2)
+		ref := parts[0] + ":" + parts[1]
+		if req.Method == "PUT" {
+			if r.rejected[ref] {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			body, _ := ioutil.ReadAll(req.Body)
+			r.manifests[ref] = body
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		if req.Method == "DELETE" {
+			// deleting by digest removes every tag of the manifest
+			deleted := false
+			for tagged, manifest := range r.manifests {
+				if strings.HasPrefix(tagged, parts[0]+":") && "sha256:"+util.Digest(manifest) == parts[1] {
+					delete(r.manifests, tagged)
+					deleted = true
+				}
+			}
+			if !deleted {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		manifest, ok := r.manifests[ref]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", util.OCIManifestMediaType)
+		w.Write(manifest)
+
+	case strings.Contains(p, "/blobs/uploads/"):
+		if req.Method == "POST" {
+			w.Header().Set("Location", "/v2/"+p+"upload-id")
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		digest := req.URL.Query().Get("digest")
+		if digest != "sha256:"+util.Digest(body) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.blobs[digest] = body
+		w.WriteHeader(http.StatusCreated)
+
+	case strings.Contains(p, "/blobs/"):
+		digest := p[strings.LastIndex(p, "/")+1:]
+		blob, ok := r.blobs[digest]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if req.Method == "HEAD" {
+			return
+		}
+		w.Write(blob)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
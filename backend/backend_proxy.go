@@ -0,0 +1,333 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zlangbert/hrp/config"
+	"github.com/zlangbert/hrp/util"
+)
+
+// how long an upstream request may take when no timeout is configured
+const defaultUpstreamTimeout = 30 * time.Second
+
+var (
+	// ErrReadOnly is returned when writing to a repository that can't be written to
+	ErrReadOnly = errors.New("repository is read-only")
+)
+
+type proxyBackend struct {
+	config   *config.AppConfig
+	upstream *url.URL
+	cache    Store
+	client   *http.Client
+
+	// the rewritten upstream index, refreshed when older than the ttl. The
+	// lock only guards these fields, upstream is never requested holding it.
+	indexLock *sync.Mutex
+	index     *util.IndexFile
+	fetched   time.Time
+	urls      map[string]string
+
+	// the last failed refresh, upstream isn't retried for a while after one
+	failed time.Time
+
+	// the refresh in progress, concurrent callers wait for it instead of
+	// requesting upstream again
+	refreshing *indexRefresh
+}
+
+// an upstream index refresh, done is closed once err is set
+type indexRefresh struct {
+	done chan struct{}
+	err  error
+}
+
+func newProxy(config *config.AppConfig, upstream string, cache Backend) (*proxyBackend, error) {
+
+	// validate config
+	upstreamURL, err := url.Parse(strings.TrimSuffix(upstream, "/") + "/")
+	if err != nil || upstreamURL.Host == "" {
+		return nil, fmt.Errorf("proxy config - invalid upstream url: %s", upstream)
+	}
+
+	store, ok := cache.(Store)
+	if !ok {
+		return nil, fmt.Errorf("proxy config - %s backend can't cache upstream content", config.BackendName)
+	}
+
+	return &proxyBackend{
+		config:   config,
+		upstream: upstreamURL,
+		cache:    store,
+		client:   &http.Client{Timeout: upstreamTimeout(config)},
+
+		indexLock: &sync.Mutex{},
+		urls:      map[string]string{},
+	}, nil
+}
+
+/*
+ * Initialize backend
+ */
+func (b *proxyBackend) Initialize() error {
+
+	log.Infof("initializing proxy to %s...", b.upstream)
+
+	// an unreachable upstream shouldn't keep the rest of hrp from starting
+	err := b.Reindex()
+	if err != nil {
+		log.Warnf("upstream %s unavailable, serving from cache: %s", b.upstream, err.Error())
+	}
+
+	return nil
+}
+
+/*
+ * Get index:
+ *
+ * 1. refresh from upstream if stale, unless a refresh failed recently
+ * 2. fall back to the last good copy when upstream is down
+ */
+func (b *proxyBackend) GetIndex() ([]byte, error) {
+
+	b.indexLock.Lock()
+	stale := b.index == nil || time.Since(b.fetched) > b.config.Upstream.IndexTTL
+	retry := time.Since(b.failed) >= b.config.Upstream.RetryDelay
+	b.indexLock.Unlock()
+
+	if stale && retry {
+		err := b.refresh()
+		if err != nil {
+			log.Warnf("failed refreshing index from %s: %s", b.upstream, err.Error())
+			b.indexLock.Lock()
+			b.failed = time.Now()
+			b.indexLock.Unlock()
+		}
+	}
+
+	b.indexLock.Lock()
+	index := b.index
+	b.indexLock.Unlock()
+
+	if index == nil {
+		var err error
+		index, err = b.loadCachedIndex()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return index.Marshal()
+}
+
+/*
+ * Get chart:
+ *
+ * serve from the cache, or fetch from upstream and cache it
+ */
+func (b *proxyBackend) GetChart(name string) ([]byte, error) {
+
+	data, err := b.cache.GetFile(name)
+	if err == nil {
+		return data, nil
+	}
+
+	b.indexLock.Lock()
+	chartURL, ok := b.urls[name]
+	b.indexLock.Unlock()
+	if !ok {
+		chartURL = b.upstream.String() + name
+	}
+
+	data, err = b.fetch(chartURL)
+	if err != nil {
+		return nil, err
+	}
+
+	err = b.cache.PutFile(name, data)
+	if err != nil {
+		log.Errorf("failed caching chart %s: %s", name, err.Error())
+	}
+
+	return data, nil
+}
+
+/*
+ * Put chart:
+ *
+ * upstream repositories are read-only
+ */
+func (b *proxyBackend) PutChart(filename string, file io.Reader, size int64) error {
+	return ErrReadOnly
+}
+
+/*
+ * Delete charts:
+ *
+ * upstream repositories are read-only
+ */
+func (b *proxyBackend) DeleteCharts(filenames ...string) error {
+	return ErrReadOnly
+}
+
+/*
+ * Reindex repository:
+ *
+ * force a refresh of the upstream index
+ */
+func (b *proxyBackend) Reindex() error {
+	return b.refresh()
+}
+
+/*
+ * refresh the index from upstream, or wait for the refresh in progress.
+ * Upstream is requested without holding the index lock, so a slow upstream
+ * only holds up the callers waiting for its index.
+ */
+func (b *proxyBackend) refresh() error {
+
+	b.indexLock.Lock()
+	r := b.refreshing
+	if r != nil {
+		b.indexLock.Unlock()
+		<-r.done
+		return r.err
+	}
+	r = &indexRefresh{done: make(chan struct{})}
+	b.refreshing = r
+	b.indexLock.Unlock()
+
+	r.err = b.refreshIndex()
+
+	b.indexLock.Lock()
+	b.refreshing = nil
+	b.indexLock.Unlock()
+	close(r.done)
+
+	return r.err
+}
+
+func (b *proxyBackend) refreshIndex() error {
+
+	data, err := b.fetch(b.upstream.String() + util.HelmIndexFilename)
+	if err != nil {
+		return err
+	}
+
+	index, urls, err := b.rewriteIndex(data)
+	if err != nil {
+		return err
+	}
+
+	b.indexLock.Lock()
+	b.setIndex(index, urls)
+	b.indexLock.Unlock()
+
+	// keep the last good copy for when upstream is down
+	err = b.cache.PutFile(util.HelmIndexFilename, data)
+	if err != nil {
+		log.Errorf("failed caching index: %s", err.Error())
+	}
+
+	return nil
+}
+
+/*
+ * use the last good copy of the index, unless a refresh got one meanwhile
+ */
+func (b *proxyBackend) loadCachedIndex() (*util.IndexFile, error) {
+
+	data, err := b.cache.GetFile(util.HelmIndexFilename)
+	if err != nil {
+		return nil, fmt.Errorf("upstream %s unavailable and no cached index", b.upstream)
+	}
+
+	index, urls, err := b.rewriteIndex(data)
+	if err != nil {
+		return nil, err
+	}
+
+	b.indexLock.Lock()
+	defer b.indexLock.Unlock()
+
+	if b.index == nil {
+		b.setIndex(index, urls)
+	}
+
+	return b.index, nil
+}
+
+/*
+ * parse an upstream index and rewrite chart urls to point at this repository,
+ * returning the upstream url of every chart
+ */
+func (b *proxyBackend) rewriteIndex(data []byte) (*util.IndexFile, map[string]string, error) {
+
+	index, err := util.ParseIndex(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	urls := map[string]string{}
+	for _, versions := range index.Entries {
+		for _, cv := range versions {
+			rewritten := []string{}
+			for _, u := range cv.URLs {
+				ref, err := url.Parse(u)
+				if err != nil {
+					log.Warnf("skipping invalid chart url %s", u)
+					continue
+				}
+				absolute := b.upstream.ResolveReference(ref)
+				filename := path.Base(absolute.Path)
+
+				urls[filename] = absolute.String()
+				rewritten = append(rewritten, util.ChartURL(b.config.BaseURL, filename))
+			}
+			cv.URLs = rewritten
+		}
+	}
+
+	return index, urls, nil
+}
+
+// swap in a rewritten index, the index lock must be held. The index isn't
+// changed after, so it can be read once the lock is released.
+func (b *proxyBackend) setIndex(index *util.IndexFile, urls map[string]string) {
+	b.index = index
+	b.urls = urls
+	b.fetched = time.Now()
+}
+
+// requests to upstream always time out, so a hung upstream can't hold up a refresh
+func upstreamTimeout(config *config.AppConfig) time.Duration {
+	if config.Upstream.Timeout > 0 {
+		return config.Upstream.Timeout
+	}
+	return defaultUpstreamTimeout
+}
+
+func (b *proxyBackend) fetch(u string) ([]byte, error) {
+
+	resp, err := b.client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upstream request %s returned %d", u, resp.StatusCode)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
@@ -0,0 +1,376 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zlangbert/hrp/config"
+	"github.com/zlangbert/hrp/util"
+)
+
+func TestProxy_New_InvalidUpstream(t *testing.T) {
+
+	_, err := newProxy(testProxyConfig(), "not a url", newMemoryStore())
+
+	if assert.Error(t, err, "expected error") {
+		assert.Contains(t, err.Error(), "invalid upstream url")
+	}
+}
+
+func TestProxy_New_CacheNotAStore(t *testing.T) {
+
+	_, err := newProxy(testProxyConfig(), "http://upstream", new(backendStub))
+
+	if assert.Error(t, err, "expected error") {
+		assert.Contains(t, err.Error(), "can't cache upstream content")
+	}
+}
+
+func TestProxyBackend_GetIndex_RewritesURLs(t *testing.T) {
+
+	upstream := newUpstreamStub()
+	server := httptest.NewServer(upstream)
+	defer server.Close()
+
+	cache := newMemoryStore()
+	b, _ := newProxy(testProxyConfig(), server.URL+"/charts", cache)
+
+	// run
+	data, err := b.GetIndex()
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+	index, _ := util.ParseIndex(data)
+	assert.Equal(t,
+		[]string{"http://localhost:1323/stable/relative-1.0.0.tgz"},
+		index.Entries["relative"][0].URLs)
+	assert.Equal(t,
+		[]string{"http://localhost:1323/stable/absolute-1.0.0.tgz"},
+		index.Entries["absolute"][0].URLs)
+	assert.Equal(t,
+		server.URL+"/charts/relative-1.0.0.tgz",
+		b.urls["relative-1.0.0.tgz"])
+	assert.Contains(t, cache.files, "index.yaml", "expected upstream index cached")
+}
+
+func TestProxyBackend_GetIndex_KeepsUnknownFields(t *testing.T) {
+
+	upstream := newUpstreamStub()
+	server := httptest.NewServer(upstream)
+	defer server.Close()
+
+	b, _ := newProxy(testProxyConfig(), server.URL+"/charts", newMemoryStore())
+
+	// run
+	data, err := b.GetIndex()
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+	index, _ := util.ParseIndex(data)
+	if assert.Len(t, index.Entries["relative"], 1) {
+		assert.Equal(t, ">=1.10", index.Entries["relative"][0].Extra["kubeVersion"])
+		assert.NotNil(t, index.Entries["relative"][0].Extra["dependencies"], "expected dependencies kept")
+	}
+}
+
+func TestProxyBackend_GetIndex_UpstreamDown(t *testing.T) {
+
+	upstream := newUpstreamStub()
+	server := httptest.NewServer(upstream)
+
+	cache := newMemoryStore()
+	b, _ := newProxy(testProxyConfig(), server.URL+"/charts", cache)
+	b.GetIndex()
+	server.Close()
+
+	// a fresh instance only has the cache to go on
+	b, _ = newProxy(testProxyConfig(), server.URL+"/charts", cache)
+
+	// run
+	data, err := b.GetIndex()
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+	index, _ := util.ParseIndex(data)
+	assert.Len(t, index.Entries, 2)
+}
+
+func TestProxyBackend_GetIndex_UpstreamDownNoCache(t *testing.T) {
+
+	server := httptest.NewServer(newUpstreamStub())
+	server.Close()
+
+	b, _ := newProxy(testProxyConfig(), server.URL, newMemoryStore())
+
+	// run
+	data, err := b.GetIndex()
+
+	// check
+	assert.Nil(t, data, "nil result")
+	if assert.Error(t, err, "expected error") {
+		assert.Contains(t, err.Error(), "no cached index")
+	}
+}
+
+func TestProxyBackend_GetIndex_CachedWithinTTL(t *testing.T) {
+
+	upstream := newUpstreamStub()
+	server := httptest.NewServer(upstream)
+	defer server.Close()
+
+	b, _ := newProxy(testProxyConfig(), server.URL+"/charts", newMemoryStore())
+
+	// run
+	b.GetIndex()
+	b.GetIndex()
+
+	// check
+	assert.Equal(t, 1, upstream.requests["/charts/index.yaml"], "expected a single upstream request")
+}
+
+func TestProxyBackend_GetIndex_SlowUpstream(t *testing.T) {
+
+	upstream := newUpstreamStub()
+	upstream.indexBlock = make(chan struct{})
+	server := httptest.NewServer(upstream)
+	defer server.Close()
+
+	b, _ := newProxy(testProxyConfig(), server.URL+"/charts", newMemoryStore())
+
+	// run
+	results := make(chan error, 2)
+	for n := 0; n < 2; n++ {
+		go func() {
+			_, err := b.GetIndex()
+			results <- err
+		}()
+	}
+	for upstream.count("/charts/index.yaml") == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	chart, err := b.GetChart("relative-1.0.0.tgz")
+	close(upstream.indexBlock)
+
+	// check
+	assert.Nil(t, err, "expected charts served while the index is fetched")
+	assert.Equal(t, []byte("relative chart"), chart)
+	assert.Nil(t, <-results, "expected nil err")
+	assert.Nil(t, <-results, "expected nil err")
+	assert.Equal(t, 1, upstream.count("/charts/index.yaml"), "expected a single upstream request")
+}
+
+func TestProxyBackend_GetIndex_UpstreamDownBacksOff(t *testing.T) {
+
+	upstream := newUpstreamStub()
+	server := httptest.NewServer(upstream)
+	defer server.Close()
+
+	b, _ := newProxy(testProxyConfig(), server.URL+"/charts", newMemoryStore())
+	b.GetIndex()
+
+	// upstream starts failing once the index is stale
+	b.upstream.Path = "/missing/"
+	b.fetched = time.Now().Add(-time.Hour)
+
+	// run
+	first, err := b.GetIndex()
+	second, _ := b.GetIndex()
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+	assert.NotEmpty(t, first, "expected the last good index")
+	assert.Equal(t, first, second)
+	assert.Equal(t, 1, upstream.requests["/missing/index.yaml"], "expected no retry within the retry delay")
+
+	// retried once the delay passed
+	b.failed = time.Now().Add(-time.Hour)
+	b.GetIndex()
+	assert.Equal(t, 2, upstream.requests["/missing/index.yaml"], "expected a retry after the retry delay")
+}
+
+func TestProxyBackend_GetChart(t *testing.T) {
+
+	upstream := newUpstreamStub()
+	server := httptest.NewServer(upstream)
+	defer server.Close()
+
+	cache := newMemoryStore()
+	b, _ := newProxy(testProxyConfig(), server.URL+"/charts", cache)
+	b.GetIndex()
+
+	// run
+	first, err := b.GetChart("relative-1.0.0.tgz")
+	second, _ := b.GetChart("relative-1.0.0.tgz")
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+	assert.Equal(t, []byte("relative chart"), first)
+	assert.Equal(t, first, second)
+	assert.Equal(t, 1, upstream.requests["/charts/relative-1.0.0.tgz"], "expected chart served from cache")
+	assert.Equal(t, first, cache.files["relative-1.0.0.tgz"])
+}
+
+func TestProxyBackend_GetChart_UpstreamMissing(t *testing.T) {
+
+	server := httptest.NewServer(newUpstreamStub())
+	defer server.Close()
+
+	b, _ := newProxy(testProxyConfig(), server.URL+"/charts", newMemoryStore())
+
+	// run
+	result, err := b.GetChart("missing-1.0.0.tgz")
+
+	// check
+	assert.Nil(t, result, "nil result")
+	if assert.Error(t, err, "expected error") {
+		assert.Contains(t, err.Error(), "returned 404")
+	}
+}
+
+func TestProxyBackend_PutChart(t *testing.T) {
+
+	b, _ := newProxy(testProxyConfig(), "http://upstream", newMemoryStore())
+
+	err := b.PutChart("test", new(fileMock), 0)
+
+	assert.Equal(t, ErrReadOnly, err)
+}
+
+//
+// helpers
+//
+
+func testProxyConfig() *config.AppConfig {
+	cfg := config.New()
+	cfg.BaseURL = "http://localhost:1323"
+	cfg.BackendName = "s3"
+	cfg.Upstream.IndexTTL = time.Minute
+	cfg.Upstream.Timeout = time.Second
+	cfg.Upstream.RetryDelay = time.Minute
+
+	return cfg.ForRepository("stable", "stable")
+}
+
+// upstreamStub serves a classic helm repository under /charts
+type upstreamStub struct {
+	lock     sync.Mutex
+	requests map[string]int
+
+	// when set, index requests wait for it to be closed
+	indexBlock chan struct{}
+}
+
+func newUpstreamStub() *upstreamStub {
+	return &upstreamStub{requests: map[string]int{}}
+}
+
+func (u *upstreamStub) count(path string) int {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.requests[path]
+}
+
+func (u *upstreamStub) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	u.lock.Lock()
+	u.requests[req.URL.Path]++
+	u.lock.Unlock()
+
+	switch req.URL.Path {
+	case "/charts/index.yaml":
+		if u.indexBlock != nil {
+			<-u.indexBlock
+		}
+		fmt.Fprintf(w, `apiVersion: v1
+entries:
+  relative:
+  - name: relative
+    version: 1.0.0
+    kubeVersion: '>=1.10'
+    dependencies:
+    - name: nginx
+      version: ^1.2.0
+    urls:
+    - relative-1.0.0.tgz
+  absolute:
+  - name: absolute
+    version: 1.0.0
+    urls:
+    - http://%s/charts/absolute-1.0.0.tgz
+`, req.Host)
+	case "/charts/relative-1.0.0.tgz":
+		w.Write([]byte("relative chart"))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// memoryStore is an in memory Backend and Store
+type memoryStore struct {
+	lock  sync.Mutex
+	files map[string][]byte
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{files: map[string][]byte{}}
+}
+
+func (m *memoryStore) Initialize() error {
+	return nil
+}
+
+func (m *memoryStore) GetIndex() ([]byte, error) {
+	return m.GetFile(util.HelmIndexFilename)
+}
+
+func (m *memoryStore) GetChart(name string) ([]byte, error) {
+	return m.GetFile(name)
+}
+
+func (m *memoryStore) PutChart(filename string, file io.Reader, size int64) error {
+	return errors.New("not implemented")
+}
+
+func (m *memoryStore) DeleteCharts(filenames ...string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, filename := range filenames {
+		delete(m.files, filename)
+	}
+	return nil
+}
+
+func (m *memoryStore) Reindex() error {
+	return nil
+}
+
+func (m *memoryStore) GetFile(name string) ([]byte, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	data, ok := m.files[name]
+	if !ok {
+		return nil, ErrFileNotFound
+	}
+	return data, nil
+}
+
+func (m *memoryStore) PutFile(name string, data []byte) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.files[name] = data
+	return nil
+}
+
+// backendStub is a Backend with no Store support
+type backendStub struct {
+	Backend
+}
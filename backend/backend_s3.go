@@ -1,29 +1,53 @@
 package backend
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
 	"io/ioutil"
-	"mime/multipart"
+	"net/url"
+	"path"
 	"path/filepath"
 
 	"errors"
+	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
+	"github.com/aws/aws-sdk-go/service/sqs"
 	log "github.com/sirupsen/logrus"
 	"github.com/zlangbert/hrp/config"
+	"github.com/zlangbert/hrp/lock"
 	"github.com/zlangbert/hrp/util"
-	"sync"
+)
+
+const (
+	// uploads are staged here until indexed, out of reach of helm's *.tgz glob
+	s3StagingDir = ".hrp-staging"
 )
 
 type s3Backend struct {
 	config   *config.AppConfig
 	svc      s3iface.S3API
+	uploader s3manageriface.UploaderAPI
 	awsUtil  util.AwsUtil
 	helmUtil util.HelmUtil
 
-	reindexLock *sync.Mutex
+	reindexLock *tryMutex
+
+	// updates the index from s3 event notifications, nil when not configured
+	events *s3EventConsumer
+
+	// index lock shared with other replicas, nil when not configured
+	locker lock.Locker
+
+	// the shared lock held by the index update in progress, guarded by reindexLock
+	lease *lock.Lease
 }
 
 func newS3(config *config.AppConfig) (*s3Backend, error) {
@@ -38,6 +62,9 @@ func newS3(config *config.AppConfig) (*s3Backend, error) {
 	if config.S3.LocalSyncPath == "" {
 		return nil, errors.New("s3 config - local sync path missing")
 	}
+	if config.S3.SSEKMSKeyID != "" && config.S3.ServerSideEncryption != s3.ServerSideEncryptionAwsKms {
+		return nil, errors.New("s3 config - kms key id requires aws:kms server side encryption")
+	}
 
 	// create aws session
 	awsConfig := &aws.Config{Region: aws.String(config.S3.Region)}
@@ -47,14 +74,29 @@ func newS3(config *config.AppConfig) (*s3Backend, error) {
 		return nil, errors.New("failed to create aws session")
 	}
 
-	return &s3Backend{
-		svc:      s3.New(awsSession),
+	locker, err := lock.New(config)
+	if err != nil {
+		return nil, err
+	}
+
+	svc := s3.New(awsSession)
+
+	b := &s3Backend{
+		svc:      svc,
+		uploader: s3manager.NewUploaderWithClient(svc),
 		config:   config,
 		awsUtil:  util.NewAwsUtil(config.Debug),
 		helmUtil: util.NewHelmUtil(config.Debug),
 
-		reindexLock: &sync.Mutex{},
-	}, nil
+		reindexLock: newTryMutex(),
+		locker:      locker,
+	}
+
+	if config.S3.SQSQueueURL != "" {
+		b.events = newS3EventConsumer(b, sqs.New(awsSession))
+	}
+
+	return b, nil
 }
 
 /*
@@ -69,6 +111,10 @@ func (b *s3Backend) Initialize() error {
 		return handleAwsError(err)
 	}
 
+	if b.events != nil {
+		b.events.start()
+	}
+
 	return nil
 }
 
@@ -94,6 +140,39 @@ func (b *s3Backend) GetChart(name string) ([]byte, error) {
 	return b.getFile(key)
 }
 
+/*
+ * Get file:
+ *
+ * read an arbitrary file from s3
+ */
+func (b *s3Backend) GetFile(name string) ([]byte, error) {
+
+	key := filepath.Join(b.config.S3.Prefix, name)
+	data, err := b.getFile(key)
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == s3.ErrCodeNoSuchKey {
+		return nil, ErrFileNotFound
+	}
+
+	return data, err
+}
+
+/*
+ * Put file:
+ *
+ * write an arbitrary file to s3, without reindexing
+ */
+func (b *s3Backend) PutFile(name string, data []byte) error {
+
+	key := filepath.Join(b.config.S3.Prefix, name)
+
+	_, err := b.svc.PutObject(b.putObjectInput(key, bytes.NewReader(data)))
+	if err != nil {
+		return handleAwsError(err)
+	}
+
+	return nil
+}
+
 func (b *s3Backend) getFile(key string) ([]byte, error) {
 	result, err := b.svc.GetObject(&s3.GetObjectInput{
 		Bucket: &b.config.S3.Bucket,
@@ -115,49 +194,424 @@ func (b *s3Backend) getFile(key string) ([]byte, error) {
 /*
  * Put chart:
  *
- * 1. upload chart to s3
- * 2. reindex
+ * 1. upload chart to a staging key
+ * 2. copy the chart and provenance file it replaces aside, if any
+ * 3. promote the staged chart to its final key, write its provenance file
+ * 4. add chart to the index
+ *
+ * a failed step rolls back the ones before it, so the chart is either
+ * published and indexed or the bucket holds what it did before. The index
+ * never lists a chart before it can be downloaded.
  */
-func (b *s3Backend) PutChart(filename string, file multipart.File) error {
+func (b *s3Backend) PutChart(filename string, file io.Reader, size int64) error {
+	return b.PutCharts([]*ChartFile{{Filename: filename, File: file, Size: size}}, true)[0]
+}
 
-	key := filepath.Join(b.config.S3.Prefix, filename)
+/*
+ * Put charts:
+ *
+ * like putting a single chart, but every chart is staged before all of
+ * them are added to the index in a single write
+ */
+func (b *s3Backend) PutCharts(charts []*ChartFile, atomic bool) []error {
+
+	// staging keys are unique, so charts are streamed to s3 without holding any lock
+	uploads := make([]*s3Upload, len(charts))
+	for n, chart := range charts {
+		uploads[n] = &s3Upload{filename: chart.Filename, prov: chart.Provenance}
+		if !atomic || !batchFailed(uploads[:n]) {
+			b.stageChart(uploads[n], chart)
+		}
+	}
+	defer func() {
+		for _, u := range uploads {
+			if u.staged != "" {
+				b.deleteObject(u.staged)
+			}
+		}
+	}()
+
+	if !atomic || !batchFailed(uploads) {
+		b.reindexLock.Lock()
+		defer b.reindexLock.Unlock()
+
+		err := b.withSharedLock(func() error {
+			b.putCharts(pending(uploads), atomic)
+			return nil
+		})
+		for _, u := range pending(uploads) {
+			u.err = err
+		}
+	}
 
-	_, err := b.svc.PutObject(&s3.PutObjectInput{
-		Bucket: &b.config.S3.Bucket,
-		Key:    &key,
-		Body:   file,
+	errs := make([]error, len(uploads))
+	for n, u := range uploads {
+		errs[n] = u.err
+		if atomic && u.err == nil && batchFailed(uploads) {
+			errs[n] = ErrBatchAborted
+		}
+	}
+
+	return errs
+}
+
+// a chart on its way into the bucket
+type s3Upload struct {
+	filename string
+	md       *util.ChartMetadata
+	digest   string
+
+	// where the chart is staged and where the object it replaces was copied
+	// aside, if any
+	staged string
+	backup string
+
+	// the provenance file written next to the chart, if any, and where the
+	// one it replaces was copied aside
+	prov       []byte
+	provBackup string
+
+	err error
+}
+
+func batchFailed(uploads []*s3Upload) bool {
+	for _, u := range uploads {
+		if u.err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// the uploads that haven't failed so far
+func pending(uploads []*s3Upload) []*s3Upload {
+	ok := []*s3Upload{}
+	for _, u := range uploads {
+		if u.err == nil {
+			ok = append(ok, u)
+		}
+	}
+	return ok
+}
+
+/*
+ * stream a chart to a staging key, reading its digest and metadata as it
+ * passes by. Big charts are uploaded in parts.
+ */
+func (b *s3Backend) stageChart(u *s3Upload, chart *ChartFile) {
+
+	hash := sha256.New()
+	size := &byteCounter{}
+	pr, pw := io.Pipe()
+
+	metadata := make(chan error, 1)
+	go func() {
+		var err error
+		u.md, err = util.ReadChartMetadata(pr)
+		io.Copy(ioutil.Discard, pr)
+		metadata <- err
+	}()
+
+	staged := filepath.Join(b.config.S3.Prefix, s3StagingDir, newRandomID())
+	body := io.TeeReader(chart.File, io.MultiWriter(hash, size, pw))
+
+	_, err := b.uploader.Upload(b.uploadInput(staged, body))
+	pw.CloseWithError(err)
+	mdErr := <-metadata
+	if err != nil {
+		u.err = handleAwsError(err)
+		return
+	}
+	u.staged = staged
+	u.digest = hex.EncodeToString(hash.Sum(nil))
+
+	switch {
+	case mdErr != nil:
+		u.err = mdErr
+	case chart.Size > 0 && size.n != chart.Size:
+		u.err = fmt.Errorf("read %d bytes of chart %s, expected %d", size.n, u.filename, chart.Size)
+	}
+}
+
+type byteCounter struct {
+	n int64
+}
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+func (b *s3Backend) putCharts(uploads []*s3Upload, atomic bool) {
+
+	if len(uploads) == 0 {
+		return
+	}
+
+	// the charts being replaced are copied aside first, so they can be put
+	// back if the batch aborts or the index can't be written
+	defer func() {
+		for _, u := range uploads {
+			if u.backup != "" {
+				b.deleteObject(u.backup)
+			}
+			if u.provBackup != "" {
+				b.deleteObject(u.provBackup)
+			}
+		}
+	}()
+	for _, u := range uploads {
+		if err := b.backupChart(u); err != nil {
+			u.err = err
+			if atomic {
+				return
+			}
+		}
+	}
+
+	// promote
+	promoted := []*s3Upload{}
+	for _, u := range pending(uploads) {
+		if err := b.promoteChart(u); err != nil {
+			u.err = err
+			if atomic {
+				break
+			}
+			continue
+		}
+		promoted = append(promoted, u)
+	}
+	if atomic && batchFailed(uploads) {
+		b.restoreCharts(promoted)
+		return
+	}
+
+	// index
+	err := b.modifyIndex(func(index *util.IndexFile) error {
+		for _, u := range promoted {
+			index.Add(u.md, util.ChartURL(b.config.BaseURL, u.filename), u.digest)
+		}
+		return nil
 	})
 	if err != nil {
-		return handleAwsError(err)
+		b.restoreCharts(promoted)
+		for _, u := range promoted {
+			u.err = err
+		}
+		return
+	}
+
+	for _, u := range promoted {
+		log.Infof("published chart %s", u.filename)
 	}
+}
 
-	err = b.Reindex()
+/*
+ * copy a staged chart to its final key and write its provenance file. A
+ * provenance file that can't be written takes the chart back out.
+ */
+func (b *s3Backend) promoteChart(u *s3Upload) error {
+
+	key := filepath.Join(b.config.S3.Prefix, u.filename)
+	_, err := b.svc.CopyObject(b.copyObjectInput(u.staged, key))
 	if err != nil {
 		return handleAwsError(err)
 	}
 
+	if u.prov != nil {
+		_, err = b.svc.PutObject(b.putObjectInput(key+util.ProvenanceExtension, bytes.NewReader(u.prov)))
+		if err != nil {
+			b.restoreCharts([]*s3Upload{u})
+			return handleAwsError(err)
+		}
+	}
+
 	return nil
 }
 
 /*
- * Reindex repository:
+ * undo promoting charts: the ones that replaced a chart put it back from
+ * its backup, new ones are removed from the bucket again. Provenance files
+ * written with them go the same way.
+ */
+func (b *s3Backend) restoreCharts(uploads []*s3Upload) {
+
+	for _, u := range uploads {
+		key := filepath.Join(b.config.S3.Prefix, u.filename)
+		b.restoreObject(key, u.backup)
+		if u.prov != nil {
+			b.restoreObject(key+util.ProvenanceExtension, u.provBackup)
+		}
+	}
+}
+
+func (b *s3Backend) restoreObject(key string, backup string) {
+
+	if backup == "" {
+		b.deleteObject(key)
+		return
+	}
+	if _, err := b.svc.CopyObject(b.copyObjectInput(backup, key)); err != nil {
+		log.Errorf("failed restoring %s replaced by a failed upload, reupload it to repair: %s",
+			key, handleAwsError(err).Error())
+	}
+}
+
+/*
+ * copy the chart and provenance file an upload is about to replace aside,
+ * if there are any
+ */
+func (b *s3Backend) backupChart(u *s3Upload) error {
+
+	key := filepath.Join(b.config.S3.Prefix, u.filename)
+
+	var err error
+	u.backup, err = b.backupObject(key)
+	if err != nil || u.prov == nil {
+		return err
+	}
+	u.provBackup, err = b.backupObject(key + util.ProvenanceExtension)
+
+	return err
+}
+
+// copy an object aside, returning where to, or nothing if there's no such object
+func (b *s3Backend) backupObject(key string) (string, error) {
+
+	backup := filepath.Join(b.config.S3.Prefix, s3StagingDir, newRandomID())
+
+	_, err := b.svc.CopyObject(b.copyObjectInput(key, backup))
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == s3.ErrCodeNoSuchKey {
+		return "", nil
+	}
+	if err != nil {
+		return "", handleAwsError(err)
+	}
+
+	return backup, nil
+}
+
+func (b *s3Backend) deleteObject(key string) {
+
+	_, err := b.svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: &b.config.S3.Bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		log.Warnf("failed deleting %s: %s", key, handleAwsError(err).Error())
+	}
+}
+
+/*
+ * Delete charts:
  *
- * 1. sync bucket locally
- * 2. regenerate index
- * 3. sync index back to s3
+ * 1. delete charts and their provenance files from s3
+ * 2. reindex
+ */
+func (b *s3Backend) DeleteCharts(filenames ...string) error {
+
+	b.reindexLock.Lock()
+	defer b.reindexLock.Unlock()
+
+	return b.withSharedLock(func() error {
+		return b.deleteCharts(filenames)
+	})
+}
+
+func (b *s3Backend) deleteCharts(filenames []string) error {
+
+	// s3 deletes at most 1000 keys per request
+	objects := []*s3.ObjectIdentifier{}
+	for _, filename := range filenames {
+		for _, name := range []string{filename, filename + util.ProvenanceExtension} {
+			objects = append(objects, &s3.ObjectIdentifier{
+				Key: aws.String(filepath.Join(b.config.S3.Prefix, name)),
+			})
+		}
+	}
+
+	for len(objects) > 0 {
+		batch := objects
+		if len(batch) > 1000 {
+			batch = objects[:1000]
+		}
+		objects = objects[len(batch):]
+
+		out, err := b.svc.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: &b.config.S3.Bucket,
+			Delete: &s3.Delete{
+				Objects: batch,
+				Quiet:   aws.Bool(true),
+			},
+		})
+		if err != nil {
+			return handleAwsError(err)
+		}
+		if len(out.Errors) > 0 {
+			return fmt.Errorf("failed deleting %s: %s", aws.StringValue(out.Errors[0].Key), aws.StringValue(out.Errors[0].Message))
+		}
+	}
+
+	return b.reindex()
+}
+
+/*
+ * Reindex repository, waiting for a reindex in progress
  */
 func (b *s3Backend) Reindex() error {
 
 	b.reindexLock.Lock()
 	defer b.reindexLock.Unlock()
 
+	return b.withSharedLock(b.reindex)
+}
+
+/*
+ * Reindex repository, unless a reindex is in progress
+ */
+func (b *s3Backend) TryReindex() (bool, error) {
+
+	if !b.reindexLock.TryLock() {
+		return false, nil
+	}
+	defer b.reindexLock.Unlock()
+
+	return true, b.withSharedLock(b.reindex)
+}
+
+/*
+ * Reindex repository:
+ *
+ * 1. sync bucket locally
+ * 2. regenerate index
+ * 3. sync index back to s3, starting over if it changed meanwhile
+ */
+func (b *s3Backend) reindex() error {
+
 	log.Info("reindexing...")
 
+	err := retryIndexConflicts(b.regenerateIndex)
+	if err != nil {
+		return err
+	}
+
+	log.Info("done reindexing")
+
+	return nil
+}
+
+func (b *s3Backend) regenerateIndex() error {
+
+	base, err := b.headIndex()
+	if err != nil {
+		return err
+	}
+
 	source := "s3://" + filepath.Join(b.config.S3.Bucket, b.config.S3.Prefix)
 	target := b.config.S3.LocalSyncPath
 
 	// local bucket sync
-	err := b.awsUtil.Sync(source, target)
+	err = b.awsUtil.Sync(source, target)
 	if err != nil {
 		return err
 	}
@@ -175,20 +629,111 @@ func (b *s3Backend) Reindex() error {
 	}
 
 	// upload new index
-	key := filepath.Join(b.config.S3.Prefix, util.HelmIndexFilename)
-	_, err = b.svc.PutObject(&s3.PutObjectInput{
+	return b.putIndex(indexData, base)
+}
+
+/*
+ * run f holding the index lock shared with other replicas, if one is
+ * configured, so their index writes don't drop each other's charts. The
+ * caller holds reindexLock, the lease is checked before every index write
+ * in case it was lost meanwhile.
+ */
+func (b *s3Backend) withSharedLock(f func() error) error {
+
+	if b.locker == nil {
+		return f()
+	}
+
+	lease, err := b.locker.Acquire("index/" + path.Join(b.config.S3.Bucket, b.config.S3.Prefix))
+	if err != nil {
+		return err
+	}
+	b.lease = lease
+	defer func() {
+		b.lease = nil
+		lease.Release()
+	}()
+
+	return f()
+}
+
+/*
+ * build a put request with the configured upload options applied
+ */
+func (b *s3Backend) putObjectInput(key string, body io.ReadSeeker) *s3.PutObjectInput {
+
+	input := &s3.PutObjectInput{
 		Bucket: &b.config.S3.Bucket,
 		Key:    &key,
-		Body:   indexData,
-	})
+		Body:   body,
+	}
 
-	if err != nil {
-		return handleAwsError(err)
+	if b.config.S3.ServerSideEncryption != "" {
+		input.ServerSideEncryption = aws.String(b.config.S3.ServerSideEncryption)
+	}
+	if b.config.S3.SSEKMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(b.config.S3.SSEKMSKeyID)
+	}
+	if b.config.S3.ACL != "" {
+		input.ACL = aws.String(b.config.S3.ACL)
+	}
+	if b.config.S3.StorageClass != "" {
+		input.StorageClass = aws.String(b.config.S3.StorageClass)
+	}
+	if len(b.config.S3.Tags) > 0 {
+		tags := url.Values{}
+		for k, v := range b.config.S3.Tags {
+			tags.Set(k, v)
+		}
+		input.Tagging = aws.String(tags.Encode())
 	}
 
-	log.Info("done reindexing")
+	return input
+}
 
-	return nil
+/*
+ * managed upload of an object, with the same upload options as
+ * putObjectInput
+ */
+func (b *s3Backend) uploadInput(key string, body io.Reader) *s3manager.UploadInput {
+
+	put := b.putObjectInput(key, nil)
+
+	return &s3manager.UploadInput{
+		Bucket:               put.Bucket,
+		Key:                  put.Key,
+		Body:                 body,
+		ServerSideEncryption: put.ServerSideEncryption,
+		SSEKMSKeyId:          put.SSEKMSKeyId,
+		ACL:                  put.ACL,
+		StorageClass:         put.StorageClass,
+		Tagging:              put.Tagging,
+	}
+}
+
+/*
+ * server side copy of an object, with the same upload options as
+ * putObjectInput
+ */
+func (b *s3Backend) copyObjectInput(source string, key string) *s3.CopyObjectInput {
+
+	put := b.putObjectInput(key, nil)
+
+	input := &s3.CopyObjectInput{
+		Bucket:               put.Bucket,
+		Key:                  put.Key,
+		CopySource:           aws.String((&url.URL{Path: path.Join(b.config.S3.Bucket, source)}).EscapedPath()),
+		ServerSideEncryption: put.ServerSideEncryption,
+		SSEKMSKeyId:          put.SSEKMSKeyId,
+		ACL:                  put.ACL,
+		StorageClass:         put.StorageClass,
+	}
+	if put.Tagging != nil {
+		input.Tagging = put.Tagging
+		input.TaggingDirective = aws.String(s3.TaggingDirectiveReplace)
+	}
+
+	return input
 }
 
 /*
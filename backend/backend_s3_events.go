@@ -0,0 +1,270 @@
+package backend
+
+import (
+	"encoding/json"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	log "github.com/sirupsen/logrus"
+	"github.com/zlangbert/hrp/util"
+)
+
+var (
+	// how long to back off after failing to receive from the queue
+	s3EventsRetryDelay = 5 * time.Second
+)
+
+// s3 event notification as delivered to sqs
+type s3EventNotification struct {
+	Records []s3EventRecord `json:"Records"`
+}
+
+type s3EventRecord struct {
+	EventName string `json:"eventName"`
+	S3        struct {
+		Bucket struct {
+			Name string `json:"name"`
+		} `json:"bucket"`
+		Object struct {
+			Key string `json:"key"`
+		} `json:"object"`
+	} `json:"s3"`
+}
+
+/*
+ * s3EventConsumer keeps the index up to date from s3 event notifications
+ * instead of full reindexes. Messages are only deleted once handled, so
+ * every event is applied at least once, and messages that keep failing are
+ * logged and dropped after the configured number of receives.
+ */
+type s3EventConsumer struct {
+	backend     *s3Backend
+	svc         sqsiface.SQSAPI
+	queueURL    string
+	maxReceives int
+}
+
+func newS3EventConsumer(b *s3Backend, svc sqsiface.SQSAPI) *s3EventConsumer {
+	return &s3EventConsumer{
+		backend:     b,
+		svc:         svc,
+		queueURL:    b.config.S3.SQSQueueURL,
+		maxReceives: b.config.S3.SQSMaxReceives,
+	}
+}
+
+func (c *s3EventConsumer) start() {
+
+	log.Infof("consuming s3 events from %s", c.queueURL)
+
+	go func() {
+		for {
+			err := c.poll()
+			if err != nil {
+				log.Errorf("failed receiving s3 events: %s", err.Error())
+				time.Sleep(s3EventsRetryDelay)
+			}
+		}
+	}()
+}
+
+/*
+ * receive a batch of messages and handle each of them
+ */
+func (c *s3EventConsumer) poll() error {
+
+	out, err := c.svc.ReceiveMessage(&sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(c.queueURL),
+		MaxNumberOfMessages: aws.Int64(10),
+		WaitTimeSeconds:     aws.Int64(20),
+		AttributeNames:      []*string{aws.String(sqs.MessageSystemAttributeNameApproximateReceiveCount)},
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range out.Messages {
+		err := c.handle(aws.StringValue(msg.Body))
+		if err != nil {
+			receives, _ := strconv.Atoi(aws.StringValue(msg.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]))
+			if receives < c.maxReceives {
+				// left on the queue, it is redelivered once its visibility timeout expires
+				log.Warnf("failed handling s3 event %s, attempt %d: %s",
+					aws.StringValue(msg.MessageId), receives, err.Error())
+				continue
+			}
+			log.WithFields(log.Fields{
+				"messageId": aws.StringValue(msg.MessageId),
+				"receives":  receives,
+				"body":      aws.StringValue(msg.Body),
+			}).Errorf("dead-lettering s3 event: %s", err.Error())
+		}
+
+		_, err = c.svc.DeleteMessage(&sqs.DeleteMessageInput{
+			QueueUrl:      aws.String(c.queueURL),
+			ReceiptHandle: msg.ReceiptHandle,
+		})
+		if err != nil {
+			log.Errorf("failed deleting s3 event %s: %s", aws.StringValue(msg.MessageId), err.Error())
+		}
+	}
+
+	return nil
+}
+
+/*
+ * apply the chart changes of a notification to the index, notifications
+ * without records, such as the s3:TestEvent, are ignored
+ */
+func (c *s3EventConsumer) handle(body string) error {
+
+	notification := &s3EventNotification{}
+	err := json.Unmarshal([]byte(body), notification)
+	if err != nil {
+		return err
+	}
+
+	created := []string{}
+	removed := []string{}
+	for _, record := range notification.Records {
+		filename, ok := c.chartFilename(record)
+		if !ok {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(record.EventName, "ObjectCreated:"):
+			created = append(created, filename)
+		case strings.HasPrefix(record.EventName, "ObjectRemoved:"):
+			removed = append(removed, filename)
+		}
+	}
+
+	if len(created) == 0 && len(removed) == 0 {
+		return nil
+	}
+
+	return c.backend.updateIndex(created, removed)
+}
+
+/*
+ * the filename of the chart an event is about, only charts directly under
+ * the prefix are part of the repository
+ */
+func (c *s3EventConsumer) chartFilename(record s3EventRecord) (string, bool) {
+
+	if record.S3.Bucket.Name != c.backend.config.S3.Bucket {
+		return "", false
+	}
+
+	// keys in notifications are url encoded
+	key, err := url.QueryUnescape(record.S3.Object.Key)
+	if err != nil {
+		return "", false
+	}
+
+	if path.Dir(key) != path.Clean(c.backend.config.S3.Prefix) || path.Ext(key) != ".tgz" {
+		return "", false
+	}
+
+	return path.Base(key), true
+}
+
+/*
+ * Update index:
+ *
+ * 1. read the index from s3
+ * 2. add created and drop removed charts
+ * 3. write the index back to s3, starting over if it changed meanwhile
+ */
+func (b *s3Backend) updateIndex(created []string, removed []string) error {
+
+	b.reindexLock.Lock()
+	defer b.reindexLock.Unlock()
+
+	return b.withSharedLock(func() error {
+		return b.applyIndexChanges(created, removed)
+	})
+}
+
+func (b *s3Backend) applyIndexChanges(created []string, removed []string) error {
+
+	err := b.modifyIndex(func(index *util.IndexFile) error {
+
+		for _, filename := range removed {
+			// events are delivered at least once and out of order, a removal
+			// can arrive after the chart was uploaded again
+			exists, err := b.objectExists(filepath.Join(b.config.S3.Prefix, filename))
+			if err != nil {
+				return err
+			}
+			if exists {
+				log.Debugf("not removing %s from the index, it exists again", filename)
+				continue
+			}
+
+			if cv := index.FindByFilename(filename); cv != nil {
+				index.Remove(cv.Name, cv.Version)
+			}
+		}
+
+		for _, filename := range created {
+			chart, err := b.getFile(filepath.Join(b.config.S3.Prefix, filename))
+			if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == s3.ErrCodeNoSuchKey {
+				// removed again before we got to it, its removal event follows
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			md, err := util.LoadChartMetadata(chart)
+			if err != nil {
+				log.Warnf("not indexing invalid chart %s: %s", filename, err.Error())
+				continue
+			}
+			// copies and redelivered events re-add charts as they were, which
+			// doesn't make them any newer
+			digest := util.Digest(chart)
+			previous := index.Get(md.Name, md.Version)
+			cv := index.Add(md, util.ChartURL(b.config.BaseURL, filename), digest)
+			if previous != nil && previous.Digest == digest {
+				cv.Created = previous.Created
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Infof("updated index, %d charts added, %d removed", len(created), len(removed))
+
+	return nil
+}
+
+func (b *s3Backend) objectExists(key string) (bool, error) {
+
+	_, err := b.svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: &b.config.S3.Bucket,
+		Key:    &key,
+	})
+	if awsErr, ok := err.(awserr.Error); ok && (awsErr.Code() == "NotFound" || awsErr.Code() == s3.ErrCodeNoSuchKey) {
+		return false, nil
+	}
+	if err != nil {
+		return false, handleAwsError(err)
+	}
+
+	return true, nil
+}
@@ -0,0 +1,426 @@
+package backend
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/stretchr/testify/assert"
+	"github.com/zlangbert/hrp/util"
+)
+
+func TestS3EventConsumer_Handle_Created(t *testing.T) {
+
+	b, objects := testEventsBackend()
+	objects.put("prefix/a-1.1.0.tgz", testChartArchive("a", "1.1.0"))
+	c := newS3EventConsumer(b, newSQSFake())
+
+	// run
+	err := c.handle(testS3Event("ObjectCreated:Put", "bucket-test", "prefix/a-1.1.0.tgz"))
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+
+	index := objects.index(t)
+	if assert.Len(t, index.Entries["a"], 2) {
+		assert.Equal(t, "1.1.0", index.Entries["a"][0].Version, "expected newest version first")
+		assert.Equal(t, []string{"http://localhost:1323/a-1.1.0.tgz"}, index.Entries["a"][0].URLs)
+		assert.Equal(t, util.Digest(testChartArchive("a", "1.1.0")), index.Entries["a"][0].Digest)
+	}
+}
+
+func TestS3EventConsumer_Handle_CopyKeepsCreated(t *testing.T) {
+
+	b, objects := testEventsBackend()
+	chart := testChartArchive("a", "1.0.0")
+	objects.put("prefix/a-1.0.0.tgz", chart)
+
+	created := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	index := util.NewIndexFile()
+	index.Add(&util.ChartMetadata{Name: "a", Version: "1.0.0"}, "http://localhost:1323/a-1.0.0.tgz", util.Digest(chart)).Created = created
+	data, _ := index.Marshal()
+	objects.put("prefix/index.yaml", data)
+	c := newS3EventConsumer(b, newSQSFake())
+
+	// run
+	err := c.handle(testS3Event("ObjectCreated:Copy", "bucket-test", "prefix/a-1.0.0.tgz"))
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+	if entries := objects.index(t).Entries["a"]; assert.Len(t, entries, 1) {
+		assert.True(t, created.Equal(entries[0].Created), "expected unchanged chart to keep its creation time")
+	}
+
+	// a changed chart is new
+	changed := testChartArchiveWithFiles("a", map[string]string{
+		"Chart.yaml": "name: a\nversion: 1.0.0\ndescription: changed\n",
+	})
+	objects.put("prefix/a-1.0.0.tgz", changed)
+	err = c.handle(testS3Event("ObjectCreated:Put", "bucket-test", "prefix/a-1.0.0.tgz"))
+	assert.Nil(t, err, "expected nil err")
+	if entries := objects.index(t).Entries["a"]; assert.Len(t, entries, 1) {
+		assert.True(t, entries[0].Created.After(created), "expected changed chart to be created anew")
+		assert.Equal(t, util.Digest(changed), entries[0].Digest)
+	}
+}
+
+func TestS3EventConsumer_Handle_Removed(t *testing.T) {
+
+	b, objects := testEventsBackend()
+	c := newS3EventConsumer(b, newSQSFake())
+
+	// run
+	err := c.handle(testS3Event("ObjectRemoved:Delete", "bucket-test", "prefix/a-1.0.0.tgz"))
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+	assert.Empty(t, objects.index(t).Entries["a"], "expected chart removed")
+}
+
+func TestS3EventConsumer_Handle_RemovedAfterCreated(t *testing.T) {
+
+	b, objects := testEventsBackend()
+	objects.put("prefix/a-1.1.0.tgz", testChartArchive("a", "1.1.0"))
+	c := newS3EventConsumer(b, newSQSFake())
+	c.handle(testS3Event("ObjectCreated:Put", "bucket-test", "prefix/a-1.1.0.tgz"))
+
+	// run, the removal of an earlier copy of the chart arrives late
+	err := c.handle(testS3Event("ObjectRemoved:Delete", "bucket-test", "prefix/a-1.1.0.tgz"))
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+	index := objects.index(t)
+	if assert.Len(t, index.Entries["a"], 2, "expected live chart kept") {
+		assert.Equal(t, "1.1.0", index.Entries["a"][0].Version)
+	}
+}
+
+func TestS3EventConsumer_Handle_CreatedThenRemoved(t *testing.T) {
+
+	b, objects := testEventsBackend()
+	c := newS3EventConsumer(b, newSQSFake())
+
+	// run
+	err := c.handle(testS3Event("ObjectCreated:Put", "bucket-test", "prefix/a-1.1.0.tgz"))
+
+	// check
+	assert.Nil(t, err, "expected missing chart skipped")
+	assert.Len(t, objects.index(t).Entries["a"], 1)
+}
+
+func TestS3EventConsumer_Handle_Ignored(t *testing.T) {
+
+	b, objects := testEventsBackend()
+	c := newS3EventConsumer(b, newSQSFake())
+
+	for _, body := range []string{
+		`{"Service":"Amazon S3","Event":"s3:TestEvent","Bucket":"bucket-test"}`,
+		testS3Event("ObjectCreated:Put", "other-bucket", "prefix/b-1.0.0.tgz"),
+		testS3Event("ObjectCreated:Put", "bucket-test", "prefix/team-a/b-1.0.0.tgz"),
+		testS3Event("ObjectCreated:Put", "bucket-test", "prefix/b-1.0.0.tgz.prov"),
+		testS3Event("ObjectCreated:Put", "bucket-test", "other/b-1.0.0.tgz"),
+	} {
+		err := c.handle(body)
+		assert.Nil(t, err, "expected nil err")
+	}
+
+	assert.Equal(t, 0, objects.puts, "expected index untouched")
+}
+
+func TestS3EventConsumer_Handle_EncodedKey(t *testing.T) {
+
+	b, objects := testEventsBackend()
+	objects.put("prefix/a-1.1.0+build.1.tgz", testChartArchive("a", "1.1.0+build.1"))
+	c := newS3EventConsumer(b, newSQSFake())
+
+	// run
+	err := c.handle(testS3Event("ObjectCreated:Put", "bucket-test", "prefix/a-1.1.0%2Bbuild.1.tgz"))
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+	assert.Len(t, objects.index(t).Entries["a"], 2)
+}
+
+func TestS3EventConsumer_Poll(t *testing.T) {
+
+	b, objects := testEventsBackend()
+	objects.put("prefix/a-1.1.0.tgz", testChartArchive("a", "1.1.0"))
+
+	queue := newSQSFake()
+	queue.messages = []*sqs.Message{
+		testSQSMessage("ok", testS3Event("ObjectCreated:Put", "bucket-test", "prefix/a-1.1.0.tgz"), 1),
+		testSQSMessage("retry", "not json", 1),
+		testSQSMessage("dead", "not json", 5),
+	}
+	c := newS3EventConsumer(b, queue)
+	c.maxReceives = 5
+
+	// run
+	err := c.poll()
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+	assert.Equal(t, []string{"ok", "dead"}, queue.deleted, "expected failed message left for redelivery")
+	assert.Len(t, objects.index(t).Entries["a"], 2)
+}
+
+func TestS3EventConsumer_Poll_ReceiveError(t *testing.T) {
+
+	b, _ := testEventsBackend()
+	queue := newSQSFake()
+	queue.err = awserr.New("-1", "aws test service error", nil)
+	c := newS3EventConsumer(b, queue)
+
+	// run
+	err := c.poll()
+
+	// check
+	assert.Error(t, err, "expected receive error")
+}
+
+//
+// helpers
+//
+
+// s3 backend with an index holding a-1.0.0
+func testEventsBackend() (*s3Backend, *s3Fake) {
+
+	cfg := testConfig()
+	cfg.BaseURL = "http://localhost:1323"
+	b, _ := newS3(cfg)
+
+	objects := newS3Fake()
+	b.svc = objects
+	b.uploader = objects
+
+	index := util.NewIndexFile()
+	index.Add(&util.ChartMetadata{Name: "a", Version: "1.0.0"}, "http://localhost:1323/a-1.0.0.tgz", "")
+	data, _ := index.Marshal()
+	objects.put("prefix/index.yaml", data)
+	objects.puts = 0
+	objects.putInputs = nil
+
+	return b, objects
+}
+
+func testS3Event(name string, bucket string, key string) string {
+	return fmt.Sprintf(`{"Records":[{"eventName":%q,"s3":{"bucket":{"name":%q},"object":{"key":%q}}}]}`,
+		name, bucket, key)
+}
+
+func testSQSMessage(id string, body string, receives int) *sqs.Message {
+	return &sqs.Message{
+		MessageId:     aws.String(id),
+		ReceiptHandle: aws.String(id),
+		Body:          aws.String(body),
+		Attributes: map[string]*string{
+			sqs.MessageSystemAttributeNameApproximateReceiveCount: aws.String(fmt.Sprint(receives)),
+		},
+	}
+}
+
+// s3Fake is an in memory bucket
+type s3Fake struct {
+	s3iface.S3API
+	s3manageriface.UploaderAPI
+
+	lock     sync.Mutex
+	objects  map[string][]byte
+	metadata map[string]map[string]*string
+	puts     int
+
+	// called before every head, with the lock released
+	beforeHead func(key string)
+
+	// errors to fail calls with, by operation and key
+	errors map[string]error
+
+	// inputs of every put and copy
+	putInputs  []*s3.PutObjectInput
+	copyInputs []*s3.CopyObjectInput
+}
+
+func newS3Fake() *s3Fake {
+	return &s3Fake{
+		objects:  map[string][]byte{},
+		metadata: map[string]map[string]*string{},
+		errors:   map[string]error{},
+	}
+}
+
+func (f *s3Fake) put(key string, data []byte) {
+	f.PutObject(&s3.PutObjectInput{Key: aws.String(key), Body: bytes.NewReader(data)})
+}
+
+func (f *s3Fake) index(t *testing.T) *util.IndexFile {
+	index, err := util.ParseIndex(f.objects["prefix/index.yaml"])
+	assert.Nil(t, err, "expected valid index")
+	return index
+}
+
+// how many times the index was written
+func (f *s3Fake) indexWrites() int {
+	writes := 0
+	for _, i := range f.putInputs {
+		if aws.StringValue(i.Key) == "prefix/index.yaml" {
+			writes++
+		}
+	}
+	return writes
+}
+
+func (f *s3Fake) GetObject(i *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	key := aws.StringValue(i.Key)
+	data, ok := f.objects[key]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "not found", nil)
+	}
+	return &s3.GetObjectOutput{
+		Body:     ioutil.NopCloser(bytes.NewReader(data)),
+		ETag:     aws.String(util.Digest(data)),
+		Metadata: f.metadata[key],
+	}, nil
+}
+
+// uploads are recorded as puts, whatever their size
+func (f *s3Fake) Upload(i *s3manager.UploadInput, options ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+	data, err := ioutil.ReadAll(i.Body)
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.PutObject(&s3.PutObjectInput{
+		Bucket:               i.Bucket,
+		Key:                  i.Key,
+		Body:                 bytes.NewReader(data),
+		ServerSideEncryption: i.ServerSideEncryption,
+		SSEKMSKeyId:          i.SSEKMSKeyId,
+		ACL:                  i.ACL,
+		StorageClass:         i.StorageClass,
+		Tagging:              i.Tagging,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &s3manager.UploadOutput{}, nil
+}
+
+func (f *s3Fake) HeadObject(i *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	if f.beforeHead != nil {
+		f.beforeHead(aws.StringValue(i.Key))
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	key := aws.StringValue(i.Key)
+	data, ok := f.objects[key]
+	if !ok {
+		return nil, awserr.New("NotFound", "not found", nil)
+	}
+	return &s3.HeadObjectOutput{
+		ETag:     aws.String(util.Digest(data)),
+		Metadata: f.metadata[key],
+	}, nil
+}
+
+func (f *s3Fake) PutObject(i *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if err := f.errors["PutObject "+aws.StringValue(i.Key)]; err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadAll(i.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.objects[aws.StringValue(i.Key)] = data
+	f.metadata[aws.StringValue(i.Key)] = i.Metadata
+	f.putInputs = append(f.putInputs, i)
+	f.puts++
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *s3Fake) CopyObject(i *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if err := f.errors["CopyObject "+aws.StringValue(i.Key)]; err != nil {
+		return nil, err
+	}
+
+	source, _ := url.PathUnescape(aws.StringValue(i.CopySource))
+	data, ok := f.objects[strings.TrimPrefix(source, aws.StringValue(i.Bucket)+"/")]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "not found", nil)
+	}
+	f.objects[aws.StringValue(i.Key)] = data
+	f.copyInputs = append(f.copyInputs, i)
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func (f *s3Fake) DeleteObject(i *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	delete(f.objects, aws.StringValue(i.Key))
+	delete(f.metadata, aws.StringValue(i.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+// keys of the objects under a prefix
+func (f *s3Fake) keys(prefix string) []string {
+	keys := []string{}
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sqsFake is a queue delivering its messages once
+type sqsFake struct {
+	sqsiface.SQSAPI
+
+	messages []*sqs.Message
+	deleted  []string
+	err      error
+}
+
+func newSQSFake() *sqsFake {
+	return &sqsFake{}
+}
+
+func (f *sqsFake) ReceiveMessage(i *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	messages := f.messages
+	f.messages = nil
+	return &sqs.ReceiveMessageOutput{Messages: messages}, nil
+}
+
+func (f *sqsFake) DeleteMessage(i *sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error) {
+	f.deleted = append(f.deleted, aws.StringValue(i.ReceiptHandle))
+	return &sqs.DeleteMessageOutput{}, nil
+}
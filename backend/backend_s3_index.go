@@ -0,0 +1,212 @@
+package backend
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	log "github.com/sirupsen/logrus"
+	"github.com/zlangbert/hrp/util"
+)
+
+const (
+	// object metadata holding the index generation
+	indexGenerationMetadata = "Hrp-Generation"
+
+	// how often an index write is retried after losing a race with another writer
+	maxIndexWriteAttempts = 3
+)
+
+var (
+	// errIndexConflict is returned when the index was changed outside hrp since it was read
+	errIndexConflict = errors.New("index changed since it was read")
+)
+
+// A GenerationalIndex is a Backend whose index carries a generation, incremented on every write,
+// so clients can tell whether their copy is stale
+type GenerationalIndex interface {
+	GetIndexWithGeneration() ([]byte, int64, error)
+}
+
+/*
+ * the version of the index object a write is based on, etag is empty if
+ * there was no index yet
+ */
+type indexVersion struct {
+	etag       string
+	generation int64
+}
+
+/*
+ * Get index with generation:
+ *
+ * read index and its generation from s3
+ */
+func (b *s3Backend) GetIndexWithGeneration() ([]byte, int64, error) {
+
+	data, version, err := b.getIndexObject()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return data, version.generation, nil
+}
+
+func (b *s3Backend) indexKey() string {
+	return filepath.Join(b.config.S3.Prefix, util.HelmIndexFilename)
+}
+
+/*
+ * read the index along with its version
+ */
+func (b *s3Backend) getIndexObject() ([]byte, *indexVersion, error) {
+
+	result, err := b.svc.GetObject(&s3.GetObjectInput{
+		Bucket: &b.config.S3.Bucket,
+		Key:    aws.String(b.indexKey()),
+	})
+	if err != nil {
+		return nil, nil, handleAwsError(err)
+	}
+	defer result.Body.Close()
+
+	data, err := ioutil.ReadAll(result.Body)
+	if err != nil {
+		return nil, nil, handleAwsError(err)
+	}
+
+	return data, &indexVersion{
+		etag:       aws.StringValue(result.ETag),
+		generation: parseGeneration(result.Metadata),
+	}, nil
+}
+
+/*
+ * read the current version of the index without its content
+ */
+func (b *s3Backend) headIndex() (*indexVersion, error) {
+
+	result, err := b.svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: &b.config.S3.Bucket,
+		Key:    aws.String(b.indexKey()),
+	})
+	if awsErr, ok := err.(awserr.Error); ok && (awsErr.Code() == "NotFound" || awsErr.Code() == s3.ErrCodeNoSuchKey) {
+		return &indexVersion{}, nil
+	}
+	if err != nil {
+		return nil, handleAwsError(err)
+	}
+
+	return &indexVersion{
+		etag:       aws.StringValue(result.ETag),
+		generation: parseGeneration(result.Metadata),
+	}, nil
+}
+
+/*
+ * write the index with the next generation. Writes are exclusive because
+ * every caller holds the reindex lock and, with replicas, the shared lock,
+ * which is checked right before writing, see withSharedLock. The version
+ * check before it only notices the index being rewritten outside hrp while
+ * it was being changed, it can't make concurrent writes safe on its own.
+ */
+func (b *s3Backend) putIndex(data io.ReadSeeker, base *indexVersion) error {
+
+	current, err := b.headIndex()
+	if err != nil {
+		return err
+	}
+	if current.etag != base.etag {
+		return errIndexConflict
+	}
+
+	input := b.putObjectInput(b.indexKey(), data)
+	input.Metadata = map[string]*string{
+		indexGenerationMetadata: aws.String(strconv.FormatInt(base.generation+1, 10)),
+	}
+
+	// another replica may have the shared lock by now
+	if b.lease != nil {
+		err = b.lease.Err()
+		if err != nil {
+			log.Errorf("not writing index, %s", err.Error())
+			return err
+		}
+	}
+
+	_, err = b.svc.PutObject(input)
+	if err != nil {
+		return handleAwsError(err)
+	}
+
+	return nil
+}
+
+/*
+ * read, change and write back the index, starting over if it changed
+ * meanwhile. A missing index is treated as empty.
+ */
+func (b *s3Backend) modifyIndex(change func(index *util.IndexFile) error) error {
+
+	return retryIndexConflicts(func() error {
+
+		data, base, err := b.getIndexObject()
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == s3.ErrCodeNoSuchKey {
+			data, base, err = nil, &indexVersion{}, nil
+		}
+		if err != nil {
+			return err
+		}
+
+		index := util.NewIndexFile()
+		if data != nil {
+			index, err = util.ParseIndex(data)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = change(index)
+		if err != nil {
+			return err
+		}
+
+		index.SortEntries()
+		index.Generated = time.Now()
+
+		data, err = index.Marshal()
+		if err != nil {
+			return err
+		}
+
+		return b.putIndex(bytes.NewReader(data), base)
+	})
+}
+
+/*
+ * run an index write until the index isn't changed outside hrp meanwhile, every
+ * attempt re-reads the index
+ */
+func retryIndexConflicts(write func() error) error {
+
+	for attempt := 1; ; attempt++ {
+		err := write()
+		if err != errIndexConflict || attempt == maxIndexWriteAttempts {
+			return err
+		}
+		log.Warnf("index changed while writing it, retrying (attempt %d)", attempt)
+	}
+}
+
+// metadata keys come back from s3 in canonical header form
+func parseGeneration(metadata map[string]*string) int64 {
+	generation, _ := strconv.ParseInt(aws.StringValue(metadata[indexGenerationMetadata]), 10, 64)
+	return generation
+}
@@ -0,0 +1,124 @@
+package backend
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+	"github.com/zlangbert/hrp/lock"
+	"github.com/zlangbert/hrp/util"
+)
+
+func TestS3Backend_GetIndexWithGeneration(t *testing.T) {
+
+	b, objects := testEventsBackend()
+	objects.put("prefix/a-1.1.0.tgz", testChartArchive("a", "1.1.0"))
+
+	_, generation, err := b.GetIndexWithGeneration()
+	assert.Nil(t, err, "expected nil err")
+	assert.Equal(t, int64(0), generation, "expected index without generation to start at 0")
+
+	// run
+	err = b.updateIndex([]string{"a-1.1.0.tgz"}, nil)
+	assert.Nil(t, err, "expected nil err")
+	err = b.updateIndex(nil, []string{"a-1.0.0.tgz"})
+	assert.Nil(t, err, "expected nil err")
+
+	// check
+	data, generation, err := b.GetIndexWithGeneration()
+	assert.Nil(t, err, "expected nil err")
+	assert.Equal(t, int64(2), generation, "expected generation incremented by every write")
+	assert.Equal(t, objects.objects["prefix/index.yaml"], data)
+}
+
+func TestS3Backend_UpdateIndex_ConflictRetried(t *testing.T) {
+
+	b, objects := testEventsBackend()
+	objects.put("prefix/a-1.1.0.tgz", testChartArchive("a", "1.1.0"))
+
+	// another replica adds b-1.0.0 after we read the index, once
+	raced := false
+	objects.beforeHead = func(key string) {
+		if key != "prefix/index.yaml" || raced {
+			return
+		}
+		raced = true
+
+		index := objects.index(t)
+		index.Add(&util.ChartMetadata{Name: "b", Version: "1.0.0"}, "http://localhost:1323/b-1.0.0.tgz", "")
+		data, _ := index.Marshal()
+		objects.objects["prefix/index.yaml"] = data
+		objects.metadata["prefix/index.yaml"] = map[string]*string{indexGenerationMetadata: aws.String("7")}
+	}
+
+	// run
+	err := b.updateIndex([]string{"a-1.1.0.tgz"}, nil)
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+	index := objects.index(t)
+	assert.Len(t, index.Entries["a"], 2, "expected our change written")
+	assert.Len(t, index.Entries["b"], 1, "expected other replica's change kept")
+
+	_, generation, _ := b.GetIndexWithGeneration()
+	assert.Equal(t, int64(8), generation, "expected generation based on the index re-read")
+}
+
+func TestS3Backend_UpdateIndex_ConflictExhausted(t *testing.T) {
+
+	b, objects := testEventsBackend()
+	objects.put("prefix/a-1.1.0.tgz", testChartArchive("a", "1.1.0"))
+	objects.puts = 0
+
+	// another writer changes the index before every write
+	data := objects.objects["prefix/index.yaml"]
+	objects.beforeHead = func(key string) {
+		data = append(data, []byte("# changed\n")...)
+		objects.objects[key] = data
+	}
+
+	// run
+	err := b.updateIndex([]string{"a-1.1.0.tgz"}, nil)
+
+	// check
+	assert.Equal(t, errIndexConflict, err)
+	assert.Equal(t, 0, objects.puts, "expected index never overwritten")
+}
+
+func TestS3Backend_UpdateIndex_LockLost(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "hrp-lock")
+	assert.Nil(t, err, "expected temp dir")
+	defer os.RemoveAll(dir)
+
+	b, objects := testEventsBackend()
+	objects.put("prefix/a-1.1.0.tgz", testChartArchive("a", "1.1.0"))
+	b.locker, _ = lock.NewFileLocker(dir, lock.Options{
+		TTL:           300 * time.Millisecond,
+		Timeout:       time.Second,
+		RetryInterval: time.Millisecond,
+	})
+
+	// another replica takes the lock over while we update the index
+	objects.beforeHead = func(key string) {
+		if key != "prefix/index.yaml" || b.lease == nil {
+			return
+		}
+		record := fmt.Sprintf("other %d\n", time.Now().Add(time.Minute).UnixNano())
+		ioutil.WriteFile(filepath.Join(dir, url.PathEscape("index/bucket-test/prefix")+".lock"), []byte(record), 0644)
+		<-b.lease.Done()
+	}
+
+	// run
+	err = b.updateIndex([]string{"a-1.1.0.tgz"}, nil)
+
+	// check
+	assert.Equal(t, lock.ErrLockLost, err)
+	assert.Equal(t, 0, objects.indexWrites(), "expected index not written without the lock")
+}
@@ -14,8 +14,12 @@ import (
 	"io"
 	"io/ioutil"
 	"mime/multipart"
+	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestS3_New(t *testing.T) {
@@ -73,6 +77,24 @@ func TestS3_New_ConfigVerify_MissingLocalSyncPath(t *testing.T) {
 		"expected local sync path missing error")
 }
 
+func TestS3_New_ConfigVerify_KmsKeyWithoutKmsEncryption(t *testing.T) {
+
+	cfg := config.New()
+	cfg.S3.Region = "us-east-1"
+	cfg.S3.Bucket = "test"
+	cfg.S3.LocalSyncPath = "/tmp/hrp"
+	cfg.S3.ServerSideEncryption = "AES256"
+	cfg.S3.SSEKMSKeyID = "key"
+
+	_, err := newS3(cfg)
+
+	assert.Error(t, err, "invalid config returns error")
+	assert.Contains(t,
+		err.Error(),
+		"kms key id requires aws:kms",
+		"expected kms key id error")
+}
+
 func TestS3Backend_Initialize(t *testing.T) {
 
 	cfg := testConfig()
@@ -82,10 +104,18 @@ func TestS3Backend_Initialize(t *testing.T) {
 
 	// mock
 	s3Api := new(s3Mock)
-	s3Api.On("PutObject", &s3.PutObjectInput{
+	s3Api.On("HeadObject", &s3.HeadObjectInput{
 		Bucket: aws.String("bucket-test"),
 		Key:    aws.String("prefix/index.yaml"),
-		Body:   indexData,
+	}).Return(
+		nil,
+		awserr.New("NotFound", "not found", nil),
+	)
+	s3Api.On("PutObject", &s3.PutObjectInput{
+		Bucket:   aws.String("bucket-test"),
+		Key:      aws.String("prefix/index.yaml"),
+		Body:     indexData,
+		Metadata: map[string]*string{"Hrp-Generation": aws.String("1")},
 	}).Return(
 		&s3.PutObjectOutput{},
 		nil,
@@ -229,27 +259,308 @@ func TestS3Backend_GetChart_S3Error(t *testing.T) {
 
 func TestS3Backend_PutChart(t *testing.T) {
 
+	b, objects := testEventsBackend()
+	chart := testChartArchive("a", "1.1.0")
+
+	// run
+	err := b.PutChart("a-1.1.0.tgz", bytes.NewReader(chart), int64(len(chart)))
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+	assert.Equal(t, chart, objects.objects["prefix/a-1.1.0.tgz"], "expected chart published")
+	assert.Empty(t, objects.keys("prefix/.hrp-staging/"), "expected staged chart removed")
+
+	index := objects.index(t)
+	if assert.Len(t, index.Entries["a"], 2) {
+		assert.Equal(t, "1.1.0", index.Entries["a"][0].Version)
+		assert.Equal(t, util.Digest(chart), index.Entries["a"][0].Digest)
+	}
+}
+
+func TestS3Backend_PutChart_InvalidArchive(t *testing.T) {
+
+	b, objects := testEventsBackend()
+
+	// run
+	err := putTestChart(b, "a-1.1.0.tgz", []byte("not a chart"))
+
+	// check
+	assert.Error(t, err, "expected invalid archive error")
+	assert.Equal(t, []string{"prefix/index.yaml"}, objects.keys("prefix/"), "expected staged chart removed")
+	assert.Equal(t, 0, objects.indexWrites(), "expected index untouched")
+}
+
+func TestS3Backend_PutChart_Truncated(t *testing.T) {
+
+	b, objects := testEventsBackend()
+	chart := testChartArchive("a", "1.1.0")
+
+	// run
+	err := b.PutChart("a-1.1.0.tgz", bytes.NewReader(chart), int64(len(chart)+1))
+
+	// check
+	assert.Error(t, err, "expected size mismatch error")
+	assert.Equal(t, []string{"prefix/index.yaml"}, objects.keys("prefix/"), "expected staged chart removed")
+}
+
+func TestS3Backend_PutChart_IndexFails(t *testing.T) {
+
+	b, objects := testEventsBackend()
+	objects.errors["PutObject prefix/index.yaml"] = awserr.New("-1", "aws test service error", nil)
+
+	// run
+	err := putTestChart(b, "a-1.1.0.tgz", testChartArchive("a", "1.1.0"))
+
+	// check
+	assert.Error(t, err, "expected index error")
+	assert.Equal(t, []string{"prefix/index.yaml"}, objects.keys("prefix/"), "expected staged chart rolled back")
+	assert.Len(t, objects.index(t).Entries["a"], 1)
+}
+
+func TestS3Backend_PutChart_IndexFailsRestoresReplaced(t *testing.T) {
+
+	b, objects := testEventsBackend()
+	original := testChartArchive("a", "1.0.0")
+	objects.put("prefix/a-1.0.0.tgz", original)
+	objects.errors["PutObject prefix/index.yaml"] = awserr.New("-1", "aws test service error", nil)
+
+	// run, replacing a-1.0.0
+	err := putTestChart(b, "a-1.0.0.tgz", testChartArchiveWithFiles("a", map[string]string{
+		"Chart.yaml": "name: a\nversion: 1.0.0\ndescription: replaced\n",
+	}))
+
+	// check
+	assert.Error(t, err, "expected index error")
+	assert.Equal(t, original, objects.objects["prefix/a-1.0.0.tgz"], "expected replaced chart restored")
+	assert.Equal(t, []string{"prefix/a-1.0.0.tgz", "prefix/index.yaml"}, objects.keys("prefix/"), "expected backup removed")
+}
+
+func TestS3Backend_PutChart_PromotedBeforeIndexed(t *testing.T) {
+
+	b, objects := testEventsBackend()
+	published := false
+	objects.beforeHead = func(key string) {
+		if key == "prefix/index.yaml" {
+			objects.lock.Lock()
+			_, published = objects.objects["prefix/a-1.1.0.tgz"]
+			objects.lock.Unlock()
+		}
+	}
+
+	// run
+	err := putTestChart(b, "a-1.1.0.tgz", testChartArchive("a", "1.1.0"))
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+	assert.True(t, published, "expected chart downloadable before the index lists it")
+	assert.Len(t, objects.index(t).Entries["a"], 2)
+}
+
+func TestS3Backend_PutChart_PromoteFails(t *testing.T) {
+
+	b, objects := testEventsBackend()
+	original := objects.index(t).Entries["a"][0]
+	objects.errors["CopyObject prefix/a-1.0.0.tgz"] = awserr.New("-1", "aws test service error", nil)
+
+	// run, replacing a-1.0.0
+	err := putTestChart(b, "a-1.0.0.tgz", testChartArchive("a", "1.0.0"))
+
+	// check
+	assert.Error(t, err, "expected promote error")
+	assert.Equal(t, []string{"prefix/index.yaml"}, objects.keys("prefix/"), "expected staged chart rolled back")
+
+	index := objects.index(t)
+	if assert.Len(t, index.Entries["a"], 1) {
+		assert.Equal(t, original.Digest, index.Entries["a"][0].Digest, "expected replaced entry restored")
+	}
+}
+
+func TestS3Backend_PutCharts(t *testing.T) {
+
+	b, objects := testEventsBackend()
+
+	// run
+	errs := b.PutCharts([]*ChartFile{
+		testChartFile("a-1.1.0.tgz", testChartArchive("a", "1.1.0")),
+		testChartFile("b-0.1.0.tgz", testChartArchive("b", "0.1.0")),
+	}, false)
+
+	// check
+	assert.Equal(t, []error{nil, nil}, errs)
+	assert.Equal(t, 1, objects.indexWrites(), "expected a single index write")
+	assert.Empty(t, objects.keys("prefix/.hrp-staging/"), "expected staged charts removed")
+
+	index := objects.index(t)
+	assert.Len(t, index.Entries["a"], 2)
+	assert.Len(t, index.Entries["b"], 1)
+}
+
+func TestS3Backend_PutCharts_PartialFailure(t *testing.T) {
+
+	b, objects := testEventsBackend()
+	objects.errors["CopyObject prefix/b-0.1.0.tgz"] = awserr.New("-1", "aws test service error", nil)
+
+	// run
+	errs := b.PutCharts([]*ChartFile{
+		testChartFile("a-1.1.0.tgz", testChartArchive("a", "1.1.0")),
+		testChartFile("b-0.1.0.tgz", testChartArchive("b", "0.1.0")),
+		testChartFile("c-0.1.0.tgz", []byte("not a chart")),
+	}, false)
+
+	// check
+	assert.Nil(t, errs[0], "expected first chart stored")
+	assert.Error(t, errs[1], "expected promote error")
+	assert.Error(t, errs[2], "expected invalid archive error")
+	assert.Equal(t, []string{"prefix/a-1.1.0.tgz", "prefix/index.yaml"}, objects.keys("prefix/"))
+
+	index := objects.index(t)
+	assert.Len(t, index.Entries["a"], 2)
+	assert.Empty(t, index.Entries["b"], "expected failed chart rolled back")
+}
+
+func TestS3Backend_PutCharts_Atomic(t *testing.T) {
+
+	b, objects := testEventsBackend()
+	objects.errors["CopyObject prefix/b-0.1.0.tgz"] = awserr.New("-1", "aws test service error", nil)
+
+	// run
+	errs := b.PutCharts([]*ChartFile{
+		testChartFile("a-1.1.0.tgz", testChartArchive("a", "1.1.0")),
+		testChartFile("b-0.1.0.tgz", testChartArchive("b", "0.1.0")),
+	}, true)
+
+	// check
+	assert.Equal(t, ErrBatchAborted, errs[0])
+	assert.Error(t, errs[1], "expected promote error")
+	assert.Equal(t, []string{"prefix/index.yaml"}, objects.keys("prefix/"), "expected batch rolled back")
+
+	index := objects.index(t)
+	assert.Len(t, index.Entries["a"], 1)
+	assert.Empty(t, index.Entries["b"])
+}
+
+func TestS3Backend_PutCharts_AtomicRestoresReplaced(t *testing.T) {
+
+	b, objects := testEventsBackend()
+	original := testChartArchive("a", "1.0.0")
+	objects.put("prefix/a-1.0.0.tgz", original)
+	objects.errors["CopyObject prefix/b-0.1.0.tgz"] = awserr.New("-1", "aws test service error", nil)
+
+	// run
+	errs := b.PutCharts([]*ChartFile{
+		testChartFile("a-1.0.0.tgz", testChartArchiveWithFiles("a", map[string]string{
+			"Chart.yaml": "name: a\nversion: 1.0.0\ndescription: replaced\n",
+		})),
+		testChartFile("b-0.1.0.tgz", testChartArchive("b", "0.1.0")),
+	}, true)
+
+	// check
+	assert.Equal(t, ErrBatchAborted, errs[0])
+	assert.Error(t, errs[1], "expected promote error")
+	assert.Equal(t, original, objects.objects["prefix/a-1.0.0.tgz"], "expected replaced chart restored")
+	assert.Equal(t, []string{"prefix/a-1.0.0.tgz", "prefix/index.yaml"}, objects.keys("prefix/"), "expected backups removed")
+
+	index := objects.index(t)
+	if assert.Len(t, index.Entries["a"], 1) {
+		assert.Equal(t, "http://localhost:1323/a-1.0.0.tgz", index.Entries["a"][0].URLs[0], "expected previous entry restored")
+	}
+	assert.Empty(t, index.Entries["b"])
+}
+
+func TestS3Backend_PutCharts_Provenance(t *testing.T) {
+
+	b, objects := testEventsBackend()
+	chart := testChartFile("b-0.1.0.tgz", testChartArchive("b", "0.1.0"))
+	chart.Provenance = []byte("signature")
+
+	// run
+	errs := b.PutCharts([]*ChartFile{chart}, true)
+
+	// check
+	assert.Nil(t, errs[0], "expected nil err")
+	assert.Equal(t, []byte("signature"), objects.objects["prefix/b-0.1.0.tgz.prov"], "expected provenance file")
+	assert.Equal(t, []string{"prefix/b-0.1.0.tgz", "prefix/b-0.1.0.tgz.prov", "prefix/index.yaml"}, objects.keys("prefix/"))
+}
+
+func TestS3Backend_PutCharts_AtomicRestoresProvenance(t *testing.T) {
+
+	b, objects := testEventsBackend()
+	original := testChartArchive("a", "1.0.0")
+	objects.put("prefix/a-1.0.0.tgz", original)
+	objects.put("prefix/a-1.0.0.tgz.prov", []byte("original signature"))
+	objects.errors["PutObject prefix/b-0.1.0.tgz.prov"] = awserr.New("-1", "aws test service error", nil)
+
+	replacing := testChartFile("a-1.0.0.tgz", testChartArchiveWithFiles("a", map[string]string{
+		"Chart.yaml": "name: a\nversion: 1.0.0\ndescription: replaced\n",
+	}))
+	replacing.Provenance = []byte("new signature")
+	added := testChartFile("b-0.1.0.tgz", testChartArchive("b", "0.1.0"))
+	added.Provenance = []byte("signature")
+
+	// run
+	errs := b.PutCharts([]*ChartFile{replacing, added}, true)
+
+	// check
+	assert.Equal(t, ErrBatchAborted, errs[0])
+	assert.Error(t, errs[1], "expected provenance write error")
+	assert.Equal(t, original, objects.objects["prefix/a-1.0.0.tgz"], "expected replaced chart restored")
+	assert.Equal(t, []byte("original signature"), objects.objects["prefix/a-1.0.0.tgz.prov"], "expected replaced provenance restored")
+	assert.Equal(t, []string{"prefix/a-1.0.0.tgz", "prefix/a-1.0.0.tgz.prov", "prefix/index.yaml"}, objects.keys("prefix/"),
+		"expected added chart and backups removed")
+	assert.Equal(t, 0, objects.indexWrites(), "expected index untouched")
+}
+
+func TestS3Backend_PutCharts_AtomicInvalidArchive(t *testing.T) {
+
+	b, objects := testEventsBackend()
+
+	// run
+	errs := b.PutCharts([]*ChartFile{
+		testChartFile("a-1.1.0.tgz", testChartArchive("a", "1.1.0")),
+		testChartFile("b-0.1.0.tgz", []byte("not a chart")),
+	}, true)
+
+	// check
+	assert.Equal(t, ErrBatchAborted, errs[0])
+	assert.Error(t, errs[1], "expected invalid archive error")
+	assert.Equal(t, []string{"prefix/index.yaml"}, objects.keys("prefix/"), "expected staged charts removed")
+	assert.Equal(t, 0, objects.indexWrites(), "expected index untouched")
+}
+
+func TestS3Backend_DeleteCharts(t *testing.T) {
+
 	cfg := testConfig()
 	b, _ := newS3(cfg)
 
-	filename := "test"
-	file := new(fileMock)
 	indexData := bytes.NewReader([]byte{})
 
 	// mock
 	s3Api := new(s3Mock)
-	s3Api.On("PutObject", &s3.PutObjectInput{
+	s3Api.On("DeleteObjects", &s3.DeleteObjectsInput{
 		Bucket: aws.String("bucket-test"),
-		Key:    aws.String("prefix/test"),
-		Body:   file,
+		Delete: &s3.Delete{
+			Objects: []*s3.ObjectIdentifier{
+				{Key: aws.String("prefix/a-1.0.0.tgz")},
+				{Key: aws.String("prefix/a-1.0.0.tgz.prov")},
+			},
+			Quiet: aws.Bool(true),
+		},
 	}).Return(
-		&s3.PutObjectOutput{},
+		&s3.DeleteObjectsOutput{},
 		nil,
 	)
-	s3Api.On("PutObject", &s3.PutObjectInput{
+	s3Api.On("HeadObject", &s3.HeadObjectInput{
 		Bucket: aws.String("bucket-test"),
 		Key:    aws.String("prefix/index.yaml"),
-		Body:   indexData,
+	}).Return(
+		nil,
+		awserr.New("NotFound", "not found", nil),
+	)
+	s3Api.On("PutObject", &s3.PutObjectInput{
+		Bucket:   aws.String("bucket-test"),
+		Key:      aws.String("prefix/index.yaml"),
+		Body:     indexData,
+		Metadata: map[string]*string{"Hrp-Generation": aws.String("1")},
 	}).Return(
 		&s3.PutObjectOutput{},
 		nil,
@@ -277,10 +588,134 @@ func TestS3Backend_PutChart(t *testing.T) {
 	b.helmUtil = helmUtil
 
 	// run
-	err := b.PutChart(filename, file)
+	err := b.DeleteCharts("a-1.0.0.tgz")
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+	s3Api.AssertExpectations(t)
+}
+
+func TestS3Backend_SharedLock_ConcurrentReplicas(t *testing.T) {
+
+	dir, _ := ioutil.TempDir("", "hrp-lock")
+	defer os.RemoveAll(dir)
+
+	cfg := testConfig()
+	cfg.Lock.Type = "file"
+	cfg.Lock.Dir = dir
+	cfg.Lock.TTL = time.Second
+	cfg.Lock.Timeout = 5 * time.Second
+
+	replicas := []*s3Backend{}
+	for n := 0; n < 2; n++ {
+		b, err := newS3(cfg)
+		assert.Nil(t, err, "expected nil err")
+		replicas = append(replicas, b)
+	}
+
+	// run
+	var writers int32
+	var overlaps int32
+	wg := &sync.WaitGroup{}
+	for _, b := range replicas {
+		for n := 0; n < 3; n++ {
+			wg.Add(1)
+			go func(b *s3Backend) {
+				defer wg.Done()
+
+				// callers hold the replica's own reindex lock
+				b.reindexLock.Lock()
+				defer b.reindexLock.Unlock()
+
+				b.withSharedLock(func() error {
+					if atomic.AddInt32(&writers, 1) > 1 {
+						atomic.AddInt32(&overlaps, 1)
+					}
+					time.Sleep(5 * time.Millisecond)
+					atomic.AddInt32(&writers, -1)
+					return nil
+				})
+			}(b)
+		}
+	}
+	wg.Wait()
+
+	// check
+	assert.Equal(t, int32(0), overlaps, "expected one replica writing the index at a time")
+}
+
+func TestS3Backend_PutFile(t *testing.T) {
+
+	cfg := testConfig()
+	b, _ := newS3(cfg)
+
+	// mock
+	s3Api := new(s3Mock)
+	s3Api.On("PutObject", &s3.PutObjectInput{
+		Bucket: aws.String("bucket-test"),
+		Key:    aws.String("prefix/test"),
+		Body:   bytes.NewReader([]byte{0, 1, 2}),
+	}).Return(
+		&s3.PutObjectOutput{},
+		nil,
+	)
+	b.svc = s3Api
+
+	// run
+	err := b.PutFile("test", []byte{0, 1, 2})
 
 	// check
 	assert.Nil(t, err, "expected nil err")
+	s3Api.AssertNumberOfCalls(t, "PutObject", 1)
+}
+
+func TestS3Backend_GetFile_NotFound(t *testing.T) {
+
+	b, _ := testEventsBackend()
+
+	// run
+	data, err := b.GetFile("missing")
+
+	// check
+	assert.Nil(t, data, "nil data")
+	assert.Equal(t, ErrFileNotFound, err)
+}
+
+func TestS3Backend_PutChart_UploadOptions(t *testing.T) {
+
+	b, objects := testEventsBackend()
+	b.config.S3.ServerSideEncryption = "aws:kms"
+	b.config.S3.SSEKMSKeyID = "key"
+	b.config.S3.ACL = "private"
+	b.config.S3.StorageClass = "STANDARD_IA"
+	b.config.S3.Tags = map[string]string{"team": "platform", "env": "prod"}
+
+	// run
+	err := putTestChart(b, "a-1.1.0.tgz", testChartArchive("a", "1.1.0"))
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+
+	if assert.Len(t, objects.putInputs, 2) {
+		for _, input := range objects.putInputs {
+			assert.Equal(t, "aws:kms", aws.StringValue(input.ServerSideEncryption))
+			assert.Equal(t, "key", aws.StringValue(input.SSEKMSKeyId))
+			assert.Equal(t, "private", aws.StringValue(input.ACL))
+			assert.Equal(t, "STANDARD_IA", aws.StringValue(input.StorageClass))
+			assert.Equal(t, "env=prod&team=platform", aws.StringValue(input.Tagging))
+		}
+	}
+
+	if assert.Len(t, objects.copyInputs, 1) {
+		input := objects.copyInputs[0]
+		assert.Equal(t, "prefix/a-1.1.0.tgz", aws.StringValue(input.Key))
+		assert.Equal(t, "aws:kms", aws.StringValue(input.ServerSideEncryption))
+		assert.Equal(t, "key", aws.StringValue(input.SSEKMSKeyId))
+		assert.Equal(t, "private", aws.StringValue(input.ACL))
+		assert.Equal(t, "STANDARD_IA", aws.StringValue(input.StorageClass))
+		assert.Equal(t, "env=prod&team=platform", aws.StringValue(input.Tagging))
+		assert.Equal(t, s3.TaggingDirectiveReplace, aws.StringValue(input.TaggingDirective))
+	}
 }
 
 //
@@ -324,6 +759,50 @@ func (m *s3Mock) GetObject(i *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
 	return out, err
 }
 
+func (m *s3Mock) DeleteObjects(i *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
+	args := m.Called(i)
+
+	var out *s3.DeleteObjectsOutput
+	var err error
+
+	if o, ok := args.Get(0).(*s3.DeleteObjectsOutput); ok {
+		out = o
+	} else {
+		out = nil
+	}
+
+	if e, ok := args.Get(1).(error); ok {
+		err = awserr.New("-1", "aws test service error", e)
+	} else {
+		err = nil
+	}
+
+	return out, err
+}
+
+func (m *s3Mock) HeadObject(i *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	args := m.Called(i)
+
+	var out *s3.HeadObjectOutput
+	var err error
+
+	if o, ok := args.Get(0).(*s3.HeadObjectOutput); ok {
+		out = o
+	} else {
+		out = nil
+	}
+
+	if e, ok := args.Get(1).(awserr.Error); ok {
+		err = e
+	} else if e, ok := args.Get(1).(error); ok {
+		err = awserr.New("-1", "aws test service error", e)
+	} else {
+		err = nil
+	}
+
+	return out, err
+}
+
 func (m *s3Mock) PutObject(i *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
 	args := m.Called(i)
 
@@ -0,0 +1,154 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zlangbert/hrp/config"
+	"github.com/zlangbert/hrp/util"
+)
+
+type virtualBackend struct {
+	config  *config.AppConfig
+	names   []string
+	members []Backend
+
+	// which member serves each chart file, as of the last merged index
+	chartsLock *sync.RWMutex
+	charts     map[string]Backend
+}
+
+func newVirtual(config *config.AppConfig, names []string, members []Backend) (*virtualBackend, error) {
+
+	// validate config
+	if len(members) == 0 {
+		return nil, errors.New("virtual config - no member repositories")
+	}
+
+	return &virtualBackend{
+		config:  config,
+		names:   names,
+		members: members,
+
+		chartsLock: &sync.RWMutex{},
+		charts:     map[string]Backend{},
+	}, nil
+}
+
+/*
+ * Initialize backend
+ */
+func (b *virtualBackend) Initialize() error {
+	return nil
+}
+
+/*
+ * Get index:
+ *
+ * 1. read the index of every member in priority order
+ * 2. merge, keeping the first source of each chart version
+ * 3. rewrite chart urls to point at this repository
+ */
+func (b *virtualBackend) GetIndex() ([]byte, error) {
+
+	merged := util.NewIndexFile()
+	charts := map[string]Backend{}
+	available := 0
+
+	for n, member := range b.members {
+		data, err := member.GetIndex()
+		if err != nil {
+			log.Warnf("skipping unavailable member repository %s: %s", b.names[n], err.Error())
+			continue
+		}
+
+		index, err := util.ParseIndex(data)
+		if err != nil {
+			log.Warnf("skipping member repository %s with invalid index: %s", b.names[n], err.Error())
+			continue
+		}
+		available++
+
+		for _, cv := range merged.Merge(index) {
+			rewritten := []string{}
+			for _, u := range cv.URLs {
+				filename := path.Base(u)
+				charts[filename] = member
+				rewritten = append(rewritten, util.ChartURL(b.config.BaseURL, filename))
+			}
+			cv.URLs = rewritten
+		}
+	}
+
+	if available == 0 {
+		return nil, errors.New("no member repository available")
+	}
+
+	merged.SortEntries()
+
+	b.chartsLock.Lock()
+	b.charts = charts
+	b.chartsLock.Unlock()
+
+	return merged.Marshal()
+}
+
+/*
+ * Get chart:
+ *
+ * read from the member the merged index points at, or the first
+ * member that has it
+ */
+func (b *virtualBackend) GetChart(name string) ([]byte, error) {
+
+	b.chartsLock.RLock()
+	member, ok := b.charts[name]
+	b.chartsLock.RUnlock()
+
+	if ok {
+		return member.GetChart(name)
+	}
+
+	errs := []string{}
+	for n, member := range b.members {
+		data, err := member.GetChart(name)
+		if err == nil {
+			return data, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s", b.names[n], err.Error()))
+	}
+
+	return nil, fmt.Errorf("chart not found in any member repository: %s", strings.Join(errs, "; "))
+}
+
+/*
+ * Put chart:
+ *
+ * virtual repositories are read-only, push to a member instead
+ */
+func (b *virtualBackend) PutChart(filename string, file io.Reader, size int64) error {
+	return ErrReadOnly
+}
+
+/*
+ * Delete charts:
+ *
+ * virtual repositories are read-only, delete from a member instead
+ */
+func (b *virtualBackend) DeleteCharts(filenames ...string) error {
+	return ErrReadOnly
+}
+
+/*
+ * Reindex repository:
+ *
+ * the merged index is rebuilt on every read, members reindex themselves
+ */
+func (b *virtualBackend) Reindex() error {
+	return nil
+}
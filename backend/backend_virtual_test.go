@@ -0,0 +1,177 @@
+package backend
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zlangbert/hrp/config"
+	"github.com/zlangbert/hrp/util"
+)
+
+func TestVirtual_New_NoMembers(t *testing.T) {
+
+	_, err := newVirtual(testVirtualConfig(), []string{}, []Backend{})
+
+	if assert.Error(t, err, "expected error") {
+		assert.Contains(t, err.Error(), "no member repositories")
+	}
+}
+
+func TestVirtualBackend_GetIndex_Priority(t *testing.T) {
+
+	first := testMemberRepository("first", map[string]string{
+		"a": "1.0.0",
+	})
+	second := testMemberRepository("second", map[string]string{
+		"a": "1.0.0",
+		"b": "2.0.0",
+	})
+	second.files["a-1.0.0.tgz"] = []byte("shadowed")
+
+	b, _ := newVirtual(testVirtualConfig(), []string{"first", "second"}, []Backend{first, second})
+
+	// run
+	data, err := b.GetIndex()
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+	index, _ := util.ParseIndex(data)
+	if assert.Len(t, index.Entries["a"], 1) {
+		assert.Equal(t, "first", index.Entries["a"][0].Description, "expected first member to win")
+		assert.Equal(t, []string{"http://localhost:1323/all/a-1.0.0.tgz"}, index.Entries["a"][0].URLs)
+	}
+	if assert.Len(t, index.Entries["b"], 1) {
+		assert.Equal(t, "second", index.Entries["b"][0].Description)
+	}
+
+	chart, err := b.GetChart("a-1.0.0.tgz")
+	assert.Nil(t, err, "expected nil err")
+	assert.Equal(t, []byte("first"), chart, "expected chart from first member")
+}
+
+func TestVirtualBackend_GetIndex_KeepsUnknownFields(t *testing.T) {
+
+	member := newMemoryStore()
+	member.files[util.HelmIndexFilename] = []byte(`apiVersion: v1
+entries:
+  a:
+  - name: a
+    version: 1.0.0
+    kubeVersion: '>=1.10'
+    type: application
+    urls:
+    - http://localhost:1323/member/a-1.0.0.tgz
+`)
+
+	b, _ := newVirtual(testVirtualConfig(), []string{"member"}, []Backend{member})
+
+	// run
+	data, err := b.GetIndex()
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+	index, _ := util.ParseIndex(data)
+	if assert.Len(t, index.Entries["a"], 1) {
+		assert.Equal(t, ">=1.10", index.Entries["a"][0].Extra["kubeVersion"])
+		assert.Equal(t, "application", index.Entries["a"][0].Extra["type"])
+	}
+}
+
+func TestVirtualBackend_GetIndex_MemberUnavailable(t *testing.T) {
+
+	first := newMemoryStore()
+	second := testMemberRepository("second", map[string]string{
+		"b": "2.0.0",
+	})
+
+	b, _ := newVirtual(testVirtualConfig(), []string{"first", "second"}, []Backend{first, second})
+
+	// run
+	data, err := b.GetIndex()
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+	index, _ := util.ParseIndex(data)
+	assert.Len(t, index.Entries, 1)
+}
+
+func TestVirtualBackend_GetIndex_NoMemberAvailable(t *testing.T) {
+
+	b, _ := newVirtual(testVirtualConfig(), []string{"first"}, []Backend{newMemoryStore()})
+
+	// run
+	_, err := b.GetIndex()
+
+	// check
+	assert.Error(t, err, "expected error")
+}
+
+func TestVirtualBackend_GetChart_WithoutIndex(t *testing.T) {
+
+	first := newMemoryStore()
+	second := testMemberRepository("second", map[string]string{
+		"b": "2.0.0",
+	})
+
+	b, _ := newVirtual(testVirtualConfig(), []string{"first", "second"}, []Backend{first, second})
+
+	// run
+	chart, err := b.GetChart("b-2.0.0.tgz")
+	_, missingErr := b.GetChart("c-1.0.0.tgz")
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+	assert.Equal(t, []byte("second"), chart)
+	assert.Error(t, missingErr, "expected error for missing chart")
+}
+
+func TestVirtualBackend_PutChart(t *testing.T) {
+
+	b, _ := newVirtual(testVirtualConfig(), []string{"first"}, []Backend{newMemoryStore()})
+
+	err := b.PutChart("test", new(fileMock), 0)
+
+	assert.Equal(t, ErrReadOnly, err)
+}
+
+func TestRepositories_AddVirtual_UnknownMember(t *testing.T) {
+
+	cfg := testConfig()
+	cfg.BackendName = "s3"
+	r, _ := NewRepositories(cfg, false)
+
+	_, err := r.AddVirtual("all", []string{"missing"})
+
+	if assert.Error(t, err, "expected error") {
+		assert.Contains(t, err.Error(), "unknown member repository")
+	}
+}
+
+//
+// helpers
+//
+
+func testVirtualConfig() *config.AppConfig {
+	cfg := config.New()
+	cfg.BaseURL = "http://localhost:1323"
+
+	return cfg.ForRepository("all", "all")
+}
+
+// testMemberRepository builds an in memory repository holding the charts, with the
+// repository name as every chart's description and content
+func testMemberRepository(repoName string, charts map[string]string) *memoryStore {
+	repo := newMemoryStore()
+	index := util.NewIndexFile()
+
+	for name, version := range charts {
+		md := &util.ChartMetadata{Name: name, Version: version, Description: repoName}
+		index.Add(md, util.ChartURL("http://localhost:1323/"+repoName, md.ChartFilename()), "")
+		repo.files[md.ChartFilename()] = []byte(repoName)
+	}
+
+	data, _ := index.Marshal()
+	repo.files[util.HelmIndexFilename] = data
+
+	return repo
+}
@@ -0,0 +1,316 @@
+package backend
+
+import (
+	crand "crypto/rand"
+	"encoding/hex"
+	"math/rand"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zlangbert/hrp/util"
+)
+
+// A BackgroundReindexer is a Backend that can skip reindexing while a reindex is already running
+type BackgroundReindexer interface {
+	// TryReindex reindexes unless a reindex is in progress, returning false if it was skipped
+	TryReindex() (bool, error)
+}
+
+// tryMutex is a mutex that can also be acquired without blocking
+type tryMutex struct {
+	ch chan struct{}
+}
+
+func newTryMutex() *tryMutex {
+	return &tryMutex{ch: make(chan struct{}, 1)}
+}
+
+func (m *tryMutex) Lock() {
+	m.ch <- struct{}{}
+}
+
+func (m *tryMutex) Unlock() {
+	<-m.ch
+}
+
+// TryLock acquires the mutex if it is free, returning whether it did
+func (m *tryMutex) TryLock() bool {
+	select {
+	case m.ch <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// ReindexStatus is the outcome of the last scheduled reindex of a repository
+type ReindexStatus struct {
+	Started     time.Time  `json:"started"`
+	Finished    time.Time  `json:"finished"`
+	Skipped     bool       `json:"skipped"`
+	Error       string     `json:"error,omitempty"`
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+}
+
+// ReindexScheduler periodically reindexes the root and every named repository, so charts
+// written to storage behind hrp's back show up without a restart. Repositories already being
+// reindexed are skipped until the next run.
+type ReindexScheduler struct {
+	root     Backend
+	repos    *Repositories
+	interval time.Duration
+
+	lock   *sync.Mutex
+	status map[string]*ReindexStatus
+	stop   chan struct{}
+}
+
+// NewReindexScheduler creates a ReindexScheduler running every interval, plus up to a tenth
+// of it in jitter so replicas don't all reindex at once
+func NewReindexScheduler(root Backend, repos *Repositories, interval time.Duration) *ReindexScheduler {
+	return &ReindexScheduler{
+		root:     root,
+		repos:    repos,
+		interval: interval,
+
+		lock:   &sync.Mutex{},
+		status: map[string]*ReindexStatus{},
+		stop:   make(chan struct{}),
+	}
+}
+
+// Start runs the scheduler in the background until Stop is called
+func (s *ReindexScheduler) Start() {
+	go func() {
+		for {
+			select {
+			case <-time.After(s.interval + jitter(s.interval/10)):
+				s.RunOnce()
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the scheduler
+func (s *ReindexScheduler) Stop() {
+	close(s.stop)
+}
+
+// RunOnce reindexes every repository now
+func (s *ReindexScheduler) RunOnce() {
+
+	targets := map[string]Backend{"": s.root}
+	if s.repos != nil {
+		for _, name := range s.repos.Names() {
+			if b, ok := s.repos.Get(name); ok {
+				targets[name] = b
+			}
+		}
+	}
+
+	for name, b := range targets {
+		s.reindex(name, b)
+	}
+}
+
+// Status returns the status of the last scheduled reindex of the repository, the root
+// repository has an empty name
+func (s *ReindexScheduler) Status(repo string) (ReindexStatus, bool) {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	status, ok := s.status[repo]
+	if !ok {
+		return ReindexStatus{}, false
+	}
+	return *status, true
+}
+
+func (s *ReindexScheduler) reindex(name string, b Backend) {
+
+	status := ReindexStatus{Started: time.Now()}
+
+	var err error
+	if r, ok := b.(BackgroundReindexer); ok {
+		var ran bool
+		ran, err = r.TryReindex()
+		status.Skipped = !ran
+	} else {
+		err = b.Reindex()
+	}
+	status.Finished = time.Now()
+
+	if status.Skipped {
+		log.Debugf("skipped scheduled reindex of repository %q, already reindexing", name)
+	}
+	if err != nil {
+		log.Errorf("scheduled reindex of repository %q failed: %s", name, err.Error())
+		status.Error = err.Error()
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if last, ok := s.status[name]; ok {
+		status.LastSuccess = last.LastSuccess
+	}
+	if err == nil && !status.Skipped {
+		status.LastSuccess = &status.Finished
+	}
+	s.status[name] = &status
+}
+
+func jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+// JobState is the state of a reindex job
+type JobState string
+
+const (
+	// JobRunning means the job is reindexing
+	JobRunning JobState = "running"
+	// JobSucceeded means the job finished reindexing
+	JobSucceeded JobState = "succeeded"
+	// JobFailed means the job's reindex failed
+	JobFailed JobState = "failed"
+)
+
+// ReindexJob is a reindex running in the background
+type ReindexJob struct {
+	ID         string     `json:"id"`
+	Repository string     `json:"repository,omitempty"`
+	State      JobState   `json:"state"`
+	Started    time.Time  `json:"started"`
+	Finished   *time.Time `json:"finished,omitempty"`
+	Charts     int        `json:"charts"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// ReindexJobs runs reindexes in the background. Reindexes requested while the same repository
+// is already reindexing join the running job instead of queueing another.
+type ReindexJobs struct {
+	lock    *sync.Mutex
+	jobs    map[string]*ReindexJob
+	running map[string]*ReindexJob
+
+	// ids of finished jobs, oldest first, so only the most recent are kept
+	finished []string
+}
+
+// number of finished jobs whose status is kept
+const maxFinishedReindexJobs = 100
+
+// NewReindexJobs creates an empty ReindexJobs
+func NewReindexJobs() *ReindexJobs {
+	return &ReindexJobs{
+		lock:    &sync.Mutex{},
+		jobs:    map[string]*ReindexJob{},
+		running: map[string]*ReindexJob{},
+	}
+}
+
+// Start starts reindexing the repository, or returns the job already reindexing it. done is
+// called when a job this call started finishes. The root repository has an empty name.
+func (j *ReindexJobs) Start(repo string, b Backend, done func(job ReindexJob, err error)) (ReindexJob, bool) {
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if job, ok := j.running[repo]; ok {
+		return *job, false
+	}
+
+	job := &ReindexJob{
+		ID:         newRandomID(),
+		Repository: repo,
+		State:      JobRunning,
+		Started:    time.Now(),
+	}
+	j.jobs[job.ID] = job
+	j.running[repo] = job
+
+	go func() {
+		err := b.Reindex()
+		charts := 0
+		if err == nil {
+			charts, err = countCharts(b)
+		}
+
+		finished := j.finish(job, charts, err)
+		if done != nil {
+			done(finished, err)
+		}
+	}()
+
+	return *job, true
+}
+
+// Get returns a job by id
+func (j *ReindexJobs) Get(id string) (ReindexJob, bool) {
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	job, ok := j.jobs[id]
+	if !ok {
+		return ReindexJob{}, false
+	}
+	return *job, true
+}
+
+func (j *ReindexJobs) finish(job *ReindexJob, charts int, err error) ReindexJob {
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	finished := time.Now()
+	job.Finished = &finished
+	job.Charts = charts
+	job.State = JobSucceeded
+	if err != nil {
+		log.Errorf("reindex job %s failed: %s", job.ID, err.Error())
+		job.State = JobFailed
+		job.Error = err.Error()
+	}
+	delete(j.running, job.Repository)
+
+	j.finished = append(j.finished, job.ID)
+	if len(j.finished) > maxFinishedReindexJobs {
+		delete(j.jobs, j.finished[0])
+		j.finished = j.finished[1:]
+	}
+
+	return *job
+}
+
+func countCharts(b Backend) (int, error) {
+
+	data, err := b.GetIndex()
+	if err != nil {
+		return 0, err
+	}
+	index, err := util.ParseIndex(data)
+	if err != nil {
+		return 0, err
+	}
+
+	charts := 0
+	for _, versions := range index.Entries {
+		charts += len(versions)
+	}
+	return charts, nil
+}
+
+func newRandomID() string {
+	b := make([]byte, 8)
+	crand.Read(b)
+	return hex.EncodeToString(b)
+}
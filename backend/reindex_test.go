@@ -0,0 +1,186 @@
+package backend
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zlangbert/hrp/config"
+)
+
+func TestTryMutex(t *testing.T) {
+
+	m := newTryMutex()
+
+	assert.True(t, m.TryLock(), "expected free mutex to lock")
+	assert.False(t, m.TryLock(), "expected held mutex not to lock")
+
+	m.Unlock()
+
+	assert.True(t, m.TryLock(), "expected released mutex to lock")
+}
+
+func TestS3Backend_TryReindex_Running(t *testing.T) {
+
+	b, _ := newS3(testConfig())
+	b.reindexLock.Lock()
+	defer b.reindexLock.Unlock()
+
+	// run
+	ran, err := b.TryReindex()
+
+	// check
+	assert.False(t, ran, "expected skipped reindex")
+	assert.Nil(t, err, "expected nil err")
+}
+
+func TestReindexScheduler_RunOnce(t *testing.T) {
+
+	root := &reindexStub{memoryStore: newMemoryStore()}
+	member := &reindexStub{memoryStore: newMemoryStore(), err: errors.New("sync failed")}
+
+	repos, _ := NewRepositories(config.New(), false)
+	repos.add("team-a", "team-a", func() (Backend, error) { return member, nil })
+
+	s := NewReindexScheduler(root, repos, 0)
+
+	// run
+	s.RunOnce()
+
+	// check
+	assert.Equal(t, 1, root.runs)
+	assert.Equal(t, 1, member.runs)
+
+	status, ok := s.Status("")
+	if assert.True(t, ok, "expected root status") {
+		assert.False(t, status.Skipped)
+		assert.Empty(t, status.Error)
+		if assert.NotNil(t, status.LastSuccess, "expected a successful run") {
+			assert.Equal(t, status.Finished, *status.LastSuccess)
+		}
+	}
+
+	status, ok = s.Status("team-a")
+	if assert.True(t, ok, "expected team-a status") {
+		assert.Equal(t, "sync failed", status.Error)
+		assert.Nil(t, status.LastSuccess, "expected no successful run")
+	}
+
+	_, ok = s.Status("team-b")
+	assert.False(t, ok, "expected no status for unknown repository")
+}
+
+func TestReindexScheduler_RunOnce_Skipped(t *testing.T) {
+
+	root := &reindexStub{memoryStore: newMemoryStore()}
+	s := NewReindexScheduler(root, nil, 0)
+	s.RunOnce()
+	first, _ := s.Status("")
+
+	root.running = true
+
+	// run
+	s.RunOnce()
+
+	// check
+	assert.Equal(t, 1, root.runs)
+
+	status, _ := s.Status("")
+	assert.True(t, status.Skipped, "expected skipped run")
+	assert.Equal(t, first.LastSuccess, status.LastSuccess, "expected last success kept")
+}
+
+// reindexStub is a BackgroundReindexer counting its reindexes
+type reindexStub struct {
+	*memoryStore
+	running bool
+	runs    int
+	err     error
+}
+
+func (r *reindexStub) Reindex() error {
+	r.runs++
+	return r.err
+}
+
+func (r *reindexStub) TryReindex() (bool, error) {
+	if r.running {
+		return false, nil
+	}
+	r.runs++
+	return true, r.err
+}
+
+func TestReindexJobs_Start(t *testing.T) {
+
+	b := &blockingStub{memoryStore: newMemoryStore(), release: make(chan struct{})}
+	b.PutFile("index.yaml", []byte("apiVersion: v1\nentries:\n  a:\n  - name: a\n    version: 1.0.0\n  - name: a\n    version: 1.1.0\n"))
+	jobs := NewReindexJobs()
+
+	done := make(chan ReindexJob, 1)
+
+	// run
+	job, started := jobs.Start("", b, func(job ReindexJob, err error) { done <- job })
+	other, coalesced := jobs.Start("", b, nil)
+
+	// check
+	assert.True(t, started, "expected job started")
+	assert.False(t, coalesced, "expected second request to join the running job")
+	assert.Equal(t, job.ID, other.ID)
+	assert.Equal(t, JobRunning, job.State)
+
+	close(b.release)
+	finished := <-done
+
+	assert.Equal(t, JobSucceeded, finished.State)
+	assert.Equal(t, 2, finished.Charts)
+	assert.Equal(t, 1, b.runs, "expected a single reindex")
+
+	status, ok := jobs.Get(job.ID)
+	assert.True(t, ok, "expected job status")
+	assert.Equal(t, finished, status)
+
+	// a new request after the job finished starts a new job
+	close(done)
+	next, started := jobs.Start("", b, nil)
+	assert.True(t, started, "expected new job started")
+	assert.NotEqual(t, job.ID, next.ID)
+}
+
+func TestReindexJobs_Start_Failed(t *testing.T) {
+
+	b := &reindexStub{memoryStore: newMemoryStore(), err: errors.New("sync failed")}
+	jobs := NewReindexJobs()
+
+	done := make(chan ReindexJob, 1)
+
+	// run
+	jobs.Start("team-a", b, func(job ReindexJob, err error) { done <- job })
+	finished := <-done
+
+	// check
+	assert.Equal(t, JobFailed, finished.State)
+	assert.Equal(t, "team-a", finished.Repository)
+	assert.Equal(t, "sync failed", finished.Error)
+	assert.NotNil(t, finished.Finished, "expected finish time")
+}
+
+func TestReindexJobs_Get_Unknown(t *testing.T) {
+
+	_, ok := NewReindexJobs().Get("missing")
+
+	assert.False(t, ok, "expected unknown job")
+}
+
+// blockingStub is a Backend whose reindex waits to be released
+type blockingStub struct {
+	*memoryStore
+	release chan struct{}
+	runs    int
+}
+
+func (b *blockingStub) Reindex() error {
+	<-b.release
+	b.runs++
+	return nil
+}
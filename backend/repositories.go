@@ -0,0 +1,435 @@
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zlangbert/hrp/config"
+)
+
+// the file next to the named repositories holding the ones created through Create
+const createdRepositoriesFile = "repositories.json"
+
+var (
+	// ErrRepositoryNotSaved is returned when a created repository couldn't be saved, it isn't
+	// added then
+	ErrRepositoryNotSaved = errors.New("failed saving repository")
+
+	repositoryNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+	// names that would shadow top level routes
+	reservedRepositoryNames = map[string]bool{
+		"api":     true,
+		"chart":   true,
+		"health":  true,
+		"reindex": true,
+		"ui":      true,
+	}
+)
+
+// Repositories holds the named repositories served by one instance. Every repository has its
+// own backend, and with it its own index and reindex lock.
+type Repositories struct {
+	cfg  *config.AppConfig
+	init bool
+
+	lock     *sync.RWMutex
+	backends map[string]Backend
+	prefixes map[string]string
+
+	// where repositories created through Create are saved, nil unless creation is allowed
+	store      Store
+	createLock *sync.Mutex
+}
+
+// NewRepositories builds a backend for every repository declared in the config, and for every
+// one created through Create before
+func NewRepositories(cfg *config.AppConfig, init bool) (*Repositories, error) {
+
+	r := &Repositories{
+		cfg:  cfg,
+		init: init,
+
+		lock:     &sync.RWMutex{},
+		backends: map[string]Backend{},
+		prefixes: map[string]string{},
+
+		createLock: &sync.Mutex{},
+	}
+
+	if cfg.AllowRepoCreation {
+		store, err := newCreatedRepositoriesStore(cfg)
+		if err != nil {
+			return nil, err
+		}
+		r.store = store
+	}
+
+	for name, prefix := range cfg.Repositories {
+		_, err := r.Add(name, prefix)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := r.loadCreated()
+	if err != nil {
+		return nil, err
+	}
+
+	for name, upstream := range cfg.Upstream.Repositories {
+		_, err := r.AddUpstream(name, upstream)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// virtual repositories reference the others, so they go last
+	err = r.addVirtuals(cfg.VirtualRepositories)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// created repositories are saved next to the named repositories, where no repository's
+// prefix can reach as prefixes can't contain dots
+func newCreatedRepositoriesStore(cfg *config.AppConfig) (Store, error) {
+
+	store, err := newStore(cfg.ForRepository("", ""))
+	if err != nil {
+		return nil, fmt.Errorf("repository creation - %s", err.Error())
+	}
+
+	return store, nil
+}
+
+// Get returns the backend of the named repository
+func (r *Repositories) Get(name string) (Backend, bool) {
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	b, ok := r.backends[name]
+	return b, ok
+}
+
+// Names returns the sorted repository names
+func (r *Repositories) Names() []string {
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	names := []string{}
+	for name := range r.backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Create adds a repository like Add and saves it in the backend, so it's added again on the
+// next start
+func (r *Repositories) Create(name string, prefix string) (Backend, error) {
+
+	if r.store == nil {
+		return nil, fmt.Errorf("repository creation is disabled")
+	}
+
+	if prefix == "" {
+		prefix = name
+	}
+
+	r.createLock.Lock()
+	defer r.createLock.Unlock()
+
+	b, err := r.Add(name, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	// read back what's saved, another replica may have created repositories meanwhile
+	created, err := r.readCreated()
+	if err == nil {
+		created[name] = prefix
+		err = r.writeCreated(created)
+	}
+	if err != nil {
+		log.Errorf("failed saving repository %s: %s", name, err.Error())
+		r.remove(name)
+		return nil, ErrRepositoryNotSaved
+	}
+
+	return b, nil
+}
+
+// add the repositories saved by Create. One declared in the config since is left to the config.
+func (r *Repositories) loadCreated() error {
+
+	if r.store == nil {
+		return nil
+	}
+
+	created, err := r.readCreated()
+	if err != nil {
+		return fmt.Errorf("failed reading created repositories: %s", err.Error())
+	}
+
+	for name, prefix := range created {
+		if _, ok := r.cfg.Repositories[name]; ok {
+			log.Infof("repository %s is declared in the config, not adding the created one", name)
+			continue
+		}
+		_, err := r.Add(name, prefix)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// the saved prefix of every created repository
+func (r *Repositories) readCreated() (map[string]string, error) {
+
+	data, err := r.store.GetFile(createdRepositoriesFile)
+	if err == ErrFileNotFound {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	saved := map[string]map[string]string{}
+	err = json.Unmarshal(data, &saved)
+	if err != nil {
+		return nil, err
+	}
+	if saved["repositories"] == nil {
+		return map[string]string{}, nil
+	}
+
+	return saved["repositories"], nil
+}
+
+func (r *Repositories) writeCreated(created map[string]string) error {
+
+	data, err := json.Marshal(map[string]map[string]string{
+		"repositories": created,
+	})
+	if err != nil {
+		return err
+	}
+
+	return r.store.PutFile(createdRepositoriesFile, data)
+}
+
+// Add creates a repository stored at prefix in the configured backend
+func (r *Repositories) Add(name string, prefix string) (Backend, error) {
+
+	if prefix == "" {
+		prefix = name
+	}
+
+	return r.add(name, prefix, func() (Backend, error) {
+		return NewBackend(r.cfg.ForRepository(name, prefix), r.init)
+	})
+}
+
+// AddUpstream creates a repository proxying the upstream repository at url, caching its
+// content in the configured backend under the repository name
+func (r *Repositories) AddUpstream(name string, url string) (Backend, error) {
+
+	return r.add(name, name, func() (Backend, error) {
+		repoCfg := r.cfg.ForRepository(name, name)
+
+		cache, err := NewBackend(repoCfg, false)
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := newProxy(repoCfg, url, cache)
+		if err != nil {
+			return nil, err
+		}
+
+		if r.init {
+			err = b.Initialize()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return b, nil
+	})
+}
+
+// AddVirtual creates a repository merging the existing member repositories, in priority order
+func (r *Repositories) AddVirtual(name string, members []string) (Backend, error) {
+
+	return r.add(name, name, func() (Backend, error) {
+		names := []string{}
+		backends := []Backend{}
+		for _, member := range members {
+			member = strings.TrimSpace(member)
+			b, ok := r.Get(member)
+			if !ok {
+				return nil, fmt.Errorf("virtual repository %s - unknown member repository: %s", name, member)
+			}
+			names = append(names, member)
+			backends = append(backends, b)
+		}
+
+		return newVirtual(r.cfg.ForRepository(name, name), names, backends)
+	})
+}
+
+/*
+ * add the virtual repositories, each one after the virtual repositories it
+ * has as members
+ */
+func (r *Repositories) addVirtuals(virtuals map[string]string) error {
+
+	names := []string{}
+	for name := range virtuals {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	added := map[string]bool{}
+	path := []string{}
+
+	var visit func(name string) error
+	visit = func(name string) error {
+		if added[name] {
+			return nil
+		}
+		for n, visiting := range path {
+			if visiting == name {
+				cycle := append(path[n:], name)
+				return fmt.Errorf("virtual repository %s - member cycle: %s", name, strings.Join(cycle, " -> "))
+			}
+		}
+
+		path = append(path, name)
+		members := strings.Split(virtuals[name], ",")
+		for _, member := range members {
+			member = strings.TrimSpace(member)
+			if _, ok := virtuals[member]; ok {
+				err := visit(member)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		path = path[:len(path)-1]
+
+		_, err := r.AddVirtual(name, members)
+		if err != nil {
+			return err
+		}
+		added[name] = true
+
+		return nil
+	}
+
+	for _, name := range names {
+		err := visit(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *Repositories) add(name string, prefix string, build func() (Backend, error)) (Backend, error) {
+
+	err := validateRepositoryName(name)
+	if err != nil {
+		return nil, err
+	}
+	err = validateRepositoryPrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	r.lock.RLock()
+	err = r.checkAvailable(name, prefix)
+	r.lock.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// building may initialize the backend, so don't hold the lock for it
+	b, err := build()
+	if err != nil {
+		return nil, err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	err = r.checkAvailable(name, prefix)
+	if err != nil {
+		return nil, err
+	}
+	r.backends[name] = b
+	r.prefixes[name] = prefix
+
+	return b, nil
+}
+
+func (r *Repositories) remove(name string) {
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	delete(r.backends, name)
+	delete(r.prefixes, name)
+}
+
+// repositories can't share a name, nor store their charts inside each other's prefix
+func (r *Repositories) checkAvailable(name string, prefix string) error {
+
+	if _, ok := r.backends[name]; ok {
+		return fmt.Errorf("repository already exists: %s", name)
+	}
+	for other, otherPrefix := range r.prefixes {
+		if prefix == otherPrefix ||
+			strings.HasPrefix(prefix, otherPrefix+"/") ||
+			strings.HasPrefix(otherPrefix, prefix+"/") {
+			return fmt.Errorf("repository prefix %s overlaps repository %s", prefix, other)
+		}
+	}
+
+	return nil
+}
+
+func validateRepositoryName(name string) error {
+	if !repositoryNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid repository name: %s", name)
+	}
+	if reservedRepositoryNames[name] {
+		return fmt.Errorf("reserved repository name: %s", name)
+	}
+	return nil
+}
+
+// prefixes are one or more segments, each a valid repository name
+func validateRepositoryPrefix(prefix string) error {
+	for _, segment := range strings.Split(prefix, "/") {
+		if !repositoryNamePattern.MatchString(segment) {
+			return fmt.Errorf("invalid repository prefix: %s", prefix)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package backend
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zlangbert/hrp/config"
+)
+
+func TestNewRepositories(t *testing.T) {
+
+	cfg := testConfig()
+	cfg.BackendName = "s3"
+	cfg.Repositories = map[string]string{
+		"stable":    "stable",
+		"incubator": "incubator",
+	}
+
+	r, err := NewRepositories(cfg, false)
+
+	assert.Nil(t, err, "nil err")
+	assert.Equal(t, []string{"incubator", "stable"}, r.Names())
+
+	b, ok := r.Get("stable")
+	if assert.True(t, ok, "expected stable repository") {
+		s3b := b.(*s3Backend)
+		assert.Equal(t, "prefix-repos/stable", s3b.config.S3.Prefix)
+		assert.Equal(t, "/tmp/hrp-repos/stable", s3b.config.S3.LocalSyncPath)
+	}
+}
+
+func TestNewRepositories_InvalidBackend(t *testing.T) {
+
+	cfg := config.New()
+	cfg.Repositories = map[string]string{"stable": "stable"}
+
+	r, err := NewRepositories(cfg, false)
+
+	assert.Nil(t, r, "nil repositories")
+	assert.Error(t, err, "expected error")
+}
+
+func TestRepositories_Add(t *testing.T) {
+
+	cfg := testConfig()
+	cfg.BackendName = "s3"
+	r, _ := NewRepositories(cfg, false)
+
+	b, err := r.Add("team-a", "")
+
+	assert.Nil(t, err, "nil err")
+	assert.Equal(t, "prefix-repos/team-a", b.(*s3Backend).config.S3.Prefix, "expected prefix to default to name")
+
+	_, ok := r.Get("team-a")
+	assert.True(t, ok, "expected repository to be registered")
+}
+
+func TestRepositories_Add_Duplicate(t *testing.T) {
+
+	cfg := testConfig()
+	cfg.BackendName = "s3"
+	r, _ := NewRepositories(cfg, false)
+	r.Add("team-a", "")
+
+	_, err := r.Add("team-a", "other")
+
+	if assert.Error(t, err, "expected error") {
+		assert.Contains(t, err.Error(), "already exists")
+	}
+}
+
+func TestRepositories_Add_InvalidName(t *testing.T) {
+
+	cfg := testConfig()
+	cfg.BackendName = "s3"
+	r, _ := NewRepositories(cfg, false)
+
+	for _, name := range []string{"", "Team", "a/b", "index.yaml", "api", "chart", "ui"} {
+		_, err := r.Add(name, "")
+		assert.Error(t, err, "expected error for %q", name)
+	}
+}
+
+func TestRepositories_Add_InvalidPrefix(t *testing.T) {
+
+	cfg := testConfig()
+	cfg.BackendName = "s3"
+	r, _ := NewRepositories(cfg, false)
+
+	for _, prefix := range []string{".", "..", "a/../b", "/a", "a/", "a//b", "Team"} {
+		_, err := r.Add("team-a", prefix)
+		assert.Error(t, err, "expected error for %q", prefix)
+	}
+
+	_, err := r.Add("team-a", "teams/a")
+	assert.Nil(t, err, "expected nested prefix to be valid")
+}
+
+func TestRepositories_Add_OverlappingPrefix(t *testing.T) {
+
+	cfg := testConfig()
+	cfg.BackendName = "s3"
+	r, _ := NewRepositories(cfg, false)
+	r.Add("team-a", "teams/a")
+
+	for _, prefix := range []string{"teams/a", "teams", "teams/a/b"} {
+		_, err := r.Add("team-b", prefix)
+		if assert.Error(t, err, "expected error for %q", prefix) {
+			assert.Contains(t, err.Error(), "overlaps repository team-a")
+		}
+	}
+
+	_, err := r.Add("team-b", "teams/b")
+	assert.Nil(t, err, "expected sibling prefix to be valid")
+}
+
+func TestNewRepositories_VirtualMembersFirst(t *testing.T) {
+
+	cfg := testConfig()
+	cfg.BackendName = "s3"
+	cfg.Repositories = map[string]string{
+		"stable":    "stable",
+		"incubator": "incubator",
+	}
+	cfg.VirtualRepositories = map[string]string{
+		"a-all":  "b-both, stable",
+		"b-both": "stable, incubator",
+	}
+
+	r, err := NewRepositories(cfg, false)
+
+	assert.Nil(t, err, "nil err")
+	assert.Equal(t, []string{"a-all", "b-both", "incubator", "stable"}, r.Names())
+}
+
+func TestNewRepositories_VirtualMemberCycle(t *testing.T) {
+
+	cfg := testConfig()
+	cfg.BackendName = "s3"
+	cfg.Repositories = map[string]string{"stable": "stable"}
+	cfg.VirtualRepositories = map[string]string{
+		"a": "stable, b",
+		"b": "c",
+		"c": "a",
+	}
+
+	r, err := NewRepositories(cfg, false)
+
+	assert.Nil(t, r, "nil repositories")
+	if assert.Error(t, err, "expected error") {
+		assert.Contains(t, err.Error(), "member cycle: a -> b -> c -> a")
+	}
+}
+
+func TestNewCreatedRepositoriesStore(t *testing.T) {
+
+	cfg := testConfig()
+	cfg.BackendName = "s3"
+
+	store, err := newCreatedRepositoriesStore(cfg)
+
+	assert.Nil(t, err, "nil err")
+	if assert.NotNil(t, store, "expected store for created repositories") {
+		assert.Equal(t, "prefix-repos", store.(*s3Backend).config.S3.Prefix, "expected store next to the repositories")
+	}
+}
+
+func TestNewRepositories_AllowRepoCreation_NotAStore(t *testing.T) {
+
+	cfg := config.New()
+	cfg.BackendName = "oci"
+	cfg.OCI.Registry = "localhost:5000"
+	cfg.AllowRepoCreation = true
+
+	_, err := NewRepositories(cfg, false)
+
+	if assert.Error(t, err, "expected error") {
+		assert.Contains(t, err.Error(), "oci backend can't store files")
+	}
+}
+
+func TestRepositories_Create(t *testing.T) {
+
+	cfg := testConfig()
+	cfg.BackendName = "s3"
+	store := newMemoryStore()
+	r, _ := NewRepositories(cfg, false)
+	r.store = store
+
+	// run
+	_, err := r.Create("team-a", "teams/a")
+
+	// check
+	assert.Nil(t, err, "nil err")
+	assert.JSONEq(t, `{"repositories":{"team-a":"teams/a"}}`, string(store.files["repositories.json"]))
+
+	// added again on the next start
+	restarted, _ := NewRepositories(cfg, false)
+	restarted.store = store
+	err = restarted.loadCreated()
+	assert.Nil(t, err, "nil err")
+	b, ok := restarted.Get("team-a")
+	if assert.True(t, ok, "expected created repository") {
+		assert.Equal(t, "prefix-repos/teams/a", b.(*s3Backend).config.S3.Prefix)
+	}
+}
+
+func TestRepositories_Create_Disabled(t *testing.T) {
+
+	cfg := testConfig()
+	cfg.BackendName = "s3"
+	r, _ := NewRepositories(cfg, false)
+
+	_, err := r.Create("team-a", "")
+
+	assert.Error(t, err, "expected error")
+	_, ok := r.Get("team-a")
+	assert.False(t, ok, "expected no repository")
+}
@@ -1,6 +1,13 @@
 package config
 
 import (
+	"errors"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/units"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
@@ -14,7 +21,76 @@ type AppConfig struct {
 	BackendName string
 	Debug       bool
 
-	S3 S3Config
+	// how often every repository is reindexed in the background, 0 to disable
+	ReindexInterval time.Duration
+
+	// named repositories, mapping repository name to storage prefix
+	Repositories      map[string]string
+	AllowRepoCreation bool
+
+	// virtual repositories, mapping repository name to a comma separated
+	// list of member repositories in priority order
+	VirtualRepositories map[string]string
+
+	// pgp keyring used to verify uploaded provenance files, and the
+	// repositories that only accept signed charts
+	ProvenanceKeyring        string
+	RequireProvenance        bool
+	RequireProvenanceForRepo []string
+
+	// largest chart and largest request body accepted by uploads, 0 for no limit
+	MaxChartSize  units.Base2Bytes
+	MaxUploadSize units.Base2Bytes
+
+	// whether uploaded charts' dependencies on this repository have to resolve: off, warn or reject
+	DependencyCheck string
+
+	// yaml file with users and the rules authorizing them
+	AuthPolicy string
+
+	JWT JWTConfig
+
+	// audit log file, "-" for stdout, and whether to also keep it in the backend
+	AuditLog   string
+	AuditStore bool
+
+	Retention RetentionConfig
+
+	// how many replicas share the backend, more than one needs a shared lock
+	Replicas int
+	Lock     LockConfig
+
+	Upstream UpstreamConfig
+
+	S3  S3Config
+	OCI OCIConfig
+}
+
+// RetentionConfig contains config for pruning old chart versions
+type RetentionConfig struct {
+	// rules in the form <pattern>:keep-last=N,keep-days=N,keep-releases
+	Rules    []string
+	Interval time.Duration
+	DryRun   bool
+}
+
+// LockConfig contains config for the lock shared by replicas around index writes
+type LockConfig struct {
+	// none, dynamodb or file
+	Type          string
+	DynamoDBTable string
+	Dir           string
+	TTL           time.Duration
+	Timeout       time.Duration
+}
+
+// UpstreamConfig contains config for proxying upstream repositories
+type UpstreamConfig struct {
+	// upstream repositories, mapping repository name to upstream url
+	Repositories map[string]string
+	IndexTTL     time.Duration
+	Timeout      time.Duration
+	RetryDelay   time.Duration
 }
 
 // S3Config contains s3 specific config
@@ -24,15 +100,110 @@ type S3Config struct {
 	Prefix        string
 	LocalSyncPath string
 	Debug         bool
+
+	// object upload options
+	ServerSideEncryption string
+	SSEKMSKeyID          string
+	ACL                  string
+	StorageClass         string
+	Tags                 map[string]string
+
+	// sqs queue receiving the bucket's event notifications, and how often a
+	// message is retried before it is dropped
+	SQSQueueURL    string
+	SQSMaxReceives int
+}
+
+// JWTConfig contains config for authenticating with bearer tokens from an oidc provider
+type JWTConfig struct {
+	Issuer        string
+	Audience      string
+	JWKSURL       string
+	JWKSFile      string
+	UsernameClaim string
+	GroupsClaim   string
+}
+
+// OCIConfig contains oci registry specific config
+type OCIConfig struct {
+	Registry  string
+	Namespace string
+	Username  string
+	Password  string
+	PlainHTTP bool
+	Timeout   time.Duration
 }
 
 // New returns a new, empty AppConfig
 func New() *AppConfig {
 	return &AppConfig{
-		S3: S3Config{},
+		Repositories:        map[string]string{},
+		VirtualRepositories: map[string]string{},
+		Upstream: UpstreamConfig{
+			Repositories: map[string]string{},
+		},
+		S3: S3Config{
+			Tags: map[string]string{},
+		},
 	}
 }
 
+// ForRepository returns a copy of the config for the named repository, with the base url and
+// storage locations scoped to it. S3 repositories are stored next to the root repository, in
+// <prefix>-repos/, as the root's sync and reindex would otherwise pick up their charts.
+func (cfg *AppConfig) ForRepository(name string, prefix string) *AppConfig {
+
+	repoCfg := *cfg
+	repoCfg.BaseURL = strings.TrimSuffix(cfg.BaseURL, "/") + "/" + name
+	repoCfg.S3.Prefix = path.Join(siblingPath(cfg.S3.Prefix, "repos", "/"), prefix)
+	repoCfg.S3.LocalSyncPath = filepath.Join(siblingPath(cfg.S3.LocalSyncPath, "repos", string(filepath.Separator)), name)
+	repoCfg.OCI.Namespace = path.Join(cfg.OCI.Namespace, prefix)
+
+	// one consumer owns the event queue, so named repositories rely on reindexing
+	repoCfg.S3.SQSQueueURL = ""
+
+	return &repoCfg
+}
+
+// ForAudit returns a copy of the config storing the audit log next to the root repository, in
+// <prefix>-audit/, out of reach of any repository's sync and reindex.
+func (cfg *AppConfig) ForAudit() *AppConfig {
+
+	auditCfg := *cfg
+	auditCfg.S3.Prefix = siblingPath(cfg.S3.Prefix, "audit", "/")
+	auditCfg.S3.LocalSyncPath = siblingPath(cfg.S3.LocalSyncPath, "audit", string(filepath.Separator))
+	auditCfg.S3.SQSQueueURL = ""
+
+	return &auditCfg
+}
+
+// the location next to root holding what is kept apart from the root repository
+func siblingPath(root string, name string, separator string) string {
+
+	root = strings.TrimRight(root, separator)
+	if root == "" {
+		return name
+	}
+
+	return root + "-" + name
+}
+
+// ProvenanceRequired returns true if charts uploaded to the repository must come with a valid
+// provenance file. The root repository has an empty name.
+func (cfg *AppConfig) ProvenanceRequired(repo string) bool {
+
+	if cfg.RequireProvenance {
+		return true
+	}
+	for _, name := range cfg.RequireProvenanceForRepo {
+		if name == repo {
+			return true
+		}
+	}
+
+	return false
+}
+
 // Parse parses the command line flags and builds the config
 func (cfg *AppConfig) Parse(args []string) error {
 
@@ -44,14 +215,142 @@ func (cfg *AppConfig) Parse(args []string) error {
 		PlaceHolder("https://charts.mycompany.com").
 		StringVar(&cfg.BaseURL)
 
-	app.Flag("backend", "storage backend to use (s3)").
+	app.Flag("backend", "storage backend to use (s3, oci)").
 		Required().
 		PlaceHolder("backend").
-		EnumVar(&cfg.BackendName, "s3")
+		EnumVar(&cfg.BackendName, "s3", "oci")
 
 	app.Flag("debug", "app debug mode").
 		BoolVar(&cfg.Debug)
 
+	app.Flag("reindex-interval", "How often to reindex every repository in the background, picking up charts written to storage directly, 0 to disable").
+		Default("0").
+		DurationVar(&cfg.ReindexInterval)
+
+	app.Flag("repo", "Named repository served under /<name>, stored at the given prefix, may be repeated").
+		PlaceHolder("name=prefix").
+		StringMapVar(&cfg.Repositories)
+
+	app.Flag("virtual-repo", "Virtual repository served under /<name>, merging the member repositories in priority order, may be repeated").
+		PlaceHolder("name=repo1,repo2").
+		StringMapVar(&cfg.VirtualRepositories)
+
+	app.Flag("provenance-keyring", "PGP public keyring to verify uploaded provenance files against").
+		PlaceHolder("/etc/hrp/pubring.gpg").
+		ExistingFileVar(&cfg.ProvenanceKeyring)
+
+	app.Flag("max-chart-size", "Largest chart accepted by uploads, 0 for no limit").
+		Default("100MB").
+		BytesVar(&cfg.MaxChartSize)
+
+	app.Flag("max-upload-size", "Largest request body accepted by uploads, covering every chart of a batch, 0 for no limit").
+		Default("500MB").
+		BytesVar(&cfg.MaxUploadSize)
+
+	app.Flag("dependency-check", "Check that the dependencies of uploaded charts on this repository resolve to existing chart versions (off, warn, reject)").
+		Default("off").
+		EnumVar(&cfg.DependencyCheck, "off", "warn", "reject")
+
+	app.Flag("auth-policy", "YAML file with users and rules granting permissions on charts, enables authorization").
+		PlaceHolder("/etc/hrp/policy.yaml").
+		ExistingFileVar(&cfg.AuthPolicy)
+
+	// build jwt auth config
+	app.Flag("jwt-issuer", "Issuer of accepted bearer tokens, enables jwt authentication").
+		PlaceHolder("https://token.actions.githubusercontent.com").
+		StringVar(&cfg.JWT.Issuer)
+
+	app.Flag("jwt-audience", "Audience accepted bearer tokens must be issued for").
+		PlaceHolder("https://charts.mycompany.com").
+		StringVar(&cfg.JWT.Audience)
+
+	app.Flag("jwt-jwks-url", "URL of the issuer's JSON web key set").
+		PlaceHolder("https://token.actions.githubusercontent.com/.well-known/jwks").
+		StringVar(&cfg.JWT.JWKSURL)
+
+	app.Flag("jwt-jwks-file", "File containing the issuer's JSON web key set, instead of --jwt-jwks-url").
+		PlaceHolder("/etc/hrp/jwks.json").
+		ExistingFileVar(&cfg.JWT.JWKSFile)
+
+	app.Flag("jwt-username-claim", "Token claim used as the identity name").
+		Default("sub").
+		StringVar(&cfg.JWT.UsernameClaim)
+
+	app.Flag("jwt-groups-claim", "Token claim used as the identity groups").
+		Default("groups").
+		StringVar(&cfg.JWT.GroupsClaim)
+
+	app.Flag("audit-log", "File to append the audit log of repository mutations to as JSON lines, - for stdout").
+		PlaceHolder("/var/log/hrp/audit.log").
+		StringVar(&cfg.AuditLog)
+
+	app.Flag("audit-store", "Also store the audit log in the backend, next to the repository under <prefix>-audit/").
+		BoolVar(&cfg.AuditStore)
+
+	// build retention config
+	app.Flag("retention-rule", "Retention rule pruning old versions of matching charts, the first matching rule applies, may be repeated").
+		PlaceHolder("*-snapshot:keep-last=10,keep-days=30,keep-releases").
+		StringsVar(&cfg.Retention.Rules)
+
+	app.Flag("retention-interval", "How often retention runs against every repository, 0 to only run through the api").
+		Default("0").
+		DurationVar(&cfg.Retention.Interval)
+
+	app.Flag("retention-dry-run", "Only report the chart versions retention would delete").
+		BoolVar(&cfg.Retention.DryRun)
+
+	app.Flag("require-provenance", "Reject charts uploaded without a valid provenance file in every repository").
+		BoolVar(&cfg.RequireProvenance)
+
+	app.Flag("require-provenance-repo", "Reject charts uploaded without a valid provenance file in the named repository, may be repeated").
+		PlaceHolder("name").
+		StringsVar(&cfg.RequireProvenanceForRepo)
+
+	app.Flag("allow-repo-creation", "Allow named repositories to be created through the api").
+		BoolVar(&cfg.AllowRepoCreation)
+
+	// build distributed lock config
+	app.Flag("replicas", "How many replicas share the backend, more than one needs --lock with the s3 backend").
+		Default("1").
+		IntVar(&cfg.Replicas)
+
+	app.Flag("lock", "Lock shared by replicas around uploads and index regeneration (none, dynamodb, file)").
+		Default("none").
+		EnumVar(&cfg.Lock.Type, "none", "dynamodb", "file")
+
+	app.Flag("lock-dynamodb-table", "DynamoDB table holding locks, with the string hash key 'name'").
+		PlaceHolder("hrp-locks").
+		StringVar(&cfg.Lock.DynamoDBTable)
+
+	app.Flag("lock-dir", "Directory shared by replicas holding lock files").
+		PlaceHolder("/mnt/shared/hrp-locks").
+		StringVar(&cfg.Lock.Dir)
+
+	app.Flag("lock-ttl", "How long a lock is held without renewal, so locks of crashed replicas expire").
+		Default("30s").
+		DurationVar(&cfg.Lock.TTL)
+
+	app.Flag("lock-timeout", "How long to wait for a lock held by another replica").
+		Default("5m").
+		DurationVar(&cfg.Lock.Timeout)
+
+	// build upstream proxy config
+	app.Flag("upstream", "Upstream repository proxied under /<name> and cached in the backend, may be repeated").
+		PlaceHolder("name=https://kubernetes-charts.storage.googleapis.com").
+		StringMapVar(&cfg.Upstream.Repositories)
+
+	app.Flag("upstream-index-ttl", "How long an upstream index is served before being refreshed").
+		Default("5m").
+		DurationVar(&cfg.Upstream.IndexTTL)
+
+	app.Flag("upstream-timeout", "Timeout for requests to upstream repositories").
+		Default("30s").
+		DurationVar(&cfg.Upstream.Timeout)
+
+	app.Flag("upstream-retry-delay", "How long to serve the cached index after a failed upstream refresh before trying again").
+		Default("30s").
+		DurationVar(&cfg.Upstream.RetryDelay)
+
 	// build s3 backend config
 	app.Flag("s3-region", "The AWS region the bucket is in").
 		PlaceHolder("us-east-1").
@@ -69,10 +368,76 @@ func (cfg *AppConfig) Parse(args []string) error {
 		Default("/tmp/hrp").
 		StringVar(&cfg.S3.LocalSyncPath)
 
+	app.Flag("s3-sse", "Server side encryption to apply to uploaded objects (AES256, aws:kms)").
+		PlaceHolder("aws:kms").
+		EnumVar(&cfg.S3.ServerSideEncryption, "AES256", "aws:kms")
+
+	app.Flag("s3-sse-kms-key-id", "The KMS key id to use with aws:kms server side encryption").
+		PlaceHolder("arn:aws:kms:us-east-1:123456789012:key/my-key").
+		StringVar(&cfg.S3.SSEKMSKeyID)
+
+	app.Flag("s3-acl", "Canned ACL to apply to uploaded objects").
+		PlaceHolder("private").
+		StringVar(&cfg.S3.ACL)
+
+	app.Flag("s3-storage-class", "Storage class to use for uploaded objects").
+		PlaceHolder("STANDARD").
+		StringVar(&cfg.S3.StorageClass)
+
+	app.Flag("s3-tag", "Tag to apply to uploaded objects, may be repeated").
+		PlaceHolder("key=value").
+		StringMapVar(&cfg.S3.Tags)
+
+	app.Flag("s3-sqs-queue-url", "SQS queue receiving the bucket's event notifications, to update the index as charts are written to the bucket").
+		PlaceHolder("https://sqs.us-east-1.amazonaws.com/123456789012/hrp-events").
+		StringVar(&cfg.S3.SQSQueueURL)
+
+	app.Flag("s3-sqs-max-receives", "How often an event notification that fails to apply is received before it is dropped").
+		Default("5").
+		IntVar(&cfg.S3.SQSMaxReceives)
+
+	// build oci backend config
+	app.Flag("oci-registry", "The OCI registry host to store charts in").
+		PlaceHolder("registry.mycompany.com").
+		StringVar(&cfg.OCI.Registry)
+
+	app.Flag("oci-namespace", "The registry namespace to store charts under").
+		PlaceHolder("charts").
+		StringVar(&cfg.OCI.Namespace)
+
+	app.Flag("oci-username", "The registry username").
+		Envar("HRP_OCI_USERNAME").
+		StringVar(&cfg.OCI.Username)
+
+	app.Flag("oci-password", "The registry password").
+		Envar("HRP_OCI_PASSWORD").
+		StringVar(&cfg.OCI.Password)
+
+	app.Flag("oci-plain-http", "Use plain http to talk to the registry").
+		BoolVar(&cfg.OCI.PlainHTTP)
+
+	app.Flag("oci-timeout", "Timeout for requests to the registry").
+		Default("1m").
+		DurationVar(&cfg.OCI.Timeout)
+
 	_, err := app.Parse(args)
 	if err != nil {
 		return err
 	}
 
+	if (cfg.RequireProvenance || len(cfg.RequireProvenanceForRepo) > 0) && cfg.ProvenanceKeyring == "" {
+		return errors.New("requiring provenance needs --provenance-keyring")
+	}
+
+	// leases are renewed every third of the ttl, shorter ones would expire between renewals
+	if cfg.Lock.TTL < time.Second {
+		return errors.New("--lock-ttl must be at least 1s")
+	}
+
+	// s3 can't write the index conditionally, so only the lock keeps replicas from losing each other's updates
+	if cfg.Replicas > 1 && cfg.BackendName == "s3" && cfg.Lock.Type == "none" {
+		return errors.New("running more than one replica with the s3 backend needs --lock")
+	}
+
 	return nil
 }
@@ -1,8 +1,10 @@
 package config
 
 import (
+	"github.com/alecthomas/units"
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 )
 
 func TestNew(t *testing.T) {
@@ -39,3 +41,298 @@ func TestAppConfig_Parse(t *testing.T) {
 	assert.Equal(t, "http://localhost:1323", cfg.BaseURL, "unexpected baseURL")
 	assert.Equal(t, "s3", cfg.BackendName, "unexpected backend")
 }
+
+func TestAppConfig_Parse_S3UploadOptions(t *testing.T) {
+
+	args := []string{
+		"--base-url=http://localhost:1323",
+		"--backend=s3",
+		"--s3-sse=aws:kms",
+		"--s3-sse-kms-key-id=key",
+		"--s3-acl=private",
+		"--s3-storage-class=STANDARD_IA",
+		"--s3-tag=team=platform",
+		"--s3-tag=env=prod",
+	}
+
+	cfg := New()
+	err := cfg.Parse(args)
+
+	assert.Nil(t, err, "expected no error")
+	assert.Equal(t, "aws:kms", cfg.S3.ServerSideEncryption, "unexpected sse")
+	assert.Equal(t, "key", cfg.S3.SSEKMSKeyID, "unexpected kms key id")
+	assert.Equal(t, "private", cfg.S3.ACL, "unexpected acl")
+	assert.Equal(t, "STANDARD_IA", cfg.S3.StorageClass, "unexpected storage class")
+	assert.Equal(t, map[string]string{"team": "platform", "env": "prod"}, cfg.S3.Tags, "unexpected tags")
+}
+
+func TestAppConfig_Parse_Repositories(t *testing.T) {
+
+	args := []string{
+		"--base-url=http://localhost:1323",
+		"--backend=s3",
+		"--repo=stable=charts/stable",
+		"--repo=incubator=charts/incubator",
+	}
+
+	cfg := New()
+	err := cfg.Parse(args)
+
+	assert.Nil(t, err, "expected no error")
+	assert.Equal(t, map[string]string{
+		"stable":    "charts/stable",
+		"incubator": "charts/incubator",
+	}, cfg.Repositories, "unexpected repositories")
+}
+
+func TestAppConfig_ForRepository(t *testing.T) {
+
+	cfg := New()
+	cfg.BaseURL = "http://localhost:1323/"
+	cfg.S3.Prefix = "charts/"
+	cfg.S3.LocalSyncPath = "/tmp/hrp"
+	cfg.OCI.Namespace = "helm"
+	cfg.S3.SQSQueueURL = "https://sqs.us-east-1.amazonaws.com/123456789012/hrp-events"
+
+	repoCfg := cfg.ForRepository("stable", "stable-charts")
+
+	assert.Equal(t, "http://localhost:1323/stable", repoCfg.BaseURL, "unexpected baseURL")
+	assert.Equal(t, "charts-repos/stable-charts", repoCfg.S3.Prefix, "unexpected s3 prefix")
+	assert.Equal(t, "/tmp/hrp-repos/stable", repoCfg.S3.LocalSyncPath, "unexpected local sync path")
+	assert.Equal(t, "helm/stable-charts", repoCfg.OCI.Namespace, "unexpected oci namespace")
+	assert.Empty(t, repoCfg.S3.SQSQueueURL, "expected event queue not shared")
+	assert.Equal(t, "charts/", cfg.S3.Prefix, "original config unchanged")
+}
+
+func TestAppConfig_ForAudit(t *testing.T) {
+
+	cfg := New()
+	cfg.S3.Prefix = "charts/"
+	cfg.S3.LocalSyncPath = "/tmp/hrp"
+	cfg.S3.SQSQueueURL = "https://sqs.us-east-1.amazonaws.com/123456789012/hrp-events"
+
+	auditCfg := cfg.ForAudit()
+
+	assert.Equal(t, "charts-audit", auditCfg.S3.Prefix, "unexpected s3 prefix")
+	assert.Equal(t, "/tmp/hrp-audit", auditCfg.S3.LocalSyncPath, "unexpected local sync path")
+	assert.Empty(t, auditCfg.S3.SQSQueueURL, "expected event queue not shared")
+	assert.Equal(t, "charts/", cfg.S3.Prefix, "original config unchanged")
+}
+
+func TestAppConfig_ForRepository_NoPrefix(t *testing.T) {
+
+	cfg := New()
+	cfg.BaseURL = "http://localhost:1323"
+	cfg.S3.LocalSyncPath = "/tmp/hrp/"
+
+	repoCfg := cfg.ForRepository("stable", "stable")
+
+	assert.Equal(t, "repos/stable", repoCfg.S3.Prefix, "unexpected s3 prefix")
+	assert.Equal(t, "/tmp/hrp-repos/stable", repoCfg.S3.LocalSyncPath, "unexpected local sync path")
+}
+
+func TestAppConfig_Parse_Upstreams(t *testing.T) {
+
+	args := []string{
+		"--base-url=http://localhost:1323",
+		"--backend=s3",
+		"--upstream=stable=https://kubernetes-charts.storage.googleapis.com",
+		"--upstream-index-ttl=1m",
+	}
+
+	cfg := New()
+	err := cfg.Parse(args)
+
+	assert.Nil(t, err, "expected no error")
+	assert.Equal(t, map[string]string{
+		"stable": "https://kubernetes-charts.storage.googleapis.com",
+	}, cfg.Upstream.Repositories, "unexpected upstreams")
+	assert.Equal(t, time.Minute, cfg.Upstream.IndexTTL, "unexpected index ttl")
+	assert.Equal(t, 30*time.Second, cfg.Upstream.Timeout, "unexpected default timeout")
+	assert.Equal(t, 30*time.Second, cfg.Upstream.RetryDelay, "unexpected default retry delay")
+}
+
+func TestAppConfig_Parse_ReindexInterval(t *testing.T) {
+
+	args := []string{
+		"--base-url=http://localhost:1323",
+		"--backend=s3",
+		"--reindex-interval=10m",
+	}
+
+	cfg := New()
+	err := cfg.Parse(args)
+
+	assert.Nil(t, err, "expected no error")
+	assert.Equal(t, 10*time.Minute, cfg.ReindexInterval, "unexpected reindex interval")
+}
+
+func TestAppConfig_Parse_MaxChartSize(t *testing.T) {
+
+	args := []string{
+		"--base-url=http://localhost:1323",
+		"--backend=s3",
+		"--max-chart-size=10MB",
+		"--max-upload-size=1GB",
+	}
+
+	cfg := New()
+	err := cfg.Parse(args)
+
+	assert.Nil(t, err, "expected no error")
+	assert.Equal(t, 10*units.MiB, cfg.MaxChartSize, "unexpected max chart size")
+	assert.Equal(t, units.GiB, cfg.MaxUploadSize, "unexpected max upload size")
+}
+
+func TestAppConfig_Parse_MaxChartSizeDefault(t *testing.T) {
+
+	args := []string{
+		"--base-url=http://localhost:1323",
+		"--backend=s3",
+	}
+
+	cfg := New()
+	err := cfg.Parse(args)
+
+	assert.Nil(t, err, "expected no error")
+	assert.Equal(t, 100*units.MiB, cfg.MaxChartSize, "unexpected default max chart size")
+	assert.Equal(t, 500*units.MiB, cfg.MaxUploadSize, "unexpected default max upload size")
+}
+
+func TestAppConfig_Parse_DependencyCheck(t *testing.T) {
+
+	args := []string{
+		"--base-url=http://localhost:1323",
+		"--backend=s3",
+		"--dependency-check=reject",
+	}
+
+	cfg := New()
+	err := cfg.Parse(args)
+
+	assert.Nil(t, err, "expected no error")
+	assert.Equal(t, "reject", cfg.DependencyCheck, "unexpected dependency check")
+}
+
+func TestAppConfig_Parse_Lock(t *testing.T) {
+
+	args := []string{
+		"--base-url=http://localhost:1323",
+		"--backend=s3",
+		"--lock=dynamodb",
+		"--lock-dynamodb-table=hrp-locks",
+	}
+
+	cfg := New()
+	err := cfg.Parse(args)
+
+	assert.Nil(t, err, "expected no error")
+	assert.Equal(t, "dynamodb", cfg.Lock.Type, "unexpected lock type")
+	assert.Equal(t, "hrp-locks", cfg.Lock.DynamoDBTable, "unexpected table")
+	assert.Equal(t, 30*time.Second, cfg.Lock.TTL, "unexpected default ttl")
+	assert.Equal(t, 5*time.Minute, cfg.Lock.Timeout, "unexpected default timeout")
+}
+
+func TestAppConfig_Parse_LockTTLTooShort(t *testing.T) {
+
+	args := []string{
+		"--base-url=http://localhost:1323",
+		"--backend=s3",
+		"--lock=file",
+		"--lock-dir=/mnt/shared/hrp-locks",
+		"--lock-ttl=1ns",
+	}
+
+	cfg := New()
+	err := cfg.Parse(args)
+
+	if assert.Error(t, err, "expected err") {
+		assert.Contains(t, err.Error(), "--lock-ttl")
+	}
+}
+
+func TestAppConfig_Parse_ReplicasWithoutLock(t *testing.T) {
+
+	args := []string{
+		"--base-url=http://localhost:1323",
+		"--backend=s3",
+		"--replicas=2",
+	}
+
+	cfg := New()
+	err := cfg.Parse(args)
+
+	if assert.Error(t, err, "expected err") {
+		assert.Contains(t, err.Error(), "--lock")
+	}
+}
+
+func TestAppConfig_Parse_ReplicasWithLock(t *testing.T) {
+
+	args := []string{
+		"--base-url=http://localhost:1323",
+		"--backend=s3",
+		"--replicas=2",
+		"--lock=file",
+		"--lock-dir=/mnt/shared/hrp-locks",
+	}
+
+	cfg := New()
+	err := cfg.Parse(args)
+
+	assert.Nil(t, err, "expected no error")
+	assert.Equal(t, 2, cfg.Replicas, "unexpected replicas")
+}
+
+func TestAppConfig_Parse_Retention(t *testing.T) {
+
+	args := []string{
+		"--base-url=http://localhost:1323",
+		"--backend=s3",
+		"--retention-rule=*-snapshot:keep-last=5",
+		"--retention-rule=*:keep-days=90,keep-releases",
+		"--retention-interval=24h",
+	}
+
+	cfg := New()
+	err := cfg.Parse(args)
+
+	assert.Nil(t, err, "expected no error")
+	assert.Equal(t, []string{
+		"*-snapshot:keep-last=5",
+		"*:keep-days=90,keep-releases",
+	}, cfg.Retention.Rules, "unexpected rules")
+	assert.Equal(t, 24*time.Hour, cfg.Retention.Interval, "unexpected interval")
+	assert.False(t, cfg.Retention.DryRun, "expected dry run off by default")
+}
+
+func TestAppConfig_Parse_RequireProvenanceWithoutKeyring(t *testing.T) {
+
+	args := []string{
+		"--base-url=http://localhost:1323",
+		"--backend=s3",
+		"--require-provenance-repo=stable",
+	}
+
+	cfg := New()
+	err := cfg.Parse(args)
+
+	if assert.Error(t, err, "expected err") {
+		assert.Contains(t, err.Error(), "--provenance-keyring")
+	}
+}
+
+func TestAppConfig_ProvenanceRequired(t *testing.T) {
+
+	cfg := New()
+	cfg.RequireProvenanceForRepo = []string{"stable"}
+
+	assert.True(t, cfg.ProvenanceRequired("stable"), "expected required for stable")
+	assert.False(t, cfg.ProvenanceRequired("incubator"), "expected not required for incubator")
+	assert.False(t, cfg.ProvenanceRequired(""), "expected not required for root")
+
+	cfg.RequireProvenance = true
+
+	assert.True(t, cfg.ProvenanceRequired("incubator"), "expected required everywhere")
+	assert.True(t, cfg.ProvenanceRequired(""), "expected required for root")
+}
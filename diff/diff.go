@@ -0,0 +1,426 @@
+package diff
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// lines of unchanged context around every hunk
+	contextLines = 3
+
+	// files differing by more lines than this are shown as replaced entirely, bounding the
+	// memory the diff takes
+	maxEditDistance = 2000
+)
+
+// FileStatus is how a file changed between two chart versions
+type FileStatus string
+
+// File statuses
+const (
+	FileAdded    FileStatus = "added"
+	FileRemoved  FileStatus = "removed"
+	FileModified FileStatus = "modified"
+)
+
+// FileChange is a file that differs between two chart versions
+type FileChange struct {
+	Path   string     `json:"path"`
+	Status FileStatus `json:"status"`
+}
+
+// KeyChange is a key whose value differs between two yaml documents. Nested keys are joined
+// with dots and list elements indexed, e.g. "image.tag" or "ports[0].name".
+type KeyChange struct {
+	Key  string      `json:"key"`
+	From interface{} `json:"from,omitempty"`
+	To   interface{} `json:"to,omitempty"`
+}
+
+// KeyDiff is the difference between the keys of two yaml documents
+type KeyDiff struct {
+	Added   []KeyChange `json:"added"`
+	Removed []KeyChange `json:"removed"`
+	Changed []KeyChange `json:"changed"`
+}
+
+// ChartDiff is the difference between two versions of a chart
+type ChartDiff struct {
+	Files   []FileChange `json:"files"`
+	Unified string       `json:"diff"`
+	Chart   *KeyDiff     `json:"chartYaml"`
+	Values  *KeyDiff     `json:"values"`
+}
+
+// Charts compares the files of two chart archives. The names label the two sides in the
+// unified diff, e.g. "nginx-1.2.0" and "nginx-1.3.0".
+func Charts(fromName string, toName string, from map[string][]byte, to map[string][]byte) (*ChartDiff, error) {
+
+	paths := []string{}
+	for p := range from {
+		paths = append(paths, p)
+	}
+	for p := range to {
+		if _, ok := from[p]; !ok {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+
+	d := &ChartDiff{Files: []FileChange{}}
+	unified := &bytes.Buffer{}
+	for _, p := range paths {
+		a, inFrom := from[p]
+		b, inTo := to[p]
+
+		fromLabel, toLabel := fromName+"/"+p, toName+"/"+p
+		switch {
+		case !inFrom:
+			d.Files = append(d.Files, FileChange{Path: p, Status: FileAdded})
+			fromLabel = "/dev/null"
+		case !inTo:
+			d.Files = append(d.Files, FileChange{Path: p, Status: FileRemoved})
+			toLabel = "/dev/null"
+		case !bytes.Equal(a, b):
+			d.Files = append(d.Files, FileChange{Path: p, Status: FileModified})
+		default:
+			continue
+		}
+
+		unified.WriteString(Unified(fromLabel, toLabel, a, b))
+	}
+	d.Unified = unified.String()
+
+	var err error
+	d.Chart, err = Keys(from["Chart.yaml"], to["Chart.yaml"])
+	if err != nil {
+		return nil, fmt.Errorf("failed comparing Chart.yaml: %s", err.Error())
+	}
+	d.Values, err = Keys(from["values.yaml"], to["values.yaml"])
+	if err != nil {
+		return nil, fmt.Errorf("failed comparing values.yaml: %s", err.Error())
+	}
+
+	return d, nil
+}
+
+// Unified returns a unified diff of two files, empty if they are equal
+func Unified(fromLabel string, toLabel string, from []byte, to []byte) string {
+
+	if bytes.Equal(from, to) {
+		return ""
+	}
+
+	out := &bytes.Buffer{}
+	if isBinary(from) || isBinary(to) {
+		fmt.Fprintf(out, "Binary files %s and %s differ\n", fromLabel, toLabel)
+		return out.String()
+	}
+
+	a, b := splitLines(from), splitLines(to)
+	fmt.Fprintf(out, "--- %s\n+++ %s\n", fromLabel, toLabel)
+	writeHunks(out, lineEdits(a, b), a, b)
+
+	return out.String()
+}
+
+// Keys compares the keys of two yaml documents, an empty document has no keys
+func Keys(from []byte, to []byte) (*KeyDiff, error) {
+
+	a, err := flattenYAML(from)
+	if err != nil {
+		return nil, err
+	}
+	b, err := flattenYAML(to)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []string{}
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	d := &KeyDiff{Added: []KeyChange{}, Removed: []KeyChange{}, Changed: []KeyChange{}}
+	for _, k := range keys {
+		va, inA := a[k]
+		vb, inB := b[k]
+		switch {
+		case !inA:
+			d.Added = append(d.Added, KeyChange{Key: k, To: vb})
+		case !inB:
+			d.Removed = append(d.Removed, KeyChange{Key: k, From: va})
+		case !reflect.DeepEqual(va, vb):
+			d.Changed = append(d.Changed, KeyChange{Key: k, From: va, To: vb})
+		}
+	}
+
+	return d, nil
+}
+
+func flattenYAML(data []byte) (map[string]interface{}, error) {
+
+	var doc interface{}
+	err := yaml.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := map[string]interface{}{}
+	if doc != nil {
+		flatten("", doc, keys)
+	}
+
+	return keys, nil
+}
+
+/*
+ * record the leaves of a yaml value by their key path, empty maps and
+ * lists are leaves too so setting a key to {} or [] shows up
+ */
+func flatten(prefix string, v interface{}, keys map[string]interface{}) {
+
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		if len(v) == 0 {
+			keys[prefix] = map[string]interface{}{}
+		}
+		for k, child := range v {
+			key := fmt.Sprint(k)
+			if prefix != "" {
+				key = prefix + "." + key
+			}
+			flatten(key, child, keys)
+		}
+	case []interface{}:
+		if len(v) == 0 {
+			keys[prefix] = []interface{}{}
+		}
+		for n, child := range v {
+			flatten(fmt.Sprintf("%s[%d]", prefix, n), child, keys)
+		}
+	default:
+		keys[prefix] = v
+	}
+}
+
+// files with a NUL byte in their first 8k are treated as binary, like git does
+func isBinary(data []byte) bool {
+	if len(data) > 8000 {
+		data = data[:8000]
+	}
+	return bytes.IndexByte(data, 0) >= 0
+}
+
+// split into lines, each keeping its newline
+func splitLines(data []byte) []string {
+	lines := strings.SplitAfter(string(data), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+type editKind int
+
+const (
+	editEqual editKind = iota
+	editDelete
+	editInsert
+)
+
+// an edit of a line, a and b are the line's position in either file
+type edit struct {
+	kind editKind
+	a    int
+	b    int
+}
+
+/*
+ * the shortest list of edits turning a into b, using Myers' algorithm.
+ * Files too far apart are replaced as a whole.
+ */
+func lineEdits(a []string, b []string) []edit {
+
+	n, m := len(a), len(b)
+
+	// v holds the furthest x reached on every diagonal k at v[o+k], trace
+	// its state before every step d, covering only the diagonals step d reads
+	o := n + m + 1
+	v := make([]int, 2*o+1)
+	trace := [][]int{}
+
+	found := false
+	for d := 0; d <= n+m && d <= maxEditDistance && !found; d++ {
+		snapshot := make([]int, 2*d+3)
+		copy(snapshot, v[o-d-1:o+d+2])
+		trace = append(trace, snapshot)
+
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[o+k-1] < v[o+k+1]) {
+				x = v[o+k+1]
+			} else {
+				x = v[o+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[o+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+
+	if !found {
+		edits := []edit{}
+		for x := range a {
+			edits = append(edits, edit{kind: editDelete, a: x, b: 0})
+		}
+		for y := range b {
+			edits = append(edits, edit{kind: editInsert, a: n, b: y})
+		}
+		return edits
+	}
+
+	// walk back from the end, collecting edits in reverse
+	edits := []edit{}
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		o := d + 1
+		k := x - y
+
+		var prevK int
+		if k == -d || (k != d && v[o+k-1] < v[o+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[o+prevK]
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			x--
+			y--
+			edits = append(edits, edit{kind: editEqual, a: x, b: y})
+		}
+		if d > 0 {
+			if x == prevX {
+				edits = append(edits, edit{kind: editInsert, a: x, b: y - 1})
+			} else {
+				edits = append(edits, edit{kind: editDelete, a: x - 1, b: y})
+			}
+		}
+		x, y = prevX, prevY
+	}
+
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+
+	return edits
+}
+
+/*
+ * write the changed edits as hunks with context, merging hunks whose
+ * context would overlap
+ */
+func writeHunks(out *bytes.Buffer, edits []edit, a []string, b []string) {
+
+	i := 0
+	for i < len(edits) {
+		for i < len(edits) && edits[i].kind == editEqual {
+			i++
+		}
+		if i == len(edits) {
+			return
+		}
+
+		start := i - contextLines
+		if start < 0 {
+			start = 0
+		}
+
+		end := i
+		for {
+			for end < len(edits) && edits[end].kind != editEqual {
+				end++
+			}
+			next := end
+			for next < len(edits) && edits[next].kind == editEqual {
+				next++
+			}
+			if next < len(edits) && next-end <= 2*contextLines {
+				end = next
+				continue
+			}
+			end += contextLines
+			if end > len(edits) {
+				end = len(edits)
+			}
+			break
+		}
+
+		writeHunk(out, edits[start:end], a, b)
+		i = end
+	}
+}
+
+func writeHunk(out *bytes.Buffer, hunk []edit, a []string, b []string) {
+
+	aCount, bCount := 0, 0
+	for _, e := range hunk {
+		if e.kind != editInsert {
+			aCount++
+		}
+		if e.kind != editDelete {
+			bCount++
+		}
+	}
+
+	// an empty side starts at the line before it, like diff does
+	aStart, bStart := hunk[0].a, hunk[0].b
+	if aCount > 0 {
+		aStart++
+	}
+	if bCount > 0 {
+		bStart++
+	}
+
+	fmt.Fprintf(out, "@@ -%d,%d +%d,%d @@\n", aStart, aCount, bStart, bCount)
+	for _, e := range hunk {
+		switch e.kind {
+		case editEqual:
+			writeLine(out, " ", a[e.a])
+		case editDelete:
+			writeLine(out, "-", a[e.a])
+		case editInsert:
+			writeLine(out, "+", b[e.b])
+		}
+	}
+}
+
+func writeLine(out *bytes.Buffer, prefix string, line string) {
+	out.WriteString(prefix)
+	out.WriteString(line)
+	if !strings.HasSuffix(line, "\n") {
+		out.WriteString("\n\\ No newline at end of file\n")
+	}
+}
@@ -0,0 +1,172 @@
+package diff
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnified(t *testing.T) {
+
+	out := Unified("a/values.yaml", "b/values.yaml",
+		[]byte("replicas: 1\nimage:\n  tag: 1.0\n"),
+		[]byte("replicas: 1\nimage:\n  tag: 1.1\n  pullPolicy: Always\n"))
+
+	assert.Equal(t, `--- a/values.yaml
++++ b/values.yaml
+@@ -1,3 +1,4 @@
+ replicas: 1
+ image:
+-  tag: 1.0
++  tag: 1.1
++  pullPolicy: Always
+`, out)
+}
+
+func TestUnified_Hunks(t *testing.T) {
+
+	from := []string{}
+	for n := 1; n <= 20; n++ {
+		from = append(from, fmt.Sprintf("line %d\n", n))
+	}
+	to := append([]string{}, from...)
+	to[1] = "changed 2\n"
+	to[17] = "changed 18\n"
+
+	out := Unified("a", "b", []byte(strings.Join(from, "")), []byte(strings.Join(to, "")))
+
+	assert.Equal(t, `--- a
++++ b
+@@ -1,5 +1,5 @@
+ line 1
+-line 2
++changed 2
+ line 3
+ line 4
+ line 5
+@@ -15,6 +15,6 @@
+ line 15
+ line 16
+ line 17
+-line 18
++changed 18
+ line 19
+ line 20
+`, out)
+}
+
+func TestUnified_AddedFile(t *testing.T) {
+
+	out := Unified("/dev/null", "b/NOTES.txt", nil, []byte("installed"))
+
+	assert.Equal(t, `--- /dev/null
++++ b/NOTES.txt
+@@ -0,0 +1,1 @@
++installed
+\ No newline at end of file
+`, out)
+}
+
+func TestUnified_Binary(t *testing.T) {
+
+	out := Unified("a/icon.png", "b/icon.png", []byte{0, 1}, []byte{0, 2})
+
+	assert.Equal(t, "Binary files a/icon.png and b/icon.png differ\n", out)
+}
+
+func TestUnified_Equal(t *testing.T) {
+
+	assert.Equal(t, "", Unified("a", "b", []byte("same\n"), []byte("same\n")))
+}
+
+func TestLineEdits_Rebuild(t *testing.T) {
+
+	r := rand.New(rand.NewSource(1))
+	words := []string{"a\n", "b\n", "c\n", "d\n"}
+	random := func() []string {
+		lines := []string{}
+		for n := r.Intn(30); n > 0; n-- {
+			lines = append(lines, words[r.Intn(len(words))])
+		}
+		return lines
+	}
+
+	for n := 0; n < 200; n++ {
+		a, b := random(), random()
+
+		rebuiltA, rebuiltB := []string{}, []string{}
+		for _, e := range lineEdits(a, b) {
+			if e.kind != editInsert {
+				rebuiltA = append(rebuiltA, a[e.a])
+			}
+			if e.kind != editDelete {
+				rebuiltB = append(rebuiltB, b[e.b])
+			}
+		}
+
+		assert.Equal(t, a, rebuiltA, "expected edits to rebuild a")
+		assert.Equal(t, b, rebuiltB, "expected edits to rebuild b")
+	}
+}
+
+func TestKeys(t *testing.T) {
+
+	d, err := Keys(
+		[]byte("replicas: 1\nimage:\n  tag: \"1.0\"\n  repository: nginx\nports:\n- 80\nresources: {}\n"),
+		[]byte("replicas: 1\nimage:\n  tag: \"1.1\"\nports:\n- 80\n- 443\nresources:\n  limits:\n    cpu: 100m\n"))
+
+	assert.Nil(t, err, "expected nil err")
+	assert.Equal(t, []KeyChange{
+		{Key: "ports[1]", To: 443},
+		{Key: "resources.limits.cpu", To: "100m"},
+	}, d.Added)
+	assert.Equal(t, []KeyChange{
+		{Key: "image.repository", From: "nginx"},
+		{Key: "resources", From: map[string]interface{}{}},
+	}, d.Removed)
+	assert.Equal(t, []KeyChange{
+		{Key: "image.tag", From: "1.0", To: "1.1"},
+	}, d.Changed)
+}
+
+func TestKeys_Invalid(t *testing.T) {
+
+	_, err := Keys([]byte("a: ["), nil)
+
+	assert.Error(t, err, "expected parse error")
+}
+
+func TestCharts(t *testing.T) {
+
+	from := map[string][]byte{
+		"Chart.yaml":                []byte("name: nginx\nversion: 1.2.0\n"),
+		"values.yaml":               []byte("replicas: 1\n"),
+		"templates/deployment.yaml": []byte("kind: Deployment\n"),
+		"templates/old.yaml":        []byte("kind: Service\n"),
+	}
+	to := map[string][]byte{
+		"Chart.yaml":                []byte("name: nginx\nversion: 1.3.0\n"),
+		"values.yaml":               []byte("replicas: 1\n"),
+		"templates/deployment.yaml": []byte("kind: Deployment\n"),
+		"templates/new.yaml":        []byte("kind: Ingress\n"),
+	}
+
+	// run
+	d, err := Charts("nginx-1.2.0", "nginx-1.3.0", from, to)
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+	assert.Equal(t, []FileChange{
+		{Path: "Chart.yaml", Status: FileModified},
+		{Path: "templates/new.yaml", Status: FileAdded},
+		{Path: "templates/old.yaml", Status: FileRemoved},
+	}, d.Files)
+	assert.Contains(t, d.Unified, "--- nginx-1.2.0/Chart.yaml\n+++ nginx-1.3.0/Chart.yaml\n")
+	assert.Contains(t, d.Unified, "--- /dev/null\n+++ nginx-1.3.0/templates/new.yaml\n")
+	assert.Contains(t, d.Unified, "--- nginx-1.2.0/templates/old.yaml\n+++ /dev/null\n")
+	assert.Equal(t, []KeyChange{{Key: "version", From: "1.2.0", To: "1.3.0"}}, d.Chart.Changed)
+	assert.Empty(t, d.Values.Changed)
+}
@@ -0,0 +1,129 @@
+package lock
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+/*
+ * dynamoDBStore keeps one item per lock in a table whose hash key is the
+ * string attribute "name", using conditional writes to take and hold locks
+ */
+type dynamoDBStore struct {
+	svc   dynamodbiface.DynamoDBAPI
+	table string
+}
+
+// NewDynamoDBLocker creates a Locker keeping its locks in a DynamoDB table
+func NewDynamoDBLocker(table string, region string, opts Options) (Locker, error) {
+
+	// validate config
+	if table == "" {
+		return nil, errors.New("lock config - dynamodb table missing")
+	}
+
+	awsSession, err := session.NewSession(&aws.Config{Region: aws.String(region)})
+	if err != nil {
+		return nil, err
+	}
+
+	return newLocker(newDynamoDBStore(dynamodb.New(awsSession), table), opts), nil
+}
+
+func newDynamoDBStore(svc dynamodbiface.DynamoDBAPI, table string) *dynamoDBStore {
+	return &dynamoDBStore{svc: svc, table: table}
+}
+
+func (s *dynamoDBStore) tryAcquire(name string, owner string, expires time.Time) (bool, error) {
+
+	_, err := s.svc.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item: map[string]*dynamodb.AttributeValue{
+			"name":    {S: aws.String(name)},
+			"owner":   {S: aws.String(owner)},
+			"expires": {N: aws.String(unixMillis(expires))},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(#name) OR #expires < :now OR #owner = :owner"),
+		ExpressionAttributeNames: map[string]*string{
+			"#name":    aws.String("name"),
+			"#owner":   aws.String("owner"),
+			"#expires": aws.String("expires"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":now":   {N: aws.String(unixMillis(time.Now()))},
+			":owner": {S: aws.String(owner)},
+		},
+	})
+	if isConditionFailed(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (s *dynamoDBStore) renew(name string, owner string, expires time.Time) error {
+
+	_, err := s.svc.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]*dynamodb.AttributeValue{
+			"name": {S: aws.String(name)},
+		},
+		UpdateExpression:    aws.String("SET #expires = :expires"),
+		ConditionExpression: aws.String("#owner = :owner"),
+		ExpressionAttributeNames: map[string]*string{
+			"#owner":   aws.String("owner"),
+			"#expires": aws.String("expires"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":expires": {N: aws.String(unixMillis(expires))},
+			":owner":   {S: aws.String(owner)},
+		},
+	})
+	if isConditionFailed(err) {
+		return ErrLockLost
+	}
+
+	return err
+}
+
+func (s *dynamoDBStore) release(name string, owner string) error {
+
+	_, err := s.svc.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]*dynamodb.AttributeValue{
+			"name": {S: aws.String(name)},
+		},
+		ConditionExpression: aws.String("#owner = :owner"),
+		ExpressionAttributeNames: map[string]*string{
+			"#owner": aws.String("owner"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":owner": {S: aws.String(owner)},
+		},
+	})
+	if isConditionFailed(err) {
+		// expired and taken over, nothing left to release
+		return nil
+	}
+
+	return err
+}
+
+func isConditionFailed(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	return ok && awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
+
+func unixMillis(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+}
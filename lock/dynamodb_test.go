@@ -0,0 +1,154 @@
+package lock
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewDynamoDBLocker_MissingTable(t *testing.T) {
+
+	_, err := NewDynamoDBLocker("", "us-east-1", testOptions())
+
+	if assert.Error(t, err, "expected error") {
+		assert.Contains(t, err.Error(), "dynamodb table missing")
+	}
+}
+
+func TestDynamoDBLocker_ConcurrentReplicas(t *testing.T) {
+
+	table := newDynamoDBFake()
+
+	replicas := []Locker{}
+	for n := 0; n < 3; n++ {
+		replicas = append(replicas, newLocker(newDynamoDBStore(table, "hrp-locks"), testOptions()))
+	}
+
+	testMutualExclusion(t, replicas)
+}
+
+func TestDynamoDBLocker_Renewal(t *testing.T) {
+
+	table := newDynamoDBFake()
+
+	opts := testOptions()
+	opts.Timeout = 200 * time.Millisecond
+
+	testRenewal(t,
+		newLocker(newDynamoDBStore(table, "hrp-locks"), testOptions()),
+		newLocker(newDynamoDBStore(table, "hrp-locks"), opts))
+}
+
+func TestDynamoDBLocker_ExpiredLease(t *testing.T) {
+
+	table := newDynamoDBFake()
+	table.items["index"] = dynamoDBFakeItem{owner: "crashed", expires: time.Now().Add(-time.Second)}
+
+	locker := newLocker(newDynamoDBStore(table, "hrp-locks"), testOptions())
+
+	// run
+	lease, err := locker.Acquire("index")
+
+	// check
+	assert.Nil(t, err, "expected expired lock taken over")
+	assert.Equal(t, lease.owner, table.items["index"].owner)
+
+	lease.Release()
+	assert.NotContains(t, table.items, "index", "expected lock item deleted")
+}
+
+func TestDynamoDBLocker_RenewLost(t *testing.T) {
+
+	table := newDynamoDBFake()
+	table.items["index"] = dynamoDBFakeItem{owner: "other", expires: time.Now().Add(time.Minute)}
+
+	store := newDynamoDBStore(table, "hrp-locks")
+
+	// run
+	err := store.renew("index", "me", time.Now().Add(time.Minute))
+
+	// check
+	assert.Equal(t, ErrLockLost, err)
+}
+
+// dynamoDBFake is an in memory lock table evaluating the conditions the store uses
+type dynamoDBFake struct {
+	dynamodbiface.DynamoDBAPI
+
+	lock  sync.Mutex
+	items map[string]dynamoDBFakeItem
+}
+
+type dynamoDBFakeItem struct {
+	owner   string
+	expires time.Time
+}
+
+func newDynamoDBFake() *dynamoDBFake {
+	return &dynamoDBFake{items: map[string]dynamoDBFakeItem{}}
+}
+
+func (f *dynamoDBFake) PutItem(i *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	name := aws.StringValue(i.Item["name"].S)
+	now := fakeMillis(i.ExpressionAttributeValues[":now"])
+	owner := aws.StringValue(i.ExpressionAttributeValues[":owner"].S)
+
+	item, exists := f.items[name]
+	if exists && !item.expires.Before(now) && item.owner != owner {
+		return nil, fakeConditionFailed()
+	}
+
+	f.items[name] = dynamoDBFakeItem{
+		owner:   aws.StringValue(i.Item["owner"].S),
+		expires: fakeMillis(i.Item["expires"]),
+	}
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (f *dynamoDBFake) UpdateItem(i *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	name := aws.StringValue(i.Key["name"].S)
+	item, exists := f.items[name]
+	if !exists || item.owner != aws.StringValue(i.ExpressionAttributeValues[":owner"].S) {
+		return nil, fakeConditionFailed()
+	}
+
+	item.expires = fakeMillis(i.ExpressionAttributeValues[":expires"])
+	f.items[name] = item
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func (f *dynamoDBFake) DeleteItem(i *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	name := aws.StringValue(i.Key["name"].S)
+	item, exists := f.items[name]
+	if !exists || item.owner != aws.StringValue(i.ExpressionAttributeValues[":owner"].S) {
+		return nil, fakeConditionFailed()
+	}
+
+	delete(f.items, name)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+func fakeMillis(v *dynamodb.AttributeValue) time.Time {
+	ms, _ := strconv.ParseInt(aws.StringValue(v.N), 10, 64)
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+func fakeConditionFailed() error {
+	return awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "the conditional request failed", nil)
+}
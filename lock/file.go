@@ -0,0 +1,199 @@
+package lock
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * fileStore keeps one file per lock in a directory shared by the replicas,
+ * e.g. an nfs mount. Locks are taken by exclusively creating the file, and
+ * expired locks are moved aside first so only one replica can take them over.
+ */
+type fileStore struct {
+	dir string
+}
+
+type fileRecord struct {
+	owner   string
+	expires int64
+}
+
+// NewFileLocker creates a Locker keeping its locks as files in a shared directory
+func NewFileLocker(dir string, opts Options) (Locker, error) {
+
+	// validate config
+	if dir == "" {
+		return nil, errors.New("lock config - lock directory missing")
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	return newLocker(&fileStore{dir: dir}, opts), nil
+}
+
+func (s *fileStore) tryAcquire(name string, owner string, expires time.Time) (bool, error) {
+
+	p := s.path(name)
+
+	// one retry, for when the lock is released or moved aside while we look at it
+	for attempt := 0; attempt < 2; attempt++ {
+		f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = f.WriteString(formatRecord(owner, expires))
+			f.Close()
+			return err == nil, err
+		}
+		if !os.IsExist(err) {
+			return false, err
+		}
+
+		held, err := readRecord(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if held.owner == owner {
+			return true, s.renew(name, owner, expires)
+		}
+		if held.expires > time.Now().UnixNano() {
+			return false, nil
+		}
+
+		// expired, move it aside so only one replica takes it over
+		stale := p + "." + owner
+		err = os.Rename(p, stale)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+
+		moved, err := readRecord(stale)
+		if err == nil && *moved != *held {
+			// someone took the lock over between reading and moving it, put it back
+			os.Link(stale, p)
+			os.Remove(stale)
+			return false, nil
+		}
+		os.Remove(stale)
+	}
+
+	return false, nil
+}
+
+/*
+ * the record is rewritten in place through the handle it was read from. A
+ * lock moved aside and taken over meanwhile is a different file, so only
+ * our own record is ever written, and the lock is lost if the file at the
+ * lock's path isn't ours anymore afterwards.
+ */
+func (s *fileStore) renew(name string, owner string, expires time.Time) error {
+
+	p := s.path(name)
+
+	f, err := os.OpenFile(p, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return ErrLockLost
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	held, err := parseRecord(p, data)
+	if err != nil {
+		return err
+	}
+	if held.owner != owner {
+		return ErrLockLost
+	}
+
+	// records of one owner have the same length, so this is a single write of the whole record
+	record := []byte(formatRecord(owner, expires))
+	_, err = f.WriteAt(record, 0)
+	if err == nil {
+		err = f.Truncate(int64(len(record)))
+	}
+	if err != nil {
+		return err
+	}
+
+	renewed, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	current, err := os.Stat(p)
+	if os.IsNotExist(err) || (err == nil && !os.SameFile(renewed, current)) {
+		return ErrLockLost
+	}
+
+	return err
+}
+
+func (s *fileStore) release(name string, owner string) error {
+
+	p := s.path(name)
+
+	held, err := readRecord(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if held.owner != owner {
+		// expired and taken over, nothing left to release
+		return nil
+	}
+
+	return os.Remove(p)
+}
+
+func (s *fileStore) path(name string) string {
+	return filepath.Join(s.dir, url.PathEscape(name)+".lock")
+}
+
+func formatRecord(owner string, expires time.Time) string {
+	return fmt.Sprintf("%s %d\n", owner, expires.UnixNano())
+}
+
+func readRecord(p string) (*fileRecord, error) {
+
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseRecord(p, data)
+}
+
+func parseRecord(p string, data []byte) (*fileRecord, error) {
+
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("invalid lock file %s", p)
+	}
+	expires, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid lock file %s", p)
+	}
+
+	return &fileRecord{owner: fields[0], expires: expires}, nil
+}
@@ -0,0 +1,169 @@
+package lock
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewFileLocker_MissingDir(t *testing.T) {
+
+	_, err := NewFileLocker("", testOptions())
+
+	if assert.Error(t, err, "expected error") {
+		assert.Contains(t, err.Error(), "lock directory missing")
+	}
+}
+
+func TestFileLocker_ConcurrentReplicas(t *testing.T) {
+
+	dir := testLockDir(t)
+	defer os.RemoveAll(dir)
+
+	replicas := []Locker{}
+	for n := 0; n < 3; n++ {
+		locker, _ := NewFileLocker(dir, testOptions())
+		replicas = append(replicas, locker)
+	}
+
+	testMutualExclusion(t, replicas)
+}
+
+func TestFileLocker_Renewal(t *testing.T) {
+
+	dir := testLockDir(t)
+	defer os.RemoveAll(dir)
+
+	holder, _ := NewFileLocker(dir, testOptions())
+
+	opts := testOptions()
+	opts.Timeout = 200 * time.Millisecond
+	other, _ := NewFileLocker(dir, opts)
+
+	testRenewal(t, holder, other)
+}
+
+func TestFileLocker_ExpiredLease(t *testing.T) {
+
+	dir := testLockDir(t)
+	defer os.RemoveAll(dir)
+
+	// a replica crashed holding the lock
+	ioutil.WriteFile(
+		filepath.Join(dir, "index.lock"),
+		[]byte(formatRecord("crashed", time.Now().Add(-time.Second))),
+		0644)
+
+	locker, _ := NewFileLocker(dir, testOptions())
+
+	// run
+	lease, err := locker.Acquire("index")
+
+	// check
+	assert.Nil(t, err, "expected expired lock taken over")
+	record, _ := readRecord(filepath.Join(dir, "index.lock"))
+	assert.Equal(t, lease.owner, record.owner)
+
+	lease.Release()
+	_, err = os.Stat(filepath.Join(dir, "index.lock"))
+	assert.True(t, os.IsNotExist(err), "expected lock file removed")
+}
+
+func TestFileLocker_Timeout(t *testing.T) {
+
+	dir := testLockDir(t)
+	defer os.RemoveAll(dir)
+
+	opts := testOptions()
+	opts.Timeout = 50 * time.Millisecond
+	locker, _ := NewFileLocker(dir, opts)
+
+	lease, _ := locker.Acquire("index")
+	defer lease.Release()
+
+	// run
+	_, err := locker.Acquire("index")
+
+	// check
+	assert.Equal(t, ErrTimeout, err)
+}
+
+func TestFileLocker_ReleaseTakenOver(t *testing.T) {
+
+	dir := testLockDir(t)
+	defer os.RemoveAll(dir)
+
+	locker, _ := NewFileLocker(dir, testOptions())
+	lease, _ := locker.Acquire("index/bucket/charts")
+
+	// the lease expired and another replica took the lock over
+	p := filepath.Join(dir, "index%2Fbucket%2Fcharts.lock")
+	ioutil.WriteFile(p, []byte(formatRecord("other", time.Now().Add(time.Minute))), 0644)
+
+	// run
+	err := lease.Release()
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+	record, _ := readRecord(p)
+	assert.Equal(t, "other", record.owner, "expected other replica's lock kept")
+}
+
+func TestFileLocker_RenewTakenOver(t *testing.T) {
+
+	dir := testLockDir(t)
+	defer os.RemoveAll(dir)
+
+	store := &fileStore{dir: dir}
+	store.tryAcquire("index", "me", time.Now().Add(time.Minute))
+
+	// our lease expired, another replica moved it aside and took the lock over
+	p := filepath.Join(dir, "index.lock")
+	os.Rename(p, p+".other")
+	ioutil.WriteFile(p, []byte(formatRecord("other", time.Now().Add(time.Minute))), 0644)
+
+	// run
+	err := store.renew("index", "me", time.Now().Add(time.Minute))
+
+	// check
+	assert.Equal(t, ErrLockLost, err)
+	record, _ := readRecord(p)
+	assert.Equal(t, "other", record.owner, "expected other replica's lock kept")
+}
+
+func TestFileLocker_LeaseLost(t *testing.T) {
+
+	dir := testLockDir(t)
+	defer os.RemoveAll(dir)
+
+	locker, _ := NewFileLocker(dir, testOptions())
+	lease, _ := locker.Acquire("index")
+	defer lease.Release()
+	assert.Nil(t, lease.Err(), "expected lock held")
+
+	// another replica took the lock over
+	ioutil.WriteFile(
+		filepath.Join(dir, "index.lock"),
+		[]byte(formatRecord("other", time.Now().Add(time.Minute))),
+		0644)
+
+	// run
+	select {
+	case <-lease.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected lease lost")
+	}
+
+	// check
+	assert.Equal(t, ErrLockLost, lease.Err())
+}
+
+func testLockDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "hrp-lock")
+	assert.Nil(t, err, "expected temp dir")
+	return dir
+}
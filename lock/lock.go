@@ -0,0 +1,216 @@
+package lock
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zlangbert/hrp/config"
+)
+
+var (
+	// ErrTimeout is returned when a lock couldn't be acquired in time
+	ErrTimeout = errors.New("timed out acquiring lock")
+
+	// ErrLockLost is returned when renewing a lock that has been taken over by someone else
+	ErrLockLost = errors.New("lock lost")
+)
+
+// A Locker hands out named locks shared by every hrp replica using the same lock store
+type Locker interface {
+	// Acquire blocks until it holds the named lock
+	Acquire(name string) (*Lease, error)
+}
+
+// Options tune how locks are held and waited for
+type Options struct {
+	// how long a lock is held without renewal, so a crashed replica's locks expire
+	TTL time.Duration
+	// how long Acquire waits for a lock held by someone else
+	Timeout time.Duration
+	// how often Acquire checks whether the lock was released
+	RetryInterval time.Duration
+}
+
+// New builds the Locker selected in the config, nil if distributed locking is disabled
+func New(cfg *config.AppConfig) (Locker, error) {
+
+	opts := Options{
+		TTL:           cfg.Lock.TTL,
+		Timeout:       cfg.Lock.Timeout,
+		RetryInterval: 500 * time.Millisecond,
+	}
+
+	switch cfg.Lock.Type {
+	case "", "none":
+		return nil, nil
+	case "dynamodb":
+		return NewDynamoDBLocker(cfg.Lock.DynamoDBTable, cfg.S3.Region, opts)
+	case "file":
+		return NewFileLocker(cfg.Lock.Dir, opts)
+	default:
+		return nil, fmt.Errorf("unrecognized lock type: %s", cfg.Lock.Type)
+	}
+}
+
+/*
+ * a store persists lock records. Every operation is conditional, so only one
+ * owner holds a lock until it releases it or its lease expires.
+ */
+type store interface {
+	// take the lock if it is free, expired or already ours
+	tryAcquire(name string, owner string, expires time.Time) (bool, error)
+	// extend our lease, failing if we lost the lock
+	renew(name string, owner string, expires time.Time) error
+	// drop the lock if it is still ours
+	release(name string, owner string) error
+}
+
+type locker struct {
+	store store
+	opts  Options
+}
+
+func newLocker(s store, opts Options) *locker {
+	return &locker{store: s, opts: opts}
+}
+
+func (l *locker) Acquire(name string) (*Lease, error) {
+
+	owner := newOwner()
+	deadline := time.Now().Add(l.opts.Timeout)
+
+	for {
+		ok, err := l.store.tryAcquire(name, owner, time.Now().Add(l.opts.TTL))
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return newLease(l, name, owner), nil
+		}
+
+		if time.Now().After(deadline) {
+			return nil, ErrTimeout
+		}
+		time.Sleep(l.opts.RetryInterval)
+	}
+}
+
+// Lease is a held lock. It is renewed in the background until released. Holders have to check
+// Err before acting on the lock, it can be lost to another replica when renewals fail.
+type Lease struct {
+	locker *locker
+	name   string
+	owner  string
+
+	// when the lease runs out unless renewed
+	lock    *sync.Mutex
+	expires time.Time
+
+	once    *sync.Once
+	stop    chan struct{}
+	stopped chan struct{}
+	lost    chan struct{}
+}
+
+func newLease(l *locker, name string, owner string) *Lease {
+
+	lease := &Lease{
+		locker: l,
+		name:   name,
+		owner:  owner,
+
+		lock:    &sync.Mutex{},
+		expires: time.Now().Add(l.opts.TTL),
+
+		once:    &sync.Once{},
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		lost:    make(chan struct{}),
+	}
+	go lease.keepAlive()
+
+	return lease
+}
+
+// Done returns a channel that is closed when the lock is lost, either taken over by another
+// replica or expired because it couldn't be renewed
+func (l *Lease) Done() <-chan struct{} {
+	return l.lost
+}
+
+// Err returns ErrLockLost once the lock is lost, nil while it is held
+func (l *Lease) Err() error {
+
+	select {
+	case <-l.lost:
+		return ErrLockLost
+	default:
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if !time.Now().Before(l.expires) {
+		return ErrLockLost
+	}
+
+	return nil
+}
+
+// Release releases the lock
+func (l *Lease) Release() error {
+
+	var err error
+	l.once.Do(func() {
+		close(l.stop)
+		<-l.stopped
+		err = l.locker.store.release(l.name, l.owner)
+	})
+
+	return err
+}
+
+/*
+ * renew the lease until released. Once the lock was taken over, or the
+ * lease ran out while renewals failed, it is lost for good.
+ */
+func (l *Lease) keepAlive() {
+
+	defer close(l.stopped)
+
+	ticker := time.NewTicker(l.locker.opts.TTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			expires := time.Now().Add(l.locker.opts.TTL)
+			err := l.locker.store.renew(l.name, l.owner, expires)
+			if err == nil {
+				l.lock.Lock()
+				l.expires = expires
+				l.lock.Unlock()
+				continue
+			}
+
+			log.Errorf("failed renewing lock %s: %s", l.name, err.Error())
+			if err == ErrLockLost || l.Err() != nil {
+				close(l.lost)
+				return
+			}
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+func newOwner() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
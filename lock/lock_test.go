@@ -0,0 +1,103 @@
+package lock
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zlangbert/hrp/config"
+)
+
+func TestNew_None(t *testing.T) {
+
+	cfg := config.New()
+	cfg.Lock.Type = "none"
+
+	locker, err := New(cfg)
+
+	assert.Nil(t, err, "expected nil err")
+	assert.Nil(t, locker, "expected no locker")
+}
+
+func TestNew_Unknown(t *testing.T) {
+
+	cfg := config.New()
+	cfg.Lock.Type = "zookeeper"
+
+	_, err := New(cfg)
+
+	assert.Error(t, err, "expected unknown lock type error")
+}
+
+//
+// helpers
+//
+
+func testOptions() Options {
+	return Options{
+		TTL:           time.Second,
+		Timeout:       5 * time.Second,
+		RetryInterval: time.Millisecond,
+	}
+}
+
+/*
+ * run workers on every replica's locker at once, failing if two of them
+ * ever hold the lock at the same time
+ */
+func testMutualExclusion(t *testing.T, replicas []Locker) {
+
+	var holders int32
+	var overlaps int32
+	var acquired int32
+
+	wg := &sync.WaitGroup{}
+	for _, locker := range replicas {
+		for n := 0; n < 5; n++ {
+			wg.Add(1)
+			go func(locker Locker) {
+				defer wg.Done()
+
+				lease, err := locker.Acquire("index")
+				if !assert.Nil(t, err, "expected lock acquired") {
+					return
+				}
+				atomic.AddInt32(&acquired, 1)
+
+				if atomic.AddInt32(&holders, 1) > 1 {
+					atomic.AddInt32(&overlaps, 1)
+				}
+				time.Sleep(2 * time.Millisecond)
+				atomic.AddInt32(&holders, -1)
+
+				assert.Nil(t, lease.Release(), "expected lock released")
+			}(locker)
+		}
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(5*len(replicas)), acquired, "expected every worker to get the lock")
+	assert.Equal(t, int32(0), overlaps, "expected the lock held by one worker at a time")
+}
+
+/*
+ * a lease held past its ttl stays held as long as it is renewed
+ */
+func testRenewal(t *testing.T, holder Locker, other Locker) {
+
+	lease, err := holder.Acquire("index")
+	assert.Nil(t, err, "expected lock acquired")
+
+	time.Sleep(1500 * time.Millisecond)
+
+	_, err = other.Acquire("index")
+	assert.Equal(t, ErrTimeout, err, "expected renewed lock still held")
+
+	lease.Release()
+
+	lease, err = other.Acquire("index")
+	assert.Nil(t, err, "expected released lock acquired")
+	lease.Release()
+}
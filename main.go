@@ -24,6 +24,13 @@ func main() {
 		log.Fatal("failed to build backend")
 	}
 
+	// build named repositories
+	repos, err := backend.NewRepositories(cfg, true)
+	if err != nil {
+		log.Error(err.Error())
+		log.Fatal("failed to build repositories")
+	}
+
 	// start web server
-	web.Start(cfg, b)
+	web.Start(cfg, b, repos)
 }
@@ -0,0 +1,218 @@
+package retention
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver"
+	log "github.com/sirupsen/logrus"
+	"github.com/zlangbert/hrp/backend"
+	"github.com/zlangbert/hrp/util"
+)
+
+// Rule decides which versions of the charts matching its pattern are kept. A version is kept
+// if it is one of the newest KeepLast versions, is younger than KeepDays, or is a release and
+// KeepReleases is set. Everything else is deleted.
+type Rule struct {
+	Pattern      string
+	KeepLast     int
+	KeepDays     int
+	KeepReleases bool
+}
+
+// ParseRule parses a rule in the form <pattern>:keep-last=10,keep-days=30,keep-releases
+func ParseRule(s string) (*Rule, error) {
+
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return nil, fmt.Errorf("invalid retention rule %q: expected <pattern>:<options>", s)
+	}
+
+	rule := &Rule{Pattern: parts[0]}
+	_, err := path.Match(rule.Pattern, "")
+	if err != nil {
+		return nil, fmt.Errorf("invalid retention rule %q: bad chart pattern", s)
+	}
+
+	for _, option := range strings.Split(parts[1], ",") {
+		kv := strings.SplitN(strings.TrimSpace(option), "=", 2)
+		switch kv[0] {
+		case "keep-last":
+			rule.KeepLast, err = parsePositive(kv)
+		case "keep-days":
+			rule.KeepDays, err = parsePositive(kv)
+		case "keep-releases":
+			rule.KeepReleases = true
+		default:
+			err = fmt.Errorf("unknown option %q", kv[0])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid retention rule %q: %s", s, err.Error())
+		}
+	}
+
+	if rule.KeepLast == 0 && rule.KeepDays == 0 {
+		return nil, fmt.Errorf("invalid retention rule %q: keep-last or keep-days required", s)
+	}
+
+	return rule, nil
+}
+
+func parsePositive(kv []string) (int, error) {
+
+	if len(kv) != 2 {
+		return 0, fmt.Errorf("%s needs a value", kv[0])
+	}
+	n, err := strconv.Atoi(kv[1])
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("%s must be a positive number", kv[0])
+	}
+
+	return n, nil
+}
+
+func (r *Rule) matches(chart string) bool {
+	ok, _ := path.Match(r.Pattern, chart)
+	return ok
+}
+
+/*
+ * decide which of a chart's versions the rule deletes, versions must be
+ * sorted newest first
+ */
+func (r *Rule) prune(versions []*util.ChartVersion, now time.Time) []*util.ChartVersion {
+
+	pruned := []*util.ChartVersion{}
+	for n, cv := range versions {
+		if r.KeepLast > 0 && n < r.KeepLast {
+			continue
+		}
+		if r.KeepDays > 0 && now.Sub(cv.Created) < time.Duration(r.KeepDays)*24*time.Hour {
+			continue
+		}
+		if r.KeepReleases && !isPrerelease(cv.Version) {
+			continue
+		}
+		pruned = append(pruned, cv)
+	}
+
+	return pruned
+}
+
+// versions that aren't valid semver are treated as releases, so they're never pruned by accident
+func isPrerelease(version string) bool {
+	v, err := semver.NewVersion(version)
+	return err == nil && v.Prerelease() != ""
+}
+
+// Deletion is a chart version removed, or to be removed, by retention
+type Deletion struct {
+	Chart    string    `json:"chart"`
+	Version  string    `json:"version"`
+	Filename string    `json:"filename"`
+	Created  time.Time `json:"created"`
+	Rule     string    `json:"rule"`
+}
+
+// Report is the outcome of applying retention to a repository
+type Report struct {
+	DryRun  bool        `json:"dryRun"`
+	Kept    int         `json:"kept"`
+	Deleted []*Deletion `json:"deleted"`
+}
+
+// Policy is an ordered list of retention rules, the first rule matching a chart applies to it
+type Policy struct {
+	Rules []*Rule
+}
+
+// NewPolicy parses the rules of a policy
+func NewPolicy(rules []string) (*Policy, error) {
+
+	policy := &Policy{}
+	for _, s := range rules {
+		rule, err := ParseRule(s)
+		if err != nil {
+			return nil, err
+		}
+		policy.Rules = append(policy.Rules, rule)
+	}
+
+	return policy, nil
+}
+
+// Plan reports the chart versions of an index the policy deletes
+func (p *Policy) Plan(index *util.IndexFile, now time.Time) *Report {
+
+	index.SortEntries()
+
+	report := &Report{Deleted: []*Deletion{}}
+	for name, versions := range index.Entries {
+		rule := p.ruleFor(name)
+		if rule == nil {
+			report.Kept += len(versions)
+			continue
+		}
+
+		pruned := rule.prune(versions, now)
+		report.Kept += len(versions) - len(pruned)
+		for _, cv := range pruned {
+			report.Deleted = append(report.Deleted, &Deletion{
+				Chart:    cv.Name,
+				Version:  cv.Version,
+				Filename: cv.Filename(),
+				Created:  cv.Created,
+				Rule:     rule.Pattern,
+			})
+		}
+	}
+
+	return report
+}
+
+// Apply deletes the chart versions the policy doesn't keep from the backend, which reindexes
+// once when done. With dryRun the backend is left untouched.
+func (p *Policy) Apply(b backend.Backend, dryRun bool) (*Report, error) {
+
+	data, err := b.GetIndex()
+	if err != nil {
+		return nil, err
+	}
+	index, err := util.ParseIndex(data)
+	if err != nil {
+		return nil, err
+	}
+
+	report := p.Plan(index, time.Now())
+	report.DryRun = dryRun
+
+	if dryRun || len(report.Deleted) == 0 {
+		return report, nil
+	}
+
+	filenames := []string{}
+	for _, deletion := range report.Deleted {
+		filenames = append(filenames, deletion.Filename)
+	}
+
+	log.Infof("retention deleting %d chart versions", len(filenames))
+
+	err = b.DeleteCharts(filenames...)
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+func (p *Policy) ruleFor(chart string) *Rule {
+	for _, rule := range p.Rules {
+		if rule.matches(chart) {
+			return rule
+		}
+	}
+	return nil
+}
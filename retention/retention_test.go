@@ -0,0 +1,213 @@
+package retention
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zlangbert/hrp/util"
+)
+
+var now = time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC)
+
+func TestParseRule(t *testing.T) {
+
+	rule, err := ParseRule("*-snapshot:keep-last=10, keep-days=30,keep-releases")
+
+	assert.Nil(t, err, "expected nil err")
+	assert.Equal(t, &Rule{
+		Pattern:      "*-snapshot",
+		KeepLast:     10,
+		KeepDays:     30,
+		KeepReleases: true,
+	}, rule)
+}
+
+func TestParseRule_Invalid(t *testing.T) {
+
+	for _, s := range []string{
+		"keep-last=10",
+		":keep-last=10",
+		"a:keep-last=0",
+		"a:keep-last",
+		"a:keep-days=x",
+		"a:keep-forever",
+		"a:keep-releases",
+		"[:keep-last=1",
+	} {
+		_, err := ParseRule(s)
+		assert.Error(t, err, "expected error for %q", s)
+	}
+}
+
+func TestPolicy_Plan_KeepLast(t *testing.T) {
+
+	policy, _ := NewPolicy([]string{"a:keep-last=2"})
+	index := testIndex(map[string]int{"1.0.0": 30, "1.1.0": 20, "1.2.0": 10, "1.3.0": 0})
+
+	// run
+	report := policy.Plan(index, now)
+
+	// check
+	assert.Equal(t, 2, report.Kept)
+	assert.Equal(t, []string{"a-1.0.0.tgz", "a-1.1.0.tgz"}, deletedFilenames(report))
+}
+
+func TestPolicy_Plan_KeepLastOrKeepDays(t *testing.T) {
+
+	policy, _ := NewPolicy([]string{"a:keep-last=1,keep-days=15"})
+	index := testIndex(map[string]int{"1.0.0": 30, "1.1.0": 20, "1.2.0": 10, "1.3.0": 0})
+
+	// run
+	report := policy.Plan(index, now)
+
+	// check
+	assert.Equal(t, 2, report.Kept)
+	assert.Equal(t, []string{"a-1.0.0.tgz", "a-1.1.0.tgz"}, deletedFilenames(report))
+}
+
+func TestPolicy_Plan_KeepReleases(t *testing.T) {
+
+	policy, _ := NewPolicy([]string{"a:keep-last=1,keep-releases"})
+	index := testIndex(map[string]int{"1.0.0": 30, "1.1.0-rc.1": 20, "1.1.0": 10, "1.2.0-rc.1": 0})
+
+	// run
+	report := policy.Plan(index, now)
+
+	// check
+	assert.Equal(t, 3, report.Kept)
+	assert.Equal(t, []string{"a-1.1.0-rc.1.tgz"}, deletedFilenames(report))
+	assert.Equal(t, "a", report.Deleted[0].Rule)
+}
+
+func TestPolicy_Plan_FirstMatchingRule(t *testing.T) {
+
+	policy, _ := NewPolicy([]string{"b:keep-last=5", "*:keep-last=1"})
+	index := testIndex(map[string]int{"1.0.0": 10, "1.1.0": 0})
+	index.Add(&util.ChartMetadata{Name: "b", Version: "1.0.0"}, "http://localhost/b-1.0.0.tgz", "")
+	index.Add(&util.ChartMetadata{Name: "b", Version: "1.1.0"}, "http://localhost/b-1.1.0.tgz", "")
+
+	// run
+	report := policy.Plan(index, now)
+
+	// check
+	assert.Equal(t, 3, report.Kept)
+	assert.Equal(t, []string{"a-1.0.0.tgz"}, deletedFilenames(report))
+}
+
+func TestPolicy_Plan_NoMatchingRule(t *testing.T) {
+
+	policy, _ := NewPolicy([]string{"b:keep-last=1"})
+	index := testIndex(map[string]int{"1.0.0": 10, "1.1.0": 0})
+
+	// run
+	report := policy.Plan(index, now)
+
+	// check
+	assert.Equal(t, 2, report.Kept)
+	assert.Empty(t, report.Deleted)
+}
+
+func TestPolicy_Apply(t *testing.T) {
+
+	policy, _ := NewPolicy([]string{"a:keep-last=1"})
+	b := &backendStub{index: testIndex(map[string]int{"1.0.0": 10, "1.1.0": 0})}
+
+	// run
+	report, err := policy.Apply(b, false)
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+	assert.False(t, report.DryRun)
+	assert.Equal(t, []string{"a-1.0.0.tgz"}, deletedFilenames(report))
+	assert.Equal(t, [][]string{{"a-1.0.0.tgz"}}, b.deleted, "expected a single delete")
+}
+
+func TestPolicy_Apply_DryRun(t *testing.T) {
+
+	policy, _ := NewPolicy([]string{"a:keep-last=1"})
+	b := &backendStub{index: testIndex(map[string]int{"1.0.0": 10, "1.1.0": 0})}
+
+	// run
+	report, err := policy.Apply(b, true)
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+	assert.True(t, report.DryRun)
+	assert.Equal(t, []string{"a-1.0.0.tgz"}, deletedFilenames(report))
+	assert.Empty(t, b.deleted, "expected nothing deleted")
+}
+
+func TestPolicy_Apply_NothingToDelete(t *testing.T) {
+
+	policy, _ := NewPolicy([]string{"a:keep-last=5"})
+	b := &backendStub{index: testIndex(map[string]int{"1.0.0": 10, "1.1.0": 0})}
+
+	// run
+	report, err := policy.Apply(b, false)
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+	assert.Empty(t, report.Deleted)
+	assert.Empty(t, b.deleted, "expected no delete")
+}
+
+//
+// helpers
+//
+
+// versions of chart "a", by age in days
+func testIndex(versions map[string]int) *util.IndexFile {
+
+	index := util.NewIndexFile()
+	for version, age := range versions {
+		md := &util.ChartMetadata{Name: "a", Version: version}
+		cv := index.Add(md, "http://localhost/"+md.ChartFilename(), "")
+		cv.Created = now.Add(-time.Duration(age) * 24 * time.Hour)
+	}
+
+	return index
+}
+
+func deletedFilenames(report *Report) []string {
+	filenames := []string{}
+	for _, deletion := range report.Deleted {
+		filenames = append(filenames, deletion.Filename)
+	}
+	sort.Strings(filenames)
+	return filenames
+}
+
+// backendStub serves a fixed index and records deletes
+type backendStub struct {
+	index   *util.IndexFile
+	deleted [][]string
+}
+
+func (b *backendStub) Initialize() error {
+	return nil
+}
+
+func (b *backendStub) GetIndex() ([]byte, error) {
+	return b.index.Marshal()
+}
+
+func (b *backendStub) GetChart(name string) ([]byte, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (b *backendStub) PutChart(filename string, file io.Reader, size int64) error {
+	return errors.New("not implemented")
+}
+
+func (b *backendStub) DeleteCharts(filenames ...string) error {
+	b.deleted = append(b.deleted, filenames)
+	return nil
+}
+
+func (b *backendStub) Reindex() error {
+	return nil
+}
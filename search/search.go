@@ -0,0 +1,281 @@
+package search
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/semver"
+	"github.com/zlangbert/hrp/util"
+)
+
+const (
+	// DefaultLimit is the page size when a query doesn't set one
+	DefaultLimit = 20
+
+	// MaxLimit is the largest page size a query can ask for
+	MaxLimit = 100
+)
+
+// Query selects and orders chart versions. Every word of Text has to appear in a version's
+// name, description, keywords or maintainers. Sort is one of name, version or created, Order
+// one of asc or desc, defaulting to ascending names and newest versions first.
+type Query struct {
+	Text       string
+	Constraint string
+	Sort       string
+	Order      string
+	Offset     int
+	Limit      int
+
+	// Allowed filters out charts the caller can't see, nil allows all
+	Allowed func(chart string) bool
+}
+
+// Hit is a chart version matching a query
+type Hit struct {
+	Name        string             `json:"name"`
+	Version     string             `json:"version"`
+	AppVersion  string             `json:"appVersion,omitempty"`
+	Description string             `json:"description,omitempty"`
+	Keywords    []string           `json:"keywords,omitempty"`
+	Maintainers []*util.Maintainer `json:"maintainers,omitempty"`
+	Deprecated  bool               `json:"deprecated,omitempty"`
+	Created     time.Time          `json:"created"`
+	Digest      string             `json:"digest,omitempty"`
+	URLs        []string           `json:"urls"`
+}
+
+// Result is a page of hits along with the total number of matches
+type Result struct {
+	Total  int   `json:"total"`
+	Offset int   `json:"offset"`
+	Limit  int   `json:"limit"`
+	Hits   []Hit `json:"results"`
+}
+
+// Index is a repository index prepared for searching
+type Index struct {
+	entries []*entry
+}
+
+// a chart version with what it is searched and sorted by
+type entry struct {
+	hit     Hit
+	text    string
+	version *semver.Version
+}
+
+// NewIndex prepares a repository index for searching
+func NewIndex(index *util.IndexFile) *Index {
+
+	i := &Index{}
+	for _, versions := range index.Entries {
+		for _, cv := range versions {
+			i.entries = append(i.entries, newEntry(cv))
+		}
+	}
+
+	return i
+}
+
+func newEntry(cv *util.ChartVersion) *entry {
+
+	text := []string{cv.Name, cv.Description}
+	text = append(text, cv.Keywords...)
+	for _, m := range cv.Maintainers {
+		text = append(text, m.Name, m.Email)
+	}
+
+	version, _ := semver.NewVersion(cv.Version)
+
+	return &entry{
+		hit: Hit{
+			Name:        cv.Name,
+			Version:     cv.Version,
+			AppVersion:  cv.AppVersion,
+			Description: cv.Description,
+			Keywords:    cv.Keywords,
+			Maintainers: cv.Maintainers,
+			Deprecated:  cv.Deprecated,
+			Created:     cv.Created,
+			Digest:      cv.Digest,
+			URLs:        cv.URLs,
+		},
+		text:    strings.ToLower(strings.Join(text, "\n")),
+		version: version,
+	}
+}
+
+// Search runs a query, returning an error if the query is invalid
+func (i *Index) Search(q Query) (*Result, error) {
+
+	var constraint *semver.Constraints
+	if strings.TrimSpace(q.Constraint) != "" {
+		var err error
+		constraint, err = util.ParseVersionConstraint(q.Constraint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version constraint %q", q.Constraint)
+		}
+	}
+
+	less, err := ordering(q.Sort, q.Order)
+	if err != nil {
+		return nil, err
+	}
+
+	if q.Offset < 0 {
+		return nil, fmt.Errorf("invalid offset %d", q.Offset)
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+	if limit > MaxLimit {
+		limit = MaxLimit
+	}
+
+	terms := strings.Fields(strings.ToLower(q.Text))
+
+	matches := []*entry{}
+	for _, e := range i.entries {
+		if q.Allowed != nil && !q.Allowed(e.hit.Name) {
+			continue
+		}
+		if !e.matches(terms) {
+			continue
+		}
+		if constraint != nil && (e.version == nil || !constraint.Check(e.version)) {
+			continue
+		}
+		matches = append(matches, e)
+	}
+
+	sort.SliceStable(matches, func(a, b int) bool {
+		return less(matches[a], matches[b])
+	})
+
+	result := &Result{
+		Total:  len(matches),
+		Offset: q.Offset,
+		Limit:  limit,
+		Hits:   []Hit{},
+	}
+	for n := q.Offset; n < len(matches) && n < q.Offset+limit; n++ {
+		result.Hits = append(result.Hits, matches[n].hit)
+	}
+
+	return result, nil
+}
+
+func (e *entry) matches(terms []string) bool {
+	for _, term := range terms {
+		if !strings.Contains(e.text, term) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+ * how to order matches, ties are broken by name, then newest version first
+ */
+func ordering(by string, order string) (func(a *entry, b *entry) bool, error) {
+
+	byName := func(a *entry, b *entry) int {
+		return strings.Compare(a.hit.Name, b.hit.Name)
+	}
+	byVersion := func(a *entry, b *entry) int {
+		return util.CompareVersions(a.hit.Version, b.hit.Version)
+	}
+	byCreated := func(a *entry, b *entry) int {
+		switch {
+		case a.hit.Created.Before(b.hit.Created):
+			return -1
+		case a.hit.Created.After(b.hit.Created):
+			return 1
+		}
+		return 0
+	}
+
+	var compare func(a *entry, b *entry) int
+	desc := false
+	switch by {
+	case "", "name":
+		compare = byName
+	case "version":
+		compare, desc = byVersion, true
+	case "created":
+		compare, desc = byCreated, true
+	default:
+		return nil, fmt.Errorf("invalid sort %q: expected name, version or created", by)
+	}
+
+	switch order {
+	case "":
+	case "asc":
+		desc = false
+	case "desc":
+		desc = true
+	default:
+		return nil, fmt.Errorf("invalid order %q: expected asc or desc", order)
+	}
+
+	return func(a *entry, b *entry) bool {
+		c := compare(a, b)
+		if desc {
+			c = -c
+		}
+		if c == 0 {
+			c = byName(a, b)
+		}
+		if c == 0 {
+			c = -byVersion(a, b)
+		}
+		return c < 0
+	}, nil
+}
+
+// Cache holds a search index per repository, rebuilt whenever the repository's index changes
+type Cache struct {
+	lock    sync.Mutex
+	indexes map[string]*cachedIndex
+}
+
+type cachedIndex struct {
+	digest string
+	index  *Index
+}
+
+// NewCache creates an empty cache
+func NewCache() *Cache {
+	return &Cache{indexes: map[string]*cachedIndex{}}
+}
+
+// Get returns the search index for a repository's serialized index, reusing the cached one
+// while the repository index is unchanged
+func (c *Cache) Get(repo string, data []byte) (*Index, error) {
+
+	digest := util.Digest(data)
+
+	c.lock.Lock()
+	cached, ok := c.indexes[repo]
+	c.lock.Unlock()
+	if ok && cached.digest == digest {
+		return cached.index, nil
+	}
+
+	index, err := util.ParseIndex(data)
+	if err != nil {
+		return nil, err
+	}
+	cached = &cachedIndex{digest: digest, index: NewIndex(index)}
+
+	c.lock.Lock()
+	c.indexes[repo] = cached
+	c.lock.Unlock()
+
+	return cached.index, nil
+}
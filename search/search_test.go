@@ -0,0 +1,184 @@
+package search
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zlangbert/hrp/util"
+)
+
+func TestSearch_Text(t *testing.T) {
+
+	i := NewIndex(testIndex())
+
+	for text, expected := range map[string][]string{
+		"":                {"db-0.9.0", "nginx-2.0.0", "nginx-1.3.0", "nginx-1.2.0", "redis-1.0.0"},
+		"NGINX":           {"nginx-2.0.0", "nginx-1.3.0", "nginx-1.2.0"},
+		"cache":           {"redis-1.0.0"},
+		"proxy web":       {"nginx-2.0.0", "nginx-1.3.0", "nginx-1.2.0"},
+		"platform@x.test": {"db-0.9.0", "redis-1.0.0"},
+		"nginx cache":     {},
+	} {
+		result, err := i.Search(Query{Text: text})
+
+		assert.Nil(t, err, "expected nil err")
+		assert.Equal(t, expected, testHits(result), "query %q", text)
+	}
+}
+
+func TestSearch_Constraint(t *testing.T) {
+
+	i := NewIndex(testIndex())
+
+	for constraint, expected := range map[string][]string{
+		">=1.2 <2":         {"nginx-1.3.0", "nginx-1.2.0"},
+		">= 1.2, < 2":      {"nginx-1.3.0", "nginx-1.2.0"},
+		"~1.2 || ^2":       {"nginx-2.0.0", "nginx-1.2.0"},
+		"1.0.0 - 1.2.0":    {"nginx-1.2.0"},
+		"  ":               {"nginx-2.0.0", "nginx-1.3.0", "nginx-1.2.0"},
+		">1.3.0 <1.0.0":    {},
+		">=1.3.0 <=2.0.0 ": {"nginx-2.0.0", "nginx-1.3.0"},
+	} {
+		result, err := i.Search(Query{Text: "nginx", Constraint: constraint})
+
+		assert.Nil(t, err, "expected nil err")
+		assert.Equal(t, expected, testHits(result), "constraint %q", constraint)
+	}
+}
+
+func TestSearch_Sort(t *testing.T) {
+
+	i := NewIndex(testIndex())
+
+	for _, test := range []struct {
+		by       string
+		order    string
+		expected []string
+	}{
+		{"", "", []string{"db-0.9.0", "nginx-2.0.0", "nginx-1.3.0", "nginx-1.2.0", "redis-1.0.0"}},
+		{"name", "desc", []string{"redis-1.0.0", "nginx-2.0.0", "nginx-1.3.0", "nginx-1.2.0", "db-0.9.0"}},
+		{"version", "", []string{"nginx-2.0.0", "nginx-1.3.0", "nginx-1.2.0", "redis-1.0.0", "db-0.9.0"}},
+		{"version", "asc", []string{"db-0.9.0", "redis-1.0.0", "nginx-1.2.0", "nginx-1.3.0", "nginx-2.0.0"}},
+		{"created", "", []string{"redis-1.0.0", "nginx-2.0.0", "db-0.9.0", "nginx-1.3.0", "nginx-1.2.0"}},
+		{"created", "asc", []string{"nginx-1.2.0", "nginx-1.3.0", "db-0.9.0", "nginx-2.0.0", "redis-1.0.0"}},
+	} {
+		result, err := i.Search(Query{Sort: test.by, Order: test.order})
+
+		assert.Nil(t, err, "expected nil err")
+		assert.Equal(t, test.expected, testHits(result), "sort %q %q", test.by, test.order)
+	}
+}
+
+func TestSearch_Pagination(t *testing.T) {
+
+	i := NewIndex(testIndex())
+
+	// run
+	result, err := i.Search(Query{Offset: 1, Limit: 2})
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+	assert.Equal(t, 5, result.Total)
+	assert.Equal(t, 2, result.Limit)
+	assert.Equal(t, []string{"nginx-2.0.0", "nginx-1.3.0"}, testHits(result))
+
+	result, _ = i.Search(Query{Offset: 10})
+	assert.Equal(t, []Hit{}, result.Hits, "expected empty page past the end")
+
+	result, _ = i.Search(Query{Limit: 1000})
+	assert.Equal(t, MaxLimit, result.Limit, "expected limit capped")
+}
+
+func TestSearch_Allowed(t *testing.T) {
+
+	i := NewIndex(testIndex())
+
+	// run
+	result, err := i.Search(Query{Allowed: func(chart string) bool { return chart != "nginx" }})
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+	assert.Equal(t, []string{"db-0.9.0", "redis-1.0.0"}, testHits(result))
+}
+
+func TestSearch_InvalidQuery(t *testing.T) {
+
+	i := NewIndex(testIndex())
+
+	for _, q := range []Query{
+		{Constraint: "not a constraint"},
+		{Sort: "size"},
+		{Order: "random"},
+		{Offset: -1},
+	} {
+		_, err := i.Search(q)
+		assert.Error(t, err, "expected invalid query %+v", q)
+	}
+}
+
+func TestCache_Get(t *testing.T) {
+
+	c := NewCache()
+	data, _ := testIndex().Marshal()
+
+	// run
+	first, err := c.Get("", data)
+	assert.Nil(t, err, "expected nil err")
+	same, _ := c.Get("", data)
+	other, _ := c.Get("team-a", data)
+
+	changed := testIndex()
+	changed.Remove("db", "0.9.0")
+	changedData, _ := changed.Marshal()
+	rebuilt, _ := c.Get("", changedData)
+
+	// check
+	assert.True(t, first == same, "expected unchanged index cached")
+	assert.True(t, first != other, "expected index cached per repository")
+	assert.True(t, first != rebuilt, "expected changed index rebuilt")
+
+	result, _ := rebuilt.Search(Query{Text: "db"})
+	assert.Equal(t, 0, result.Total)
+}
+
+func TestCache_Get_InvalidIndex(t *testing.T) {
+
+	_, err := NewCache().Get("", []byte("entries: ["))
+
+	assert.Error(t, err, "expected parse error")
+}
+
+//
+// helpers
+//
+
+func testIndex() *util.IndexFile {
+
+	platform := []*util.Maintainer{{Name: "Platform", Email: "platform@x.test"}}
+	day := func(n int) time.Time {
+		return time.Date(2017, 6, n, 0, 0, 0, 0, time.UTC)
+	}
+
+	index := util.NewIndexFile()
+	add := func(md util.ChartMetadata, created time.Time) {
+		cv := index.Add(&md, "http://localhost:1323/"+md.ChartFilename(), "")
+		cv.Created = created
+	}
+
+	add(util.ChartMetadata{Name: "nginx", Version: "1.2.0", Description: "Web server and reverse proxy"}, day(1))
+	add(util.ChartMetadata{Name: "nginx", Version: "1.3.0", Description: "Web server and reverse proxy"}, day(2))
+	add(util.ChartMetadata{Name: "nginx", Version: "2.0.0", Description: "Web server and reverse proxy"}, day(4))
+	add(util.ChartMetadata{Name: "redis", Version: "1.0.0", Keywords: []string{"cache"}, Maintainers: platform}, day(5))
+	add(util.ChartMetadata{Name: "db", Version: "0.9.0", Maintainers: platform}, day(3))
+
+	return index
+}
+
+func testHits(result *Result) []string {
+	hits := []string{}
+	for _, hit := range result.Hits {
+		hits = append(hits, hit.Name+"-"+hit.Version)
+	}
+	return hits
+}
@@ -0,0 +1,274 @@
+package util
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	// ChartMetadataFilename is the filename of the chart metadata inside a chart archive
+	ChartMetadataFilename = "Chart.yaml"
+
+	// ChartRequirementsFilename is the filename of the chart dependencies of apiVersion v1 charts
+	ChartRequirementsFilename = "requirements.yaml"
+
+	// ErrChartMetadataMissing is returned when a chart archive has no Chart.yaml
+	ErrChartMetadataMissing = errors.New("chart archive does not contain " + ChartMetadataFilename)
+
+	// MaxDecompressedChartSize is how much data is read from a chart archive once decompressed,
+	// reading more fails with ErrTooLarge so a small archive can't expand to exhaust memory.
+	// It matches the limit helm applies when loading charts.
+	MaxDecompressedChartSize int64 = 100 << 20
+)
+
+// Maintainer describes a chart maintainer
+type Maintainer struct {
+	Name  string `yaml:"name,omitempty" json:"name,omitempty"`
+	Email string `yaml:"email,omitempty" json:"email,omitempty"`
+	URL   string `yaml:"url,omitempty" json:"url,omitempty"`
+}
+
+// ChartMetadata is the contents of a chart's Chart.yaml
+type ChartMetadata struct {
+	APIVersion  string        `yaml:"apiVersion,omitempty" json:"apiVersion,omitempty"`
+	Name        string        `yaml:"name" json:"name"`
+	Version     string        `yaml:"version" json:"version"`
+	AppVersion  string        `yaml:"appVersion,omitempty" json:"appVersion,omitempty"`
+	Description string        `yaml:"description,omitempty" json:"description,omitempty"`
+	Keywords    []string      `yaml:"keywords,omitempty" json:"keywords,omitempty"`
+	Home        string        `yaml:"home,omitempty" json:"home,omitempty"`
+	Sources     []string      `yaml:"sources,omitempty" json:"sources,omitempty"`
+	Maintainers []*Maintainer `yaml:"maintainers,omitempty" json:"maintainers,omitempty"`
+	Icon        string        `yaml:"icon,omitempty" json:"icon,omitempty"`
+	Engine      string        `yaml:"engine,omitempty" json:"engine,omitempty"`
+	Deprecated  bool          `yaml:"deprecated,omitempty" json:"deprecated,omitempty"`
+
+	// everything else in the Chart.yaml, like dependencies, kubeVersion or annotations
+	Extra map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// ChartFilename returns the conventional archive filename for the chart
+func (md *ChartMetadata) ChartFilename() string {
+	return fmt.Sprintf("%s-%s.tgz", md.Name, md.Version)
+}
+
+var chartFilenamePattern = regexp.MustCompile(`^(.+?)-(v?\d+\.\d+\.\d+[^/]*)\.tgz$`)
+
+// ParseChartFilename splits a chart archive filename of the form <name>-<version>.tgz,
+// ignoring a trailing provenance extension
+func ParseChartFilename(filename string) (name string, version string, ok bool) {
+
+	match := chartFilenamePattern.FindStringSubmatch(strings.TrimSuffix(filename, ProvenanceExtension))
+	if match == nil {
+		return "", "", false
+	}
+
+	return match[1], match[2], true
+}
+
+// LoadChartMetadata reads the Chart.yaml from a packaged chart archive
+func LoadChartMetadata(data []byte) (*ChartMetadata, error) {
+	return ReadChartMetadata(bytes.NewReader(data))
+}
+
+// ReadChartMetadata reads the Chart.yaml from a packaged chart archive as it is streamed,
+// reading no further than the Chart.yaml
+func ReadChartMetadata(r io.Reader) (*ChartMetadata, error) {
+
+	var content []byte
+	err := walkChart(r, func(filename string, f io.Reader) error {
+		if filename != ChartMetadataFilename {
+			return nil
+		}
+		b, err := ioutil.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		content = b
+		return errStopWalk
+	})
+	if err != nil {
+		return nil, err
+	}
+	if content == nil {
+		return nil, ErrChartMetadataMissing
+	}
+
+	return parseChartMetadata(content)
+}
+
+func parseChartMetadata(content []byte) (*ChartMetadata, error) {
+
+	md := &ChartMetadata{}
+	err := yaml.Unmarshal(content, md)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", ChartMetadataFilename, err.Error())
+	}
+	if md.Name == "" || md.Version == "" {
+		return nil, fmt.Errorf("invalid %s: name and version are required", ChartMetadataFilename)
+	}
+
+	return md, nil
+}
+
+// ReadChartFile reads a single file from a packaged chart archive. The name is relative to
+// the chart's root directory, e.g. "values.yaml" or "templates/deployment.yaml".
+func ReadChartFile(data []byte, name string) ([]byte, error) {
+
+	var content []byte
+	err := WalkChart(data, func(filename string, r io.Reader) error {
+		if filename != name {
+			return nil
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		content = b
+		return errStopWalk
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if content == nil {
+		if name == ChartMetadataFilename {
+			return nil, ErrChartMetadataMissing
+		}
+		return nil, fmt.Errorf("chart archive does not contain %s", name)
+	}
+
+	return content, nil
+}
+
+// ReadChartFiles reads every file of a packaged chart archive, by name relative to the
+// chart's root directory
+func ReadChartFiles(data []byte) (map[string][]byte, error) {
+
+	files := map[string][]byte{}
+	err := WalkChart(data, func(filename string, r io.Reader) error {
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		files[filename] = b
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// ChartDependency is a chart a chart depends on, declared in its requirements.yaml or, for
+// apiVersion v2 charts, its Chart.yaml
+type ChartDependency struct {
+	Name       string `yaml:"name" json:"name"`
+	Version    string `yaml:"version" json:"version"`
+	Repository string `yaml:"repository" json:"repository"`
+}
+
+// LoadChartDependencies reads the dependencies declared by a packaged chart archive
+func LoadChartDependencies(data []byte) ([]*ChartDependency, error) {
+	return ReadChartDependencies(bytes.NewReader(data))
+}
+
+// ReadChartDependencies reads the dependencies declared by a packaged chart archive as it is
+// streamed
+func ReadChartDependencies(r io.Reader) ([]*ChartDependency, error) {
+
+	dependencies := []*ChartDependency{}
+	err := walkChart(r, func(filename string, r io.Reader) error {
+		if filename != ChartMetadataFilename && filename != ChartRequirementsFilename {
+			return nil
+		}
+		content, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+
+		declared := &struct {
+			Dependencies []*ChartDependency `yaml:"dependencies"`
+		}{}
+		err = yaml.Unmarshal(content, declared)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %s", filename, err.Error())
+		}
+		dependencies = append(dependencies, declared.Dependencies...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return dependencies, nil
+}
+
+var errStopWalk = errors.New("stop walk")
+
+// WalkChart calls fn for every regular file in a packaged chart archive. Filenames passed
+// to fn are relative to the chart's root directory. Archives decompressing to more than
+// MaxDecompressedChartSize fail with ErrTooLarge.
+func WalkChart(data []byte, fn func(filename string, r io.Reader) error) error {
+	return walkChart(bytes.NewReader(data), fn)
+}
+
+func walkChart(r io.Reader, fn func(filename string, r io.Reader) error) error {
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("invalid chart archive: %s", err.Error())
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(NewLimitedReader(gz, MaxDecompressedChartSize))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err == ErrTooLarge {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("invalid chart archive: %s", err.Error())
+		}
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+			continue
+		}
+
+		// strip the leading chart directory
+		name := path.Clean(strings.TrimPrefix(header.Name, "/"))
+		parts := strings.SplitN(name, "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		err = fn(parts[1], tr)
+		if err == errStopWalk {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Digest returns the hex encoded sha256 digest of the data, as used in the repository index
+func Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
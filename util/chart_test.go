@@ -0,0 +1,84 @@
+package util
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadChartDependencies_Requirements(t *testing.T) {
+
+	chart := testChart(t, map[string]string{
+		"Chart.yaml":        "name: web\nversion: 1.0.0\n",
+		"requirements.yaml": "dependencies:\n- name: nginx\n  version: ~1.2.0\n  repository: http://charts.example.com\n",
+	})
+
+	// run
+	dependencies, err := LoadChartDependencies(chart)
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+	assert.Equal(t, []*ChartDependency{
+		{Name: "nginx", Version: "~1.2.0", Repository: "http://charts.example.com"},
+	}, dependencies)
+}
+
+func TestLoadChartDependencies_ChartV2(t *testing.T) {
+
+	chart := testChart(t, map[string]string{
+		"Chart.yaml": "apiVersion: v2\nname: web\nversion: 1.0.0\ndependencies:\n- name: redis\n  version: \">=6 <7\"\n  repository: http://charts.example.com\n",
+	})
+
+	// run
+	dependencies, err := LoadChartDependencies(chart)
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+	assert.Equal(t, []*ChartDependency{
+		{Name: "redis", Version: ">=6 <7", Repository: "http://charts.example.com"},
+	}, dependencies)
+}
+
+func TestLoadChartDependencies_None(t *testing.T) {
+
+	chart := testChart(t, map[string]string{
+		"Chart.yaml": "name: web\nversion: 1.0.0\n",
+	})
+
+	// run
+	dependencies, err := LoadChartDependencies(chart)
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+	assert.Empty(t, dependencies)
+}
+
+func TestReadChartFiles_TooLarge(t *testing.T) {
+
+	chart := testChart(t, map[string]string{
+		"Chart.yaml":  "name: web\nversion: 1.0.0\n",
+		"values.yaml": strings.Repeat("replicas: 1\n", 1000),
+	})
+
+	max := MaxDecompressedChartSize
+	MaxDecompressedChartSize = 4096
+	defer func() { MaxDecompressedChartSize = max }()
+
+	// run
+	_, err := ReadChartFiles(chart)
+
+	// check
+	assert.Equal(t, ErrTooLarge, err)
+}
+
+func testChart(t *testing.T, files map[string]string) []byte {
+
+	chart, _, err := PackageChart(bytes.NewReader(testTar(t, files)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return chart
+}
@@ -0,0 +1,251 @@
+package util
+
+import (
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver"
+	"gopkg.in/yaml.v2"
+)
+
+// IndexFile is a helm repository index
+type IndexFile struct {
+	APIVersion string                     `yaml:"apiVersion"`
+	Entries    map[string][]*ChartVersion `yaml:"entries"`
+	Generated  time.Time                  `yaml:"generated"`
+}
+
+// ChartVersion is a single chart version entry in the repository index
+type ChartVersion struct {
+	ChartMetadata `yaml:",inline"`
+
+	URLs    []string  `yaml:"urls"`
+	Created time.Time `yaml:"created,omitempty"`
+	Digest  string    `yaml:"digest,omitempty"`
+
+	// the keys of the entry not known to ChartMetadata or here, kept so an index written by
+	// helm or another repository doesn't lose them when it is rewritten. The yaml decoder
+	// doesn't fill the inline map of an embedded struct, so they are held here instead.
+	Extra map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// NewIndexFile creates a new, empty index
+func NewIndexFile() *IndexFile {
+	return &IndexFile{
+		APIVersion: "v1",
+		Entries:    map[string][]*ChartVersion{},
+		Generated:  time.Now(),
+	}
+}
+
+// ParseIndex parses a serialized repository index
+func ParseIndex(data []byte) (*IndexFile, error) {
+
+	index := NewIndexFile()
+	err := yaml.Unmarshal(data, index)
+	if err != nil {
+		return nil, err
+	}
+	if index.Entries == nil {
+		index.Entries = map[string][]*ChartVersion{}
+	}
+
+	return index, nil
+}
+
+// Marshal serializes the index
+func (i *IndexFile) Marshal() ([]byte, error) {
+	return yaml.Marshal(i)
+}
+
+// Add adds a chart version to the index, replacing an existing entry with the same version
+func (i *IndexFile) Add(md *ChartMetadata, url string, digest string) *ChartVersion {
+
+	cv := &ChartVersion{
+		ChartMetadata: *md,
+		URLs:          []string{url},
+		Created:       time.Now(),
+		Digest:        digest,
+		Extra:         md.Extra,
+	}
+	cv.ChartMetadata.Extra = nil
+
+	i.Remove(md.Name, md.Version)
+	i.Entries[md.Name] = append(i.Entries[md.Name], cv)
+
+	return cv
+}
+
+// Remove removes a chart version from the index, returning whether it was present
+func (i *IndexFile) Remove(name string, version string) bool {
+
+	versions := i.Entries[name]
+	for n, cv := range versions {
+		if cv.Version == version {
+			i.Entries[name] = append(versions[:n], versions[n+1:]...)
+			if len(i.Entries[name]) == 0 {
+				delete(i.Entries, name)
+			}
+			return true
+		}
+	}
+
+	return false
+}
+
+// Merge adds the chart versions of other that this index doesn't have yet, returning the
+// added versions. Versions already present take precedence.
+func (i *IndexFile) Merge(other *IndexFile) []*ChartVersion {
+
+	added := []*ChartVersion{}
+	for name, versions := range other.Entries {
+		for _, cv := range versions {
+			if i.Get(name, cv.Version) != nil {
+				continue
+			}
+			i.Entries[name] = append(i.Entries[name], cv)
+			added = append(added, cv)
+		}
+	}
+
+	return added
+}
+
+// Get returns the chart version with the given name and version, or nil
+func (i *IndexFile) Get(name string, version string) *ChartVersion {
+
+	for _, cv := range i.Entries[name] {
+		if cv.Version == version {
+			return cv
+		}
+	}
+
+	return nil
+}
+
+// FindByFilename returns the chart version whose url ends in the given filename, or nil
+func (i *IndexFile) FindByFilename(filename string) *ChartVersion {
+
+	for _, versions := range i.Entries {
+		for _, cv := range versions {
+			for _, url := range cv.URLs {
+				if url == filename || strings.HasSuffix(url, "/"+filename) {
+					return cv
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Resolve returns the highest version of a chart satisfying the constraint, nil if there is
+// none. A nil constraint is satisfied by every version.
+func (i *IndexFile) Resolve(name string, constraint *semver.Constraints) *ChartVersion {
+
+	var resolved *ChartVersion
+	for _, cv := range i.Entries[name] {
+		if constraint != nil {
+			v, err := semver.NewVersion(cv.Version)
+			if err != nil || !constraint.Check(v) {
+				continue
+			}
+		}
+		if resolved == nil || CompareVersions(cv.Version, resolved.Version) > 0 {
+			resolved = cv
+		}
+	}
+
+	return resolved
+}
+
+// Filename returns the name of the chart file, the last element of its url
+func (cv *ChartVersion) Filename() string {
+	for _, u := range cv.URLs {
+		parsed, err := url.Parse(u)
+		if err == nil && path.Base(parsed.Path) != "." && path.Base(parsed.Path) != "/" {
+			return path.Base(parsed.Path)
+		}
+	}
+	return cv.ChartFilename()
+}
+
+// ChartURL returns the url a chart file is served at under the repository base url
+func ChartURL(baseURL string, filename string) string {
+	return strings.TrimSuffix(baseURL, "/") + "/" + filename
+}
+
+// SortEntries sorts the versions of every chart, newest first
+func (i *IndexFile) SortEntries() {
+	for _, versions := range i.Entries {
+		sort.SliceStable(versions, func(a, b int) bool {
+			return CompareVersions(versions[a].Version, versions[b].Version) > 0
+		})
+	}
+}
+
+// CompareVersions compares two chart versions by semver precedence, falling back to string
+// comparison when either is not a valid semantic version
+func CompareVersions(a string, b string) int {
+
+	va, errA := semver.NewVersion(a)
+	vb, errB := semver.NewVersion(b)
+	if errA != nil || errB != nil {
+		return strings.Compare(a, b)
+	}
+
+	return va.Compare(vb)
+}
+
+// ParseVersionConstraint parses a semver version constraint, also accepting spaces between
+// and-ed constraints like ">=1.2 <2", which older semver releases only take comma separated.
+// Partial upper bounds are completed, as semver reads "<2" as "<2.x" and would match 2.0.0.
+func ParseVersionConstraint(s string) (*semver.Constraints, error) {
+
+	// attach operators to their versions, ">= 1.2" becomes ">=1.2"
+	fields := []string{}
+	for _, field := range strings.Fields(s) {
+		if n := len(fields); n > 0 && strings.Trim(fields[n-1], "<>=!~^") == "" {
+			fields[n-1] += field
+			continue
+		}
+		fields = append(fields, field)
+	}
+
+	joined := ""
+	for n, field := range fields {
+		if n > 0 {
+			prev := fields[n-1]
+			if field == "-" || prev == "-" || field == "||" || prev == "||" ||
+				strings.HasSuffix(prev, ",") || strings.HasPrefix(field, ",") {
+				joined += " "
+			} else {
+				joined += ","
+			}
+		}
+		joined += completeUpperBound(field)
+	}
+
+	return semver.NewConstraint(joined)
+}
+
+func completeUpperBound(field string) string {
+
+	if !strings.HasPrefix(field, "<") || strings.HasPrefix(field, "<=") {
+		return field
+	}
+
+	version := strings.TrimSuffix(field[1:], ",")
+	rest := field[1+len(version):]
+	if version == "" || strings.ContainsAny(version, "xX*-+") {
+		return field
+	}
+	for strings.Count(version, ".") < 2 {
+		version += ".0"
+	}
+
+	return "<" + version + rest
+}
@@ -0,0 +1,99 @@
+package util
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIndexFile_Resolve(t *testing.T) {
+
+	index := NewIndexFile()
+	for _, version := range []string{"1.2.0", "1.2.5", "1.3.0", "2.0.0"} {
+		index.Add(&ChartMetadata{Name: "nginx", Version: version}, "nginx-"+version+".tgz", "")
+	}
+
+	constraint, err := ParseVersionConstraint("~1.2.0")
+	assert.Nil(t, err, "expected nil err")
+	if cv := index.Resolve("nginx", constraint); assert.NotNil(t, cv, "expected a version") {
+		assert.Equal(t, "1.2.5", cv.Version)
+	}
+
+	constraint, err = ParseVersionConstraint(">=1.2 <2")
+	assert.Nil(t, err, "expected nil err")
+	if cv := index.Resolve("nginx", constraint); assert.NotNil(t, cv, "expected a version") {
+		assert.Equal(t, "1.3.0", cv.Version)
+	}
+
+	if cv := index.Resolve("nginx", nil); assert.NotNil(t, cv, "expected a version") {
+		assert.Equal(t, "2.0.0", cv.Version)
+	}
+
+	constraint, err = ParseVersionConstraint(">=3")
+	assert.Nil(t, err, "expected nil err")
+	assert.Nil(t, index.Resolve("nginx", constraint), "expected no version")
+	assert.Nil(t, index.Resolve("redis", nil), "expected no version")
+}
+
+func TestParseIndex_KeepsUnknownFields(t *testing.T) {
+
+	data := []byte(`apiVersion: v1
+entries:
+  web:
+  - name: web
+    version: 1.0.0
+    kubeVersion: '>=1.10'
+    type: application
+    annotations:
+      category: frontend
+    dependencies:
+    - name: nginx
+      version: ^1.2.0
+      repository: https://charts.example.com
+      condition: nginx.enabled
+      tags:
+      - proxy
+    urls:
+    - web-1.0.0.tgz
+    digest: abc
+generated: 2018-01-01T00:00:00Z
+`)
+
+	// run
+	index, err := ParseIndex(data)
+	assert.Nil(t, err, "expected nil err")
+	out, err := index.Marshal()
+	assert.Nil(t, err, "expected nil err")
+	index, err = ParseIndex(out)
+	assert.Nil(t, err, "expected nil err")
+
+	// check
+	cv := index.Get("web", "1.0.0")
+	if assert.NotNil(t, cv, "expected entry") {
+		assert.Equal(t, ">=1.10", cv.Extra["kubeVersion"])
+		assert.Equal(t, "application", cv.Extra["type"])
+		assert.NotNil(t, cv.Extra["annotations"], "expected annotations")
+		assert.Equal(t, []string{"web-1.0.0.tgz"}, cv.URLs)
+		assert.Equal(t, "abc", cv.Digest)
+	}
+	assert.Contains(t, string(out), "condition: nginx.enabled")
+	assert.Contains(t, string(out), "- proxy")
+	assert.Equal(t, 1, strings.Count(string(out), "urls:"), "expected known keys written once")
+}
+
+func TestIndexFile_Add_KeepsChartFields(t *testing.T) {
+
+	md, err := parseChartMetadata([]byte("name: web\nversion: 1.0.0\nkubeVersion: '>=1.10'\ndependencies:\n- name: nginx\n  version: ^1.2.0\n"))
+	assert.Nil(t, err, "expected nil err")
+
+	// run
+	index := NewIndexFile()
+	index.Add(md, "web-1.0.0.tgz", "abc")
+	out, err := index.Marshal()
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+	assert.Contains(t, string(out), "kubeVersion: '>=1.10'")
+	assert.Contains(t, string(out), "dependencies:")
+}
@@ -0,0 +1,91 @@
+package util
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+var (
+	// ErrTooLarge is returned when reading more data than allowed
+	ErrTooLarge = errors.New("exceeds the maximum size")
+)
+
+// ReadAllLimited reads r to the end like ioutil.ReadAll, but fails with ErrTooLarge as soon as
+// more than limit bytes were read. A limit of 0 means no limit.
+func ReadAllLimited(r io.Reader, limit int64) ([]byte, error) {
+
+	if limit <= 0 {
+		return ioutil.ReadAll(r)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, ErrTooLarge
+	}
+
+	return data, nil
+}
+
+// NewLimitedReader returns a reader of r that fails with ErrTooLarge once more than limit bytes
+// were read from it. A limit of 0 means no limit.
+func NewLimitedReader(r io.Reader, limit int64) io.Reader {
+
+	if limit <= 0 {
+		return r
+	}
+
+	return &limitedReader{r: r, remaining: limit}
+}
+
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+
+	// read one byte past the limit, to tell a reader ending right at it from one going over
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return 0, ErrTooLarge
+	}
+
+	return n, err
+}
+
+// NewLimitedWriter returns a writer to w that fails with ErrTooLarge instead of writing more than
+// limit bytes to it in total. A limit of 0 means no limit.
+func NewLimitedWriter(w io.Writer, limit int64) io.Writer {
+
+	if limit <= 0 {
+		return w
+	}
+
+	return &limitedWriter{w: w, remaining: limit}
+}
+
+type limitedWriter struct {
+	w         io.Writer
+	remaining int64
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+
+	if int64(len(p)) > l.remaining {
+		return 0, ErrTooLarge
+	}
+
+	n, err := l.w.Write(p)
+	l.remaining -= int64(n)
+
+	return n, err
+}
@@ -0,0 +1,79 @@
+package util
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadAllLimited(t *testing.T) {
+
+	data, err := ReadAllLimited(bytes.NewReader([]byte("chart")), 5)
+
+	assert.Nil(t, err, "expected nil err")
+	assert.Equal(t, []byte("chart"), data)
+}
+
+func TestReadAllLimited_TooLarge(t *testing.T) {
+
+	_, err := ReadAllLimited(bytes.NewReader([]byte("charts")), 5)
+
+	assert.Equal(t, ErrTooLarge, err)
+}
+
+func TestReadAllLimited_NoLimit(t *testing.T) {
+
+	data, err := ReadAllLimited(bytes.NewReader([]byte("charts")), 0)
+
+	assert.Nil(t, err, "expected nil err")
+	assert.Equal(t, []byte("charts"), data)
+}
+
+func TestNewLimitedReader(t *testing.T) {
+
+	data, err := ioutil.ReadAll(NewLimitedReader(bytes.NewReader([]byte("chart")), 5))
+
+	assert.Nil(t, err, "expected nil err")
+	assert.Equal(t, []byte("chart"), data)
+}
+
+func TestNewLimitedReader_TooLarge(t *testing.T) {
+
+	_, err := ioutil.ReadAll(NewLimitedReader(bytes.NewReader([]byte("charts")), 5))
+
+	assert.Equal(t, ErrTooLarge, err)
+}
+
+func TestNewLimitedReader_NoLimit(t *testing.T) {
+
+	data, err := ioutil.ReadAll(NewLimitedReader(bytes.NewReader([]byte("charts")), 0))
+
+	assert.Nil(t, err, "expected nil err")
+	assert.Equal(t, []byte("charts"), data)
+}
+
+func TestNewLimitedWriter(t *testing.T) {
+
+	buf := &bytes.Buffer{}
+	w := NewLimitedWriter(buf, 5)
+
+	_, err := w.Write([]byte("cha"))
+	assert.Nil(t, err, "expected nil err")
+	_, err = w.Write([]byte("rt"))
+	assert.Nil(t, err, "expected nil err")
+	assert.Equal(t, "chart", buf.String())
+}
+
+func TestNewLimitedWriter_TooLarge(t *testing.T) {
+
+	buf := &bytes.Buffer{}
+	w := NewLimitedWriter(buf, 5)
+
+	w.Write([]byte("cha"))
+	_, err := w.Write([]byte("rts"))
+
+	assert.Equal(t, ErrTooLarge, err)
+	assert.Equal(t, "cha", buf.String(), "expected nothing past the limit written")
+}
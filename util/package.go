@@ -0,0 +1,185 @@
+package util
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+)
+
+var (
+	// ErrNotChartSource is returned when a tar stream doesn't contain a chart source directory
+	ErrNotChartSource = errors.New("tar does not contain a chart directory with a " + ChartMetadataFilename)
+)
+
+// IsGzip returns whether the data starts like a gzip stream, as a packaged chart does
+func IsGzip(data []byte) bool {
+	return len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b
+}
+
+// IsTar returns whether the data starts like an uncompressed tar stream
+func IsTar(data []byte) bool {
+	return len(data) >= 262 && string(data[257:262]) == "ustar"
+}
+
+// TarFile is a regular file read from a tar stream
+type TarFile struct {
+	Name   string
+	Header *tar.Header
+	Data   []byte
+}
+
+// ReadTarFiles reads the regular files of an uncompressed tar stream, in order. Names are
+// cleaned and relative to the tar's root, files outside of it are an error. A file larger
+// than maxFileSize fails with ErrTooLarge before it is read, 0 means no limit.
+func ReadTarFiles(r io.Reader, maxFileSize int64) ([]*TarFile, error) {
+
+	files := []*TarFile{}
+	err := WalkTar(r, maxFileSize, func(name string, header *tar.Header, f io.Reader) error {
+		data, err := ioutil.ReadAll(f)
+		if err == ErrTooLarge {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("invalid tar: %s", err.Error())
+		}
+		files = append(files, &TarFile{Name: name, Header: header, Data: data})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// WalkTar calls fn for every regular file of an uncompressed tar stream as it is read, with
+// names cleaned like ReadTarFiles does. A file larger than maxFileSize fails with ErrTooLarge
+// before fn is called, 0 means no limit.
+func WalkTar(r io.Reader, maxFileSize int64, fn func(name string, header *tar.Header, r io.Reader) error) error {
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err == ErrTooLarge {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("invalid tar: %s", err.Error())
+		}
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+			continue
+		}
+
+		name := path.Clean(strings.TrimPrefix(header.Name, "/"))
+		if name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("invalid tar: %s is outside the tar's root", header.Name)
+		}
+
+		if maxFileSize > 0 && header.Size > maxFileSize {
+			return ErrTooLarge
+		}
+
+		err = fn(name, header, tr)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// PackageChart packages a chart source directory, given as an uncompressed tar, into a chart
+// archive like helm package does. The tar holds the chart's files either at its root or in
+// a single top level directory. Like the archive helm builds, the packaged files are placed
+// in a directory named after the chart. .helmignore files are not applied.
+func PackageChart(r io.Reader) ([]byte, *ChartMetadata, error) {
+
+	buf := &bytes.Buffer{}
+	md, err := WriteChartPackage(buf, r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return buf.Bytes(), md, nil
+}
+
+// WriteChartPackage packages a chart source directory like PackageChart, writing the chart
+// archive to w as it is built.
+func WriteChartPackage(w io.Writer, r io.Reader) (*ChartMetadata, error) {
+
+	entries, err := ReadTarFiles(r, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// the chart's root is wherever its Chart.yaml is, the tar's root or a directory in it
+	root := ""
+	var md *ChartMetadata
+	for _, e := range entries {
+		if path.Base(e.Name) != ChartMetadataFilename || strings.Count(e.Name, "/") > 1 {
+			continue
+		}
+		if md != nil && strings.Contains(e.Name, "/") {
+			continue
+		}
+
+		md, err = parseChartMetadata(e.Data)
+		if err != nil {
+			return nil, err
+		}
+		root = strings.TrimSuffix(e.Name, ChartMetadataFilename)
+	}
+	if md == nil {
+		return nil, ErrNotChartSource
+	}
+
+	files := map[string]*TarFile{}
+	names := []string{}
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name, root) {
+			continue
+		}
+		name := strings.TrimPrefix(e.Name, root)
+		if _, ok := files[name]; !ok {
+			names = append(names, name)
+		}
+		files[name] = e
+	}
+	sort.Strings(names)
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, name := range names {
+		e := files[name]
+		err := tw.WriteHeader(&tar.Header{
+			Name:     md.Name + "/" + name,
+			Mode:     e.Header.Mode,
+			Size:     int64(len(e.Data)),
+			ModTime:  e.Header.ModTime,
+			Typeflag: tar.TypeReg,
+		})
+		if err == nil {
+			_, err = tw.Write(e.Data)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = tw.Close()
+	if err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return md, nil
+}
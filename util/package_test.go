@@ -0,0 +1,165 @@
+package util
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPackageChart(t *testing.T) {
+
+	source := testTar(t, map[string]string{
+		"nginx/Chart.yaml":                "name: nginx\nversion: 1.2.0\n",
+		"nginx/values.yaml":               "replicas: 1\n",
+		"nginx/templates/deployment.yaml": "kind: Deployment\n",
+	})
+
+	// run
+	chart, md, err := PackageChart(bytes.NewReader(source))
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+	if assert.NotNil(t, md, "expected metadata") {
+		assert.Equal(t, "nginx-1.2.0.tgz", md.ChartFilename())
+	}
+	assert.True(t, IsGzip(chart), "expected a gzipped archive")
+
+	files, err := ReadChartFiles(chart)
+	assert.Nil(t, err, "expected nil err")
+	assert.Equal(t, map[string][]byte{
+		"Chart.yaml":                []byte("name: nginx\nversion: 1.2.0\n"),
+		"values.yaml":               []byte("replicas: 1\n"),
+		"templates/deployment.yaml": []byte("kind: Deployment\n"),
+	}, files)
+}
+
+func TestWriteChartPackage_TooLarge(t *testing.T) {
+
+	source := testTar(t, map[string]string{
+		"nginx/Chart.yaml":  "name: nginx\nversion: 1.2.0\n",
+		"nginx/values.yaml": "replicas: 1\n",
+	})
+
+	// run
+	_, err := WriteChartPackage(NewLimitedWriter(ioutil.Discard, 16), bytes.NewReader(source))
+
+	// check
+	assert.Equal(t, ErrTooLarge, err)
+}
+
+func TestPackageChart_RootDirectory(t *testing.T) {
+
+	source := testTar(t, map[string]string{
+		"Chart.yaml":  "name: nginx\nversion: 1.2.0\n",
+		"values.yaml": "replicas: 1\n",
+	})
+
+	// run
+	chart, _, err := PackageChart(bytes.NewReader(source))
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+	md, err := LoadChartMetadata(chart)
+	assert.Nil(t, err, "expected nil err")
+	if assert.NotNil(t, md, "expected metadata") {
+		assert.Equal(t, "nginx", md.Name)
+	}
+}
+
+func TestPackageChart_NoChart(t *testing.T) {
+
+	source := testTar(t, map[string]string{
+		"values.yaml": "replicas: 1\n",
+	})
+
+	// run
+	_, _, err := PackageChart(bytes.NewReader(source))
+
+	// check
+	assert.Equal(t, ErrNotChartSource, err)
+}
+
+func TestPackageChart_OutsideChart(t *testing.T) {
+
+	source := testTar(t, map[string]string{
+		"Chart.yaml":     "name: nginx\nversion: 1.2.0\n",
+		"../values.yaml": "replicas: 1\n",
+	})
+
+	// run
+	_, _, err := PackageChart(bytes.NewReader(source))
+
+	// check
+	assert.Error(t, err, "expected error")
+}
+
+func TestReadTarFiles_TooLarge(t *testing.T) {
+
+	source := testTar(t, map[string]string{
+		"a-1.0.0.tgz": "0123456789",
+	})
+
+	// run
+	_, err := ReadTarFiles(bytes.NewReader(source), 5)
+
+	// check
+	assert.Equal(t, ErrTooLarge, err)
+}
+
+func TestWalkTar(t *testing.T) {
+
+	source := testTar(t, map[string]string{
+		"charts/a-1.0.0.tgz": "chart",
+	})
+
+	// run
+	names := []string{}
+	contents := []string{}
+	err := WalkTar(bytes.NewReader(source), 5, func(name string, header *tar.Header, r io.Reader) error {
+		data, err := ioutil.ReadAll(r)
+		names = append(names, name)
+		contents = append(contents, string(data))
+		return err
+	})
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+	assert.Equal(t, []string{"charts/a-1.0.0.tgz"}, names)
+	assert.Equal(t, []string{"chart"}, contents)
+}
+
+func TestIsTar(t *testing.T) {
+
+	assert.True(t, IsTar(testTar(t, map[string]string{"Chart.yaml": ""})))
+	assert.False(t, IsTar([]byte{0x1f, 0x8b}))
+}
+
+func testTar(t *testing.T, files map[string]string) []byte {
+
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for name, content := range files {
+		err := tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(content)),
+			Typeflag: tar.TypeReg,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tw.Write([]byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
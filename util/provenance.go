@@ -0,0 +1,117 @@
+package util
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/clearsign"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	// ProvenanceExtension is the extension of a chart's provenance file, appended to the chart filename
+	ProvenanceExtension = ".prov"
+)
+
+// ProvenanceVerifier verifies chart provenance files against a pgp keyring
+type ProvenanceVerifier struct {
+	keyring openpgp.EntityList
+}
+
+// Verification is the result of a successful provenance check
+type Verification struct {
+	SignedBy string
+	Digest   string
+}
+
+// NewProvenanceVerifier loads a binary or armored public keyring from path
+func NewProvenanceVerifier(path string) (*ProvenanceVerifier, error) {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading keyring: %s", err.Error())
+	}
+
+	keyring, err := openpgp.ReadKeyRing(bytes.NewReader(data))
+	if err != nil {
+		keyring, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed reading keyring: %s", err.Error())
+	}
+
+	return &ProvenanceVerifier{keyring: keyring}, nil
+}
+
+// NewProvenanceVerifierFromKeyring creates a ProvenanceVerifier from an already loaded keyring
+func NewProvenanceVerifierFromKeyring(keyring openpgp.EntityList) *ProvenanceVerifier {
+	return &ProvenanceVerifier{keyring: keyring}
+}
+
+// Verify checks that prov is signed by a key in the keyring and that it records the
+// digest of the chart archive under filename
+func (v *ProvenanceVerifier) Verify(chart []byte, filename string, prov []byte) (*Verification, error) {
+	return v.VerifyDigest(Digest(chart), filename, prov)
+}
+
+// VerifyDigest is Verify for a chart archive known by its hex encoded sha256 digest
+func (v *ProvenanceVerifier) VerifyDigest(chartDigest string, filename string, prov []byte) (*Verification, error) {
+
+	block, _ := clearsign.Decode(prov)
+	if block == nil {
+		return nil, errors.New("provenance file is not a pgp signed message")
+	}
+
+	signer, err := openpgp.CheckDetachedSignature(
+		v.keyring,
+		bytes.NewReader(block.Bytes),
+		block.ArmoredSignature.Body)
+	if err != nil {
+		return nil, fmt.Errorf("provenance signature invalid: %s", err.Error())
+	}
+
+	// the signed message is the chart's Chart.yaml followed by the file digests
+	parts := bytes.Split(block.Plaintext, []byte("\n...\n"))
+	if len(parts) < 2 {
+		return nil, errors.New("provenance file has no file digests")
+	}
+	sums := struct {
+		Files map[string]string `yaml:"files"`
+	}{}
+	err = yaml.Unmarshal(parts[1], &sums)
+	if err != nil {
+		return nil, fmt.Errorf("provenance file digests invalid: %s", err.Error())
+	}
+
+	digest := "sha256:" + chartDigest
+	expected, ok := sums.Files[filepath.Base(filename)]
+	if !ok {
+		return nil, fmt.Errorf("provenance file has no digest for %s", filepath.Base(filename))
+	}
+	if expected != digest {
+		return nil, fmt.Errorf("provenance digest mismatch for %s: signed %s, uploaded %s", filepath.Base(filename), expected, digest)
+	}
+
+	return &Verification{
+		SignedBy: signerName(signer),
+		Digest:   digest,
+	}, nil
+}
+
+func signerName(signer *openpgp.Entity) string {
+	names := []string{}
+	for name := range signer.Identities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		return fmt.Sprintf("%X", signer.PrimaryKey.Fingerprint)
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,104 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/clearsign"
+)
+
+func TestProvenanceVerifier_Verify(t *testing.T) {
+
+	signer := testSigner(t, "release")
+	chart := []byte("chart archive")
+
+	v := NewProvenanceVerifierFromKeyring(openpgp.EntityList{signer})
+
+	// run
+	result, err := v.Verify(chart, "my-chart-1.0.0.tgz", testProvenance(t, signer, "my-chart-1.0.0.tgz", chart))
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+	if assert.NotNil(t, result, "expected verification") {
+		assert.Equal(t, "release <release@example.com>", result.SignedBy)
+		assert.Equal(t, "sha256:"+Digest(chart), result.Digest)
+	}
+}
+
+func TestProvenanceVerifier_Verify_UnknownSigner(t *testing.T) {
+
+	trusted := testSigner(t, "release")
+	untrusted := testSigner(t, "someone")
+	chart := []byte("chart archive")
+
+	v := NewProvenanceVerifierFromKeyring(openpgp.EntityList{trusted})
+
+	// run
+	_, err := v.Verify(chart, "my-chart-1.0.0.tgz", testProvenance(t, untrusted, "my-chart-1.0.0.tgz", chart))
+
+	// check
+	if assert.Error(t, err, "expected error") {
+		assert.Contains(t, err.Error(), "signature invalid")
+	}
+}
+
+func TestProvenanceVerifier_Verify_DigestMismatch(t *testing.T) {
+
+	signer := testSigner(t, "release")
+
+	v := NewProvenanceVerifierFromKeyring(openpgp.EntityList{signer})
+
+	// run
+	_, err := v.Verify(
+		[]byte("tampered archive"),
+		"my-chart-1.0.0.tgz",
+		testProvenance(t, signer, "my-chart-1.0.0.tgz", []byte("chart archive")))
+
+	// check
+	if assert.Error(t, err, "expected error") {
+		assert.Contains(t, err.Error(), "digest mismatch")
+	}
+}
+
+func TestProvenanceVerifier_Verify_NotSigned(t *testing.T) {
+
+	v := NewProvenanceVerifierFromKeyring(openpgp.EntityList{})
+
+	// run
+	_, err := v.Verify([]byte("chart archive"), "my-chart-1.0.0.tgz", []byte("name: my-chart"))
+
+	// check
+	if assert.Error(t, err, "expected error") {
+		assert.Contains(t, err.Error(), "not a pgp signed message")
+	}
+}
+
+//
+// helpers
+//
+
+func testSigner(t *testing.T, name string) *openpgp.Entity {
+	entity, err := openpgp.NewEntity(name, "", name+"@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entity
+}
+
+// testProvenance builds a provenance file the way helm package --sign does
+func testProvenance(t *testing.T, signer *openpgp.Entity, filename string, chart []byte) []byte {
+	message := fmt.Sprintf("name: my-chart\nversion: 1.0.0\n\n...\nfiles:\n  %s: sha256:%s\n", filename, Digest(chart))
+
+	buf := &bytes.Buffer{}
+	w, err := clearsign.Encode(buf, signer.PrivateKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte(message))
+	w.Close()
+
+	return buf.Bytes()
+}
@@ -0,0 +1,428 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// OCIManifestMediaType is the media type of an oci image manifest
+	OCIManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+)
+
+// RegistryUtil is a minimal client for the oci distribution api
+type RegistryUtil interface {
+	Catalog() ([]string, error)
+	Tags(repository string) ([]string, error)
+	GetManifest(repository string, reference string) ([]byte, error)
+	PutManifest(repository string, reference string, manifest []byte) error
+	DeleteManifest(repository string, digest string) error
+	GetBlob(repository string, digest string) ([]byte, error)
+	PushBlob(repository string, data []byte) (string, error)
+}
+
+type registryUtilImpl struct {
+	Debug bool
+
+	baseURL  string
+	username string
+	password string
+	client   *http.Client
+
+	// bearer tokens by scope, and the scope last asked for by each repository
+	tokensLock *sync.Mutex
+	tokens     map[string]*registryToken
+	scopes     map[string]string
+}
+
+type registryToken struct {
+	token   string
+	expires time.Time
+}
+
+// NewRegistryUtil creates a new RegistryUtil for the registry at host. Requests taking longer
+// than timeout fail, 0 means no timeout.
+func NewRegistryUtil(host string, username string, password string, plainHTTP bool, timeout time.Duration, debug bool) RegistryUtil {
+
+	scheme := "https"
+	if plainHTTP {
+		scheme = "http"
+	}
+
+	return &registryUtilImpl{
+		Debug:      debug,
+		baseURL:    fmt.Sprintf("%s://%s/v2", scheme, host),
+		username:   username,
+		password:   password,
+		client:     &http.Client{Timeout: timeout},
+		tokensLock: &sync.Mutex{},
+		tokens:     map[string]*registryToken{},
+		scopes:     map[string]string{},
+	}
+}
+
+// Catalog lists the repositories in the registry
+func (u *registryUtilImpl) Catalog() ([]string, error) {
+
+	repositories := []string{}
+	err := u.list("/_catalog", func(body []byte) error {
+		result := struct {
+			Repositories []string `json:"repositories"`
+		}{}
+		err := json.Unmarshal(body, &result)
+		repositories = append(repositories, result.Repositories...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return repositories, nil
+}
+
+// Tags lists the tags of a repository
+func (u *registryUtilImpl) Tags(repository string) ([]string, error) {
+
+	tags := []string{}
+	err := u.list(fmt.Sprintf("/%s/tags/list", repository), func(body []byte) error {
+		result := struct {
+			Tags []string `json:"tags"`
+		}{}
+		err := json.Unmarshal(body, &result)
+		tags = append(tags, result.Tags...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return tags, nil
+}
+
+var nextLinkPattern = regexp.MustCompile(`<([^>]+)>\s*;\s*rel="?next"?`)
+
+/*
+ * get every page of a paginated list, following the Link header of each
+ * page to the next
+ */
+func (u *registryUtilImpl) list(path string, page func(body []byte) error) error {
+
+	target := u.baseURL + path
+	for target != "" {
+		body, header, err := u.doURL("GET", target, "", nil, http.StatusOK)
+		if err != nil {
+			return err
+		}
+		err = page(body)
+		if err != nil {
+			return err
+		}
+
+		target = ""
+		if match := nextLinkPattern.FindStringSubmatch(header.Get("Link")); match != nil {
+			next, err := u.resolve(match[1])
+			if err != nil {
+				return err
+			}
+			target = next.String()
+		}
+	}
+
+	return nil
+}
+
+// GetManifest fetches a manifest by tag or digest
+func (u *registryUtilImpl) GetManifest(repository string, reference string) ([]byte, error) {
+	path := fmt.Sprintf("/%s/manifests/%s", repository, reference)
+	return u.do("GET", path, "", nil, http.StatusOK)
+}
+
+// PutManifest uploads a manifest under a tag
+func (u *registryUtilImpl) PutManifest(repository string, reference string, manifest []byte) error {
+	path := fmt.Sprintf("/%s/manifests/%s", repository, reference)
+	_, err := u.do("PUT", path, OCIManifestMediaType, manifest, http.StatusCreated)
+	return err
+}
+
+// DeleteManifest deletes a manifest, and with it all its tags, by digest
+func (u *registryUtilImpl) DeleteManifest(repository string, digest string) error {
+	path := fmt.Sprintf("/%s/manifests/%s", repository, digest)
+	_, err := u.do("DELETE", path, "", nil, http.StatusAccepted)
+	return err
+}
+
+// GetBlob fetches a blob by digest
+func (u *registryUtilImpl) GetBlob(repository string, digest string) ([]byte, error) {
+	path := fmt.Sprintf("/%s/blobs/%s", repository, digest)
+	return u.do("GET", path, "", nil, http.StatusOK)
+}
+
+// PushBlob uploads a blob with a monolithic upload and returns its digest
+func (u *registryUtilImpl) PushBlob(repository string, data []byte) (string, error) {
+
+	digest := "sha256:" + Digest(data)
+
+	// skip blobs the registry already has
+	_, err := u.do("HEAD", fmt.Sprintf("/%s/blobs/%s", repository, digest), "", nil, http.StatusOK)
+	if err == nil {
+		return digest, nil
+	}
+
+	// start upload
+	resp, err := u.send("POST", u.baseURL+fmt.Sprintf("/%s/blobs/uploads/", repository), "", nil)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return "", fmt.Errorf("registry blob upload start failed: %s", resp.Status)
+	}
+
+	// complete upload
+	location, err := u.resolve(resp.Header.Get("Location"))
+	if err != nil {
+		return "", err
+	}
+	query := location.Query()
+	query.Set("digest", digest)
+	location.RawQuery = query.Encode()
+
+	resp, err = u.send("PUT", location.String(), "application/octet-stream", data)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("registry blob upload failed: %s", resp.Status)
+	}
+
+	return digest, nil
+}
+
+func (u *registryUtilImpl) do(method string, path string, contentType string, body []byte, expected int) ([]byte, error) {
+	data, _, err := u.doURL(method, u.baseURL+path, contentType, body, expected)
+	return data, err
+}
+
+func (u *registryUtilImpl) doURL(method string, target string, contentType string, body []byte, expected int) ([]byte, http.Header, error) {
+
+	path := strings.TrimPrefix(target, u.baseURL)
+
+	resp, err := u.send(method, target, contentType, body)
+	if err != nil {
+		log.Errorf("registry request failed: %s", err.Error())
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if u.Debug {
+		log.Debugf("registry %s %s: %s", method, path, resp.Status)
+	}
+
+	if resp.StatusCode != expected {
+		return nil, nil, &RegistryError{Method: method, Path: path, StatusCode: resp.StatusCode}
+	}
+
+	return data, resp.Header, nil
+}
+
+/*
+ * send a request, authenticating with a bearer token when the registry
+ * challenges for one. The token is fetched from the challenge's realm, with
+ * the basic credentials if there are any, and reused for its scope.
+ */
+func (u *registryUtilImpl) send(method string, target string, contentType string, body []byte) (*http.Response, error) {
+
+	repository := registryRepository(target)
+
+	u.tokensLock.Lock()
+	token := u.tokens[u.scopes[repository]]
+	u.tokensLock.Unlock()
+	if token != nil && time.Now().After(token.expires) {
+		token = nil
+	}
+
+	resp, err := u.sendWithToken(method, target, contentType, body, token)
+	if err != nil {
+		return nil, err
+	}
+
+	challenge := resp.Header.Get("WWW-Authenticate")
+	if resp.StatusCode != http.StatusUnauthorized || !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	token, scope, err := u.fetchToken(challenge)
+	if err != nil {
+		return nil, err
+	}
+	u.tokensLock.Lock()
+	u.tokens[scope] = token
+	u.scopes[repository] = scope
+	u.tokensLock.Unlock()
+
+	return u.sendWithToken(method, target, contentType, body, token)
+}
+
+func (u *registryUtilImpl) sendWithToken(method string, target string, contentType string, body []byte, token *registryToken) (*http.Response, error) {
+
+	req, err := u.newRequest(method, target, contentType, body)
+	if err != nil {
+		return nil, err
+	}
+	if method == "GET" && strings.Contains(target, "/manifests/") {
+		req.Header.Set("Accept", OCIManifestMediaType)
+	}
+	if token != nil {
+		req.Header.Set("Authorization", "Bearer "+token.token)
+	}
+
+	return u.client.Do(req)
+}
+
+var challengeParamPattern = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// get a token for a bearer challenge, returning it along with the scope it is for
+func (u *registryUtilImpl) fetchToken(challenge string) (*registryToken, string, error) {
+
+	params := map[string]string{}
+	for _, match := range challengeParamPattern.FindAllStringSubmatch(challenge, -1) {
+		params[match[1]] = match[2]
+	}
+	if params["realm"] == "" {
+		return nil, "", fmt.Errorf("registry bearer challenge without realm: %s", challenge)
+	}
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil {
+		return nil, "", err
+	}
+	query := realm.Query()
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	if params["scope"] != "" {
+		query.Set("scope", params["scope"])
+	}
+	realm.RawQuery = query.Encode()
+
+	req, err := u.newRequest("GET", realm.String(), "", nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("registry token request failed: %s", resp.Status)
+	}
+
+	result := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid registry token response: %s", err.Error())
+	}
+	if result.Token == "" {
+		result.Token = result.AccessToken
+	}
+	if result.Token == "" {
+		return nil, "", fmt.Errorf("registry token response without a token")
+	}
+
+	// tokens without an expiry are good for a minute, they're renewed a little early
+	expiresIn := time.Duration(result.ExpiresIn) * time.Second
+	if expiresIn <= 0 {
+		expiresIn = time.Minute
+	}
+
+	return &registryToken{
+		token:   result.Token,
+		expires: time.Now().Add(expiresIn - expiresIn/10),
+	}, params["scope"], nil
+}
+
+// the repository a registry url is about, empty for the catalog
+func registryRepository(target string) string {
+
+	parsed, err := url.Parse(target)
+	if err != nil {
+		return ""
+	}
+	path := strings.TrimPrefix(parsed.Path, "/v2/")
+	for _, sep := range []string{"/manifests/", "/blobs/", "/tags/"} {
+		if n := strings.Index(path, sep); n >= 0 {
+			return path[:n]
+		}
+	}
+
+	return ""
+}
+
+func (u *registryUtilImpl) newRequest(method string, url string, contentType string, body []byte) (*http.Request, error) {
+
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if u.username != "" {
+		req.SetBasicAuth(u.username, u.password)
+	}
+
+	return req, nil
+}
+
+// upload locations may be relative to the registry host
+func (u *registryUtilImpl) resolve(location string) (*url.URL, error) {
+
+	base, err := url.Parse(u.baseURL)
+	if err != nil {
+		return nil, err
+	}
+	ref, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+
+	return base.ResolveReference(ref), nil
+}
+
+// RegistryError is returned when the registry responds with an unexpected status
+type RegistryError struct {
+	Method     string
+	Path       string
+	StatusCode int
+}
+
+func (e *RegistryError) Error() string {
+	return fmt.Sprintf("registry %s %s returned %d", e.Method, e.Path, e.StatusCode)
+}
+
+// NotFound returns true if the registry reported the resource missing
+func (e *RegistryError) NotFound() bool {
+	return e.StatusCode == http.StatusNotFound
+}
@@ -0,0 +1,95 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryUtil_Catalog_Paginated(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Query().Get("last") {
+		case "":
+			w.Header().Set("Link", `</v2/_catalog?last=charts%2Fa&n=1>; rel="next"`)
+			json.NewEncoder(w).Encode(map[string][]string{"repositories": {"charts/a"}})
+		case "charts/a":
+			json.NewEncoder(w).Encode(map[string][]string{"repositories": {"charts/b"}})
+		}
+	}))
+	defer server.Close()
+
+	u := NewRegistryUtil(strings.TrimPrefix(server.URL, "http://"), "", "", true, 0, false)
+
+	// run
+	repositories, err := u.Catalog()
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+	assert.Equal(t, []string{"charts/a", "charts/b"}, repositories)
+}
+
+func TestRegistryUtil_Tags_Paginated(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("last") == "" {
+			w.Header().Set("Link", `<http://`+req.Host+`/v2/charts/a/tags/list?last=1.0.0&n=1>; rel="next"`)
+			json.NewEncoder(w).Encode(map[string][]string{"tags": {"1.0.0"}})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string][]string{"tags": {"1.1.0"}})
+	}))
+	defer server.Close()
+
+	u := NewRegistryUtil(strings.TrimPrefix(server.URL, "http://"), "", "", true, 0, false)
+
+	// run
+	tags, err := u.Tags("charts/a")
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+	assert.Equal(t, []string{"1.0.0", "1.1.0"}, tags)
+}
+
+func TestRegistryUtil_BearerChallenge(t *testing.T) {
+
+	tokenRequests := 0
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/token" {
+			tokenRequests++
+			user, password, _ := req.BasicAuth()
+			assert.Equal(t, "user", user)
+			assert.Equal(t, "secret", password)
+			assert.Equal(t, "repository:charts/a:pull", req.URL.Query().Get("scope"))
+			json.NewEncoder(w).Encode(map[string]interface{}{"token": "abc", "expires_in": 300})
+			return
+		}
+		if req.Header.Get("Authorization") != "Bearer abc" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(
+				`Bearer realm="%s/token",service="registry",scope="repository:charts/a:pull"`, server.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("manifest"))
+	}))
+	defer server.Close()
+
+	u := NewRegistryUtil(strings.TrimPrefix(server.URL, "http://"), "user", "secret", true, 0, false)
+
+	// run
+	first, err := u.GetManifest("charts/a", "1.0.0")
+	assert.Nil(t, err, "expected nil err")
+	second, err := u.GetManifest("charts/a", "1.1.0")
+	assert.Nil(t, err, "expected nil err")
+
+	// check
+	assert.Equal(t, []byte("manifest"), first)
+	assert.Equal(t, []byte("manifest"), second)
+	assert.Equal(t, 1, tokenRequests, "expected token reused for its scope")
+}
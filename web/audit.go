@@ -0,0 +1,65 @@
+package web
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo"
+	"github.com/zlangbert/hrp/audit"
+	"github.com/zlangbert/hrp/util"
+)
+
+func newAuditEvent(c *context, action audit.Action) *audit.Event {
+
+	event := &audit.Event{
+		Action:     action,
+		Repository: c.repo,
+		ClientIP:   c.RealIP(),
+	}
+	if c.identity != nil {
+		event.Identity = c.identity.Name
+	}
+
+	return event
+}
+
+/*
+ * record the outcome of a mutation, if auditing is enabled
+ */
+func recordAudit(c *context, event *audit.Event, err error) {
+
+	if c.audit == nil {
+		return
+	}
+
+	event.Outcome = audit.OutcomeSuccess
+	if err != nil {
+		event.Outcome = audit.OutcomeFailure
+		event.Error = err.Error()
+		if httpErr, ok := err.(*echo.HTTPError); ok {
+			if httpErr.Code == http.StatusUnauthorized || httpErr.Code == http.StatusForbidden {
+				event.Outcome = audit.OutcomeDenied
+			}
+		}
+	}
+
+	c.audit.Log(event)
+}
+
+/*
+ * check the index for an existing chart version, so replacing uploads are
+ * audited as overwrites
+ */
+func chartExists(c *context, md *util.ChartMetadata) bool {
+
+	data, err := c.backend.GetIndex()
+	if err != nil {
+		return false
+	}
+
+	index, err := util.ParseIndex(data)
+	if err != nil {
+		return false
+	}
+
+	return index.Get(md.Name, md.Version) != nil
+}
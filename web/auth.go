@@ -0,0 +1,85 @@
+package web
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo"
+	"github.com/zlangbert/hrp/auth"
+	"github.com/zlangbert/hrp/util"
+)
+
+/*
+ * resolve the identity of the request with the configured authenticators,
+ * requests without credentials are anonymous
+ */
+func authenticate(h echo.HandlerFunc) echo.HandlerFunc {
+	return func(ec echo.Context) error {
+		c := ec.(*context)
+
+		for _, authenticator := range c.authenticators {
+			identity, err := authenticator.Authenticate(c.Request())
+			if err != nil {
+				return unauthorized(c, err.Error())
+			}
+			if identity != nil {
+				c.identity = identity
+				break
+			}
+		}
+
+		return h(c)
+	}
+}
+
+/*
+ * check the request's identity has the permission on the chart, everything
+ * is allowed when no policy is configured
+ */
+func authorize(c *context, permission auth.Permission, chart string) error {
+
+	if c.policy == nil || c.policy.Allowed(c.identity, permission, chart) {
+		return nil
+	}
+
+	if c.identity == nil {
+		return unauthorized(c, "authentication required")
+	}
+
+	return echo.NewHTTPError(
+		http.StatusForbidden,
+		"not allowed to "+string(permission)+" "+chart)
+}
+
+func unauthorized(c *context, message string) error {
+
+	challenge := `Basic realm="hrp"`
+	if c.cfg.JWT.Issuer != "" {
+		challenge = `Bearer realm="hrp", ` + challenge
+	}
+	c.Response().Header().Set(echo.HeaderWWWAuthenticate, challenge)
+
+	return echo.NewHTTPError(http.StatusUnauthorized, message)
+}
+
+/*
+ * drop the charts the request's identity can't read from an index
+ */
+func filterIndex(c *context, data []byte) ([]byte, error) {
+
+	if c.policy == nil {
+		return data, nil
+	}
+
+	index, err := util.ParseIndex(data)
+	if err != nil {
+		return nil, err
+	}
+
+	for name := range index.Entries {
+		if !c.policy.Allowed(c.identity, auth.PermissionRead, name) {
+			delete(index.Entries, name)
+		}
+	}
+
+	return index.Marshal()
+}
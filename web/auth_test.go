@@ -0,0 +1,198 @@
+package web
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+	"github.com/zlangbert/hrp/auth"
+	"github.com/zlangbert/hrp/backend"
+	"github.com/zlangbert/hrp/util"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestFilterIndex(t *testing.T) {
+
+	policy, err := auth.ParsePolicy([]byte("rules:\n- groups: [payments]\n  charts: ['payments-*']\n  permissions: [read]\n"))
+	assert.Nil(t, err, "expected nil err")
+
+	c := &context{policy: policy, identity: &auth.Identity{Name: "alice", Groups: []string{"payments"}}}
+	data := []byte(`apiVersion: v1
+entries:
+  payments-api:
+  - name: payments-api
+    version: 1.0.0
+    kubeVersion: '>=1.10'
+    dependencies:
+    - name: redis
+      version: ^3.0.0
+    urls:
+    - payments-api-1.0.0.tgz
+  ledger:
+  - name: ledger
+    version: 1.0.0
+    urls:
+    - ledger-1.0.0.tgz
+`)
+
+	// run
+	out, err := filterIndex(c, data)
+
+	// check
+	assert.Nil(t, err, "expected nil err")
+	index, _ := util.ParseIndex(out)
+	assert.Empty(t, index.Entries["ledger"], "expected unreadable chart dropped")
+	if assert.Len(t, index.Entries["payments-api"], 1) {
+		assert.Equal(t, ">=1.10", index.Entries["payments-api"][0].Extra["kubeVersion"])
+		assert.NotNil(t, index.Entries["payments-api"][0].Extra["dependencies"], "expected dependencies kept")
+	}
+}
+
+func TestIndex_Authorized(t *testing.T) {
+
+	e := testAuthServer(t, newMemoryBackend())
+
+	// run
+	rec := serveAs(e, "alice", http.MethodGet, "/index.yaml", nil, "")
+
+	// check
+	assert.Equal(t, http.StatusOK, rec.Code)
+	index, err := util.ParseIndex(rec.Body.Bytes())
+	assert.Nil(t, err, "expected nil err")
+	assert.NotEmpty(t, index.Entries["payments-api"], "expected readable chart listed")
+	assert.Empty(t, index.Entries["ledger"], "expected unreadable chart dropped")
+}
+
+func TestIndex_Anonymous(t *testing.T) {
+
+	e := testAuthServer(t, newMemoryBackend())
+
+	// run
+	rec := serveAs(e, "", http.MethodGet, "/index.yaml", nil, "")
+
+	// check
+	assert.Equal(t, http.StatusOK, rec.Code)
+	index, _ := util.ParseIndex(rec.Body.Bytes())
+	assert.Empty(t, index.Entries, "expected no charts for anonymous requests")
+}
+
+func TestIndex_InvalidCredentials(t *testing.T) {
+
+	e := testAuthServer(t, newMemoryBackend())
+	req := httptest.NewRequest(http.MethodGet, "/index.yaml", nil)
+	req.SetBasicAuth("alice", "wrong-password")
+	rec := httptest.NewRecorder()
+
+	// run
+	e.ServeHTTP(rec, req)
+
+	// check
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, `Basic realm="hrp"`, rec.Header().Get(echo.HeaderWWWAuthenticate))
+}
+
+func TestGetChart_Authorized(t *testing.T) {
+
+	e := testAuthServer(t, newMemoryBackend())
+
+	// run
+	allowed := serveAs(e, "alice", http.MethodGet, "/payments-api-1.0.0.tgz", nil, "")
+	forbidden := serveAs(e, "alice", http.MethodGet, "/ledger-1.0.0.tgz", nil, "")
+	anonymous := serveAs(e, "", http.MethodGet, "/ledger-1.0.0.tgz", nil, "")
+
+	// check
+	assert.Equal(t, http.StatusOK, allowed.Code)
+	assert.Equal(t, http.StatusForbidden, forbidden.Code)
+	assert.Equal(t, http.StatusUnauthorized, anonymous.Code)
+	assert.Equal(t, `Basic realm="hrp"`, anonymous.Header().Get(echo.HeaderWWWAuthenticate))
+}
+
+func TestUploadChart_Authorized(t *testing.T) {
+
+	b := newMemoryBackend()
+	e := testAuthServer(t, b)
+
+	// run
+	allowed := serveAs(e, "alice", http.MethodPut, "/api/charts", testChart("payments-api", "1.1.0"), "application/gzip")
+	forbidden := serveAs(e, "alice", http.MethodPut, "/api/charts", testChart("ledger", "1.1.0"), "application/gzip")
+
+	// check
+	assert.Equal(t, http.StatusOK, allowed.Code)
+	assert.Equal(t, http.StatusForbidden, forbidden.Code)
+	assert.Contains(t, b.charts, "payments-api-1.1.0.tgz", "expected allowed chart stored")
+	assert.NotContains(t, b.charts, "ledger-1.1.0.tgz", "expected forbidden chart not stored")
+}
+
+func TestPutChart_BatchAuthorizedPerChart(t *testing.T) {
+
+	b := newMemoryBackend()
+	e := testAuthServer(t, b)
+	body, contentType := testUpload(
+		testPart{"chart", "payments-api-1.1.0.tgz", testChart("payments-api", "1.1.0")},
+		testPart{"chart", "ledger-1.1.0.tgz", testChart("ledger", "1.1.0")},
+	)
+
+	// run
+	rec := serveAs(e, "alice", http.MethodPost, "/chart", body, contentType)
+
+	// check
+	assert.Equal(t, http.StatusMultiStatus, rec.Code)
+	results := batchResults(rec.Body.Bytes())
+	if assert.Len(t, results, 2) {
+		assert.Equal(t, uploadStored, results[0].Status)
+		assert.Equal(t, uploadFailed, results[1].Status)
+		assert.Equal(t, "not allowed to push ledger", results[1].Error)
+	}
+	assert.NotContains(t, b.charts, "ledger-1.1.0.tgz", "expected forbidden chart not stored")
+}
+
+//
+// helpers
+//
+
+// a server holding payments-api and ledger, where alice can read and push the payments charts
+func testAuthServer(t *testing.T, b *memoryBackend) *echo.Echo {
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("alice-password"), bcrypt.MinCost)
+	policy, err := auth.ParsePolicy([]byte(fmt.Sprintf(`users:
+- name: alice
+  passwordHash: "%s"
+  groups: [payments]
+rules:
+- groups: [payments]
+  charts: ['payments-*']
+  permissions: [read, push]
+`, hash)))
+	assert.Nil(t, err, "expected nil err")
+
+	b.PutCharts([]*backend.ChartFile{
+		{Filename: "payments-api-1.0.0.tgz", File: bytes.NewReader(testChart("payments-api", "1.0.0"))},
+		{Filename: "ledger-1.0.0.tgz", File: bytes.NewReader(testChart("ledger", "1.0.0"))},
+	}, true)
+
+	e, app := testServer(testServerConfig(), b)
+	app.policy = policy
+	app.authenticators = []auth.Authenticator{policy}
+
+	return e
+}
+
+// serve the request as the user, anonymously without one
+func serveAs(e *echo.Echo, user string, method string, path string, body []byte, contentType string) *httptest.ResponseRecorder {
+
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	if contentType != "" {
+		req.Header.Set(echo.HeaderContentType, contentType)
+	}
+	if user != "" {
+		req.SetBasicAuth(user, user+"-password")
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	return rec
+}
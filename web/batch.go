@@ -0,0 +1,437 @@
+package web
+
+import (
+	"archive/tar"
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/labstack/echo"
+	"github.com/zlangbert/hrp/audit"
+	"github.com/zlangbert/hrp/backend"
+	"github.com/zlangbert/hrp/util"
+)
+
+// outcomes of a chart in a batch upload
+const (
+	uploadStored  = "stored"
+	uploadFailed  = "failed"
+	uploadAborted = "aborted"
+)
+
+// a chart read from an upload request, spooled to a temporary file as it is
+// read so uploads aren't held in memory
+type chartUpload struct {
+	filename string
+	file     *os.File
+	size     int64
+	digest   string
+	prov     []byte
+}
+
+/*
+ * copy a chart to a temporary file, held to the maximum chart size and
+ * digested on the way
+ */
+func spoolChart(filename string, r io.Reader, limit int64) (*chartUpload, error) {
+	return spoolChartFrom(filename, limit, func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+}
+
+/*
+ * spool the chart write writes, held to the maximum chart size and digested
+ * on the way
+ */
+func spoolChartFrom(filename string, limit int64, write func(w io.Writer) error) (*chartUpload, error) {
+
+	f, err := ioutil.TempFile("", "hrp-chart-")
+	if err != nil {
+		return nil, echo.NewHTTPError(
+			http.StatusInternalServerError,
+			"failed buffering chart upload")
+	}
+	u := &chartUpload{filename: filename, file: f}
+
+	hash := sha256.New()
+	size := &byteCounter{}
+	err = write(util.NewLimitedWriter(io.MultiWriter(f, hash, size), limit))
+	if err != nil {
+		u.close()
+		return nil, err
+	}
+	u.size = size.n
+	u.digest = hex.EncodeToString(hash.Sum(nil))
+
+	return u, nil
+}
+
+type byteCounter struct {
+	n int64
+}
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// a reader of the whole chart, independent of any other reader of it
+func (u *chartUpload) reader() io.Reader {
+	return io.NewSectionReader(u.file, 0, u.size)
+}
+
+func (u *chartUpload) metadata() (*util.ChartMetadata, error) {
+	return util.ReadChartMetadata(u.reader())
+}
+
+func (u *chartUpload) close() {
+	u.file.Close()
+	os.Remove(u.file.Name())
+}
+
+// the outcome of a chart in a batch upload
+type uploadResult struct {
+	Filename string   `json:"filename"`
+	Chart    string   `json:"chart,omitempty"`
+	Version  string   `json:"version,omitempty"`
+	Digest   string   `json:"digest"`
+	Status   string   `json:"status"`
+	Error    string   `json:"error,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// the charts of an upload request and how to store them
+type uploadRequest struct {
+	charts []*chartUpload
+	batch  bool
+	atomic bool
+}
+
+// remove the spooled charts
+func (req *uploadRequest) close() {
+	for _, u := range req.charts {
+		u.close()
+	}
+}
+
+/*
+ * hold the whole request body to the maximum upload size, however many
+ * charts it carries
+ */
+func limitUploadBody(c *context) {
+
+	if c.cfg.MaxUploadSize > 0 {
+		c.Request().Body = http.MaxBytesReader(c.Response(), c.Request().Body, int64(c.cfg.MaxUploadSize))
+	}
+}
+
+/*
+ * read the uploaded charts from the multipart stream, expanding tars of
+ * charts, and match them up with their provenance files by name. A single
+ * chart is matched with any provenance file, as a batch is whenever there's
+ * more than one chart or a tar. Every chart is held to the maximum chart
+ * size as it is read, and the request to the maximum upload size. The
+ * request has to be closed once its charts are stored.
+ */
+func readChartUploads(c *context) (*uploadRequest, error) {
+
+	limitUploadBody(c)
+
+	mr, err := c.Request().MultipartReader()
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "missing 'chart' param")
+	}
+
+	req := &uploadRequest{atomic: c.QueryParam("atomic") == "true"}
+	read := false
+	defer func() {
+		if !read {
+			req.close()
+		}
+	}()
+
+	limit := int64(c.cfg.MaxChartSize)
+	provs := [][]byte{}
+	provByName := map[string][]byte{}
+	parts := 0
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if isBodyTooLarge(err) {
+			return nil, uploadReadError(c, "upload", err)
+		}
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "invalid multipart form: "+err.Error())
+		}
+
+		switch part.FormName() {
+		case "chart":
+			parts++
+			charts, tarProvs, err := readChartPart(part, limit)
+			if err != nil {
+				return nil, uploadReadError(c, part.FileName(), err)
+			}
+			req.charts = append(req.charts, charts...)
+			for name, data := range tarProvs {
+				provByName[name] = data
+			}
+			if tarProvs != nil {
+				req.batch = true
+			}
+		case "prov":
+			data, err := util.ReadAllLimited(part, maxProvenanceSize)
+			if err != nil {
+				return nil, uploadReadError(c, part.FileName(), err)
+			}
+			provs = append(provs, data)
+			provByName[part.FileName()] = data
+		case "atomic":
+			value, err := util.ReadAllLimited(part, 16)
+			req.atomic = err == nil && string(value) == "true"
+		}
+	}
+
+	if parts == 0 {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "missing 'chart' param")
+	}
+	if len(req.charts) == 0 {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "no charts in upload")
+	}
+	req.batch = req.batch || parts > 1
+	read = true
+
+	if !req.batch {
+		if len(provs) > 0 {
+			req.charts[0].prov = provs[0]
+		}
+		return req, nil
+	}
+	for _, u := range req.charts {
+		u.prov = provByName[u.filename+util.ProvenanceExtension]
+	}
+
+	return req, nil
+}
+
+/*
+ * read a chart field, either a chart archive or a tar of them and their
+ * provenance files. The provenance files are nil unless it was a tar.
+ */
+func readChartPart(part *multipart.Part, limit int64) ([]*chartUpload, map[string][]byte, error) {
+
+	r := bufio.NewReader(part)
+	head, _ := r.Peek(512)
+
+	if !util.IsTar(head) {
+		u, err := spoolChart(part.FileName(), r, limit)
+		if err != nil {
+			return nil, nil, err
+		}
+		return []*chartUpload{u}, nil, nil
+	}
+
+	charts := []*chartUpload{}
+	provs := map[string][]byte{}
+	err := util.WalkTar(r, limit, func(name string, header *tar.Header, f io.Reader) error {
+		name = path.Base(name)
+		switch {
+		case strings.HasSuffix(name, util.ProvenanceExtension):
+			data, err := util.ReadAllLimited(f, maxProvenanceSize)
+			if err != nil {
+				return err
+			}
+			provs[name] = data
+		case strings.HasSuffix(name, ".tgz"):
+			u, err := spoolChart(name, f, limit)
+			if err != nil {
+				return err
+			}
+			charts = append(charts, u)
+		}
+		return nil
+	})
+	if err != nil {
+		for _, u := range charts {
+			u.close()
+		}
+		return nil, nil, err
+	}
+
+	return charts, provs, nil
+}
+
+// http.MaxBytesReader's error has no type of its own
+func isBodyTooLarge(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "http: request body too large")
+}
+
+func uploadReadError(c *context, filename string, err error) error {
+
+	switch {
+	case err == util.ErrTooLarge:
+		return echo.NewHTTPError(
+			http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("%s exceeds the maximum chart size of %s", filename, c.cfg.MaxChartSize))
+	case isBodyTooLarge(err):
+		return echo.NewHTTPError(
+			http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("upload exceeds the maximum upload size of %s", c.cfg.MaxUploadSize))
+	}
+	if httpErr, ok := err.(*echo.HTTPError); ok {
+		return httpErr
+	}
+
+	return echo.NewHTTPError(
+		http.StatusBadRequest,
+		"failed reading "+filename+": "+err.Error())
+}
+
+/*
+ * store a batch of charts, updating the index once if the backend can. A
+ * chart failing doesn't stop the others unless the batch is atomic, which
+ * stores every chart or none of them.
+ */
+func putCharts(c *context, uploads []*chartUpload, atomic bool) error {
+
+	batchBackend, ok := c.backend.(backend.BatchBackend)
+	if atomic && !ok {
+		return echo.NewHTTPError(
+			http.StatusNotImplemented,
+			"backend does not support atomic batch uploads")
+	}
+
+	events := make([]*audit.Event, len(uploads))
+	errs := make([]error, len(uploads))
+	for n, u := range uploads {
+		c.Logger().Infof("putting charts %s", u.filename)
+
+		events[n] = newAuditEvent(c, audit.ActionPush)
+		events[n].Filename = u.filename
+		events[n].Digest = "sha256:" + u.digest
+
+		errs[n] = checkChart(c, u, events[n])
+	}
+
+	// dependencies can be on other charts of the batch that passed their checks
+	batch := []*util.ChartMetadata{}
+	for n, u := range uploads {
+		if errs[n] == nil {
+			if md, err := u.metadata(); err == nil {
+				batch = append(batch, md)
+			}
+		}
+	}
+	warnings := make([][]string, len(uploads))
+	for n, u := range uploads {
+		if errs[n] == nil {
+			warnings[n], errs[n] = checkDependencies(c, u.reader(), batch)
+		}
+	}
+
+	aborted := atomic && anyFailed(errs)
+	if !aborted {
+		files := []*backend.ChartFile{}
+		stored := []int{}
+		for n, u := range uploads {
+			if errs[n] == nil {
+				files = append(files, &backend.ChartFile{
+					Filename:   u.filename,
+					File:       u.reader(),
+					Size:       u.size,
+					Provenance: u.prov,
+				})
+				stored = append(stored, n)
+			}
+		}
+
+		// a batch backend writes provenance files with their charts, so an
+		// atomic batch rolls them back along with the charts
+		var backendErrs []error
+		if ok {
+			backendErrs = batchBackend.PutCharts(files, atomic)
+		} else {
+			for _, f := range files {
+				err := c.backend.PutChart(f.Filename, f.File, f.Size)
+				if err == nil && f.Provenance != nil {
+					err = writeProvenance(c, f.Filename, f.Provenance)
+				}
+				backendErrs = append(backendErrs, err)
+			}
+		}
+
+		for i, err := range backendErrs {
+			if err != nil && err != backend.ErrBatchAborted {
+				c.Logger().Errorf("backend failed put chart %s: %s", files[i].Filename, err.Error())
+				err = echo.NewHTTPError(
+					http.StatusInternalServerError,
+					"backend failed put chart")
+			}
+			errs[stored[i]] = err
+		}
+		aborted = atomic && anyFailed(errs)
+	}
+
+	results := make([]*uploadResult, len(uploads))
+	storedCount := 0
+	for n, u := range uploads {
+		err := errs[n]
+		if err == nil && aborted {
+			err = backend.ErrBatchAborted
+		}
+		recordAudit(c, events[n], err)
+
+		results[n] = &uploadResult{
+			Filename: u.filename,
+			Chart:    events[n].Chart,
+			Version:  events[n].Version,
+			Digest:   events[n].Digest,
+			Status:   uploadStored,
+			Warnings: warnings[n],
+		}
+		switch {
+		case err == backend.ErrBatchAborted:
+			results[n].Status = uploadAborted
+			results[n].Error = err.Error()
+		case err != nil:
+			results[n].Status = uploadFailed
+			results[n].Error = err.Error()
+			if httpErr, ok := err.(*echo.HTTPError); ok {
+				results[n].Error = fmt.Sprint(httpErr.Message)
+			}
+		default:
+			storedCount++
+		}
+	}
+
+	status := http.StatusOK
+	if storedCount == 0 {
+		status = http.StatusUnprocessableEntity
+	} else if storedCount < len(uploads) {
+		status = http.StatusMultiStatus
+	}
+
+	return c.JSON(status, map[string][]*uploadResult{
+		"results": results,
+	})
+}
+
+func anyFailed(errs []error) bool {
+	for _, err := range errs {
+		if err != nil {
+			return true
+		}
+	}
+	return false
+}
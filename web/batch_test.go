@@ -0,0 +1,242 @@
+package web
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/alecthomas/units"
+	"github.com/stretchr/testify/assert"
+	"github.com/zlangbert/hrp/backend"
+)
+
+func TestPutChart_Batch(t *testing.T) {
+
+	b := newMemoryBackend()
+	e, _ := testServer(testServerConfig(), b)
+	body, contentType := testUpload(
+		testPart{"chart", "a-1.0.0.tgz", testChart("a", "1.0.0")},
+		testPart{"chart", "b-1.0.0.tgz", testChart("b", "1.0.0")},
+		testPart{"prov", "b-1.0.0.tgz.prov", []byte("signature")},
+	)
+
+	// run
+	rec := serve(e, http.MethodPost, "/chart", body, contentType)
+
+	// check
+	assert.Equal(t, http.StatusOK, rec.Code)
+	results := batchResults(rec.Body.Bytes())
+	if assert.Len(t, results, 2) {
+		assert.Equal(t, uploadStored, results[0].Status)
+		assert.Equal(t, uploadStored, results[1].Status)
+	}
+	assert.Contains(t, b.charts, "a-1.0.0.tgz", "expected chart stored")
+	assert.Contains(t, b.charts, "b-1.0.0.tgz", "expected chart stored")
+	assert.Equal(t, []byte("signature"), b.files["b-1.0.0.tgz.prov"], "expected provenance stored with its chart")
+	assert.Nil(t, b.files["a-1.0.0.tgz.prov"], "expected no provenance for the unsigned chart")
+	assert.Equal(t, int64(1), b.generation, "expected the index updated once")
+}
+
+func TestPutChart_Tar(t *testing.T) {
+
+	b := newMemoryBackend()
+	e, _ := testServer(testServerConfig(), b)
+	archive := testTar(map[string][]byte{
+		"charts/a-1.0.0.tgz":      testChart("a", "1.0.0"),
+		"charts/a-1.0.0.tgz.prov": []byte("signature"),
+	})
+	body, contentType := testUpload(testPart{"chart", "charts.tar", archive})
+
+	// run
+	rec := serve(e, http.MethodPost, "/chart", body, contentType)
+
+	// check
+	assert.Equal(t, http.StatusOK, rec.Code)
+	results := batchResults(rec.Body.Bytes())
+	if assert.Len(t, results, 1) {
+		assert.Equal(t, "a-1.0.0.tgz", results[0].Filename)
+	}
+	assert.Contains(t, b.charts, "a-1.0.0.tgz", "expected chart stored")
+	assert.Equal(t, []byte("signature"), b.files["a-1.0.0.tgz.prov"], "expected provenance matched by name")
+}
+
+func TestPutChart_BatchPartial(t *testing.T) {
+
+	b := newMemoryBackend()
+	b.failing["b-1.0.0.tgz"] = true
+	e, _ := testServer(testServerConfig(), b)
+	body, contentType := testUpload(
+		testPart{"chart", "a-1.0.0.tgz", testChart("a", "1.0.0")},
+		testPart{"chart", "b-1.0.0.tgz", testChart("b", "1.0.0")},
+	)
+
+	// run
+	rec := serve(e, http.MethodPost, "/chart", body, contentType)
+
+	// check
+	assert.Equal(t, http.StatusMultiStatus, rec.Code)
+	results := batchResults(rec.Body.Bytes())
+	if assert.Len(t, results, 2) {
+		assert.Equal(t, uploadStored, results[0].Status)
+		assert.Equal(t, uploadFailed, results[1].Status)
+	}
+	assert.Contains(t, b.charts, "a-1.0.0.tgz", "expected chart stored")
+	assert.NotContains(t, b.charts, "b-1.0.0.tgz", "expected failed chart not stored")
+}
+
+func TestPutChart_AtomicBatchBackendFailed(t *testing.T) {
+
+	b := newMemoryBackend()
+	b.failing["b-1.0.0.tgz"] = true
+	e, _ := testServer(testServerConfig(), b)
+	body, contentType := testUpload(
+		testPart{"chart", "a-1.0.0.tgz", testChart("a", "1.0.0")},
+		testPart{"prov", "a-1.0.0.tgz.prov", []byte("signature")},
+		testPart{"chart", "b-1.0.0.tgz", testChart("b", "1.0.0")},
+	)
+
+	// run
+	rec := serve(e, http.MethodPost, "/chart?atomic=true", body, contentType)
+
+	// check
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	results := batchResults(rec.Body.Bytes())
+	if assert.Len(t, results, 2) {
+		assert.Equal(t, uploadAborted, results[0].Status)
+		assert.Equal(t, backend.ErrBatchAborted.Error(), results[0].Error)
+		assert.Equal(t, uploadFailed, results[1].Status)
+	}
+	assert.Empty(t, b.charts, "expected nothing stored")
+	assert.Empty(t, b.files, "expected no provenance stored")
+	assert.Equal(t, int64(0), b.generation, "expected index untouched")
+}
+
+func TestPutChart_AtomicBatchCheckFailed(t *testing.T) {
+
+	b := newMemoryBackend()
+	e, _ := testServer(testServerConfig(), b)
+	body, contentType := testUpload(
+		testPart{"chart", "a-1.0.0.tgz", testChart("a", "1.0.0")},
+		testPart{"chart", "b-1.0.0.zip", testChart("b", "1.0.0")},
+		testPart{"atomic", "", []byte("true")},
+	)
+
+	// run
+	rec := serve(e, http.MethodPost, "/chart", body, contentType)
+
+	// check
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	results := batchResults(rec.Body.Bytes())
+	if assert.Len(t, results, 2) {
+		assert.Equal(t, uploadAborted, results[0].Status)
+		assert.Equal(t, uploadFailed, results[1].Status)
+		assert.Contains(t, results[1].Error, "invalid chart filename")
+	}
+	assert.Empty(t, b.charts, "expected nothing stored")
+	assert.Equal(t, int64(0), b.generation, "expected backend not called")
+}
+
+func TestPutChart_AtomicBatchUnsupported(t *testing.T) {
+
+	b := newMemoryBackend()
+	e, _ := testServer(testServerConfig(), &plainBackend{b})
+	body, contentType := testUpload(
+		testPart{"chart", "a-1.0.0.tgz", testChart("a", "1.0.0")},
+		testPart{"chart", "b-1.0.0.tgz", testChart("b", "1.0.0")},
+	)
+
+	// run
+	rec := serve(e, http.MethodPost, "/chart?atomic=true", body, contentType)
+
+	// check
+	assert.Equal(t, http.StatusNotImplemented, rec.Code)
+	assert.Empty(t, b.charts, "expected nothing stored")
+}
+
+func TestPutChart_MaxChartSize(t *testing.T) {
+
+	b := newMemoryBackend()
+	cfg := testServerConfig()
+	cfg.MaxChartSize = 64
+	e, _ := testServer(cfg, b)
+	body, contentType := testUpload(testPart{"chart", "a-1.0.0.tgz", testChart("a", "1.0.0")})
+
+	// run
+	rec := serve(e, http.MethodPost, "/chart", body, contentType)
+
+	// check
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	assert.Contains(t, rec.Body.String(), "a-1.0.0.tgz exceeds the maximum chart size")
+	assert.Empty(t, b.charts, "expected nothing stored")
+}
+
+func TestPutChart_MaxUploadSize(t *testing.T) {
+
+	b := newMemoryBackend()
+	chart := testChart("a", "1.0.0")
+	cfg := testServerConfig()
+	cfg.MaxUploadSize = units.Base2Bytes(len(chart) + len(chart)/2)
+	e, _ := testServer(cfg, b)
+	body, contentType := testUpload(
+		testPart{"chart", "a-1.0.0.tgz", chart},
+		testPart{"chart", "b-1.0.0.tgz", testChart("b", "1.0.0")},
+	)
+
+	// run
+	rec := serve(e, http.MethodPost, "/chart", body, contentType)
+
+	// check
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code, "expected every chart counted against the upload")
+	assert.Contains(t, rec.Body.String(), "maximum upload size")
+	assert.Empty(t, b.charts, "expected nothing stored")
+}
+
+func TestPutChart_MaxProvenanceSize(t *testing.T) {
+
+	b := newMemoryBackend()
+	e, _ := testServer(testServerConfig(), b)
+	body, contentType := testUpload(
+		testPart{"chart", "a-1.0.0.tgz", testChart("a", "1.0.0")},
+		testPart{"prov", "a-1.0.0.tgz.prov", bytes.Repeat([]byte("#"), maxProvenanceSize+1)},
+	)
+
+	// run
+	rec := serve(e, http.MethodPost, "/chart", body, contentType)
+
+	// check
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	assert.Empty(t, b.charts, "expected nothing stored")
+}
+
+//
+// helpers
+//
+
+// an uncompressed tar of the files
+func testTar(files map[string][]byte) []byte {
+
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for name, data := range files {
+		tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(data)),
+			Typeflag: tar.TypeReg,
+		})
+		tw.Write(data)
+	}
+	tw.Close()
+
+	return buf.Bytes()
+}
+
+func batchResults(body []byte) []*uploadResult {
+
+	response := map[string][]*uploadResult{}
+	json.Unmarshal(body, &response)
+
+	return response["results"]
+}
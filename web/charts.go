@@ -0,0 +1,260 @@
+package web
+
+import (
+	"container/list"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/labstack/echo"
+	"github.com/zlangbert/hrp/auth"
+	"github.com/zlangbert/hrp/util"
+)
+
+// how many bytes of extracted chart files are kept in memory
+const chartFilesCacheSize = 64 * 1024 * 1024
+
+// names helm recognizes a chart's readme by, in order of preference
+var readmeFilenames = []string{"README.md", "README.txt", "README"}
+
+// a file in a chart archive listing
+type chartFile struct {
+	Path string `json:"path"`
+	Size int    `json:"size"`
+}
+
+func listChartFiles(ec echo.Context) error {
+	c := ec.(*context)
+
+	files, err := chartVersionFiles(c)
+	if err != nil {
+		return err
+	}
+
+	listing := []chartFile{}
+	for p, data := range files {
+		listing = append(listing, chartFile{Path: p, Size: len(data)})
+	}
+	sort.Slice(listing, func(a, b int) bool {
+		return listing[a].Path < listing[b].Path
+	})
+
+	return c.JSON(http.StatusOK, map[string][]chartFile{
+		"files": listing,
+	})
+}
+
+func getChartFile(ec echo.Context) error {
+	c := ec.(*context)
+
+	files, err := chartVersionFiles(c)
+	if err != nil {
+		return err
+	}
+
+	p := strings.TrimPrefix(c.Param("*"), "/")
+	data, ok := files[p]
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "file not found in chart: "+p)
+	}
+
+	// chart files are whatever the pusher put in them, never let a browser render them
+	contentType := "application/octet-stream"
+	if utf8.Valid(data) {
+		contentType = "text/plain; charset=utf-8"
+	}
+
+	return chartFileBlob(c, contentType, data)
+}
+
+func getChartValues(ec echo.Context) error {
+	c := ec.(*context)
+
+	files, err := chartVersionFiles(c)
+	if err != nil {
+		return err
+	}
+
+	data, ok := files["values.yaml"]
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "chart has no values.yaml")
+	}
+
+	return chartFileBlob(c, "text/yaml", data)
+}
+
+func getChartReadme(ec echo.Context) error {
+	c := ec.(*context)
+
+	files, err := chartVersionFiles(c)
+	if err != nil {
+		return err
+	}
+
+	data, ok := chartReadme(files)
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "chart has no readme")
+	}
+
+	return chartFileBlob(c, "text/markdown; charset=utf-8", data)
+}
+
+// serve a file from a chart archive as exactly the given type
+func chartFileBlob(c *context, contentType string, data []byte) error {
+	c.Response().Header().Set("X-Content-Type-Options", "nosniff")
+	return c.Blob(http.StatusOK, contentType, data)
+}
+
+func chartReadme(files map[string][]byte) ([]byte, bool) {
+	for _, name := range readmeFilenames {
+		if data, ok := files[name]; ok {
+			return data, true
+		}
+	}
+	return nil, false
+}
+
+/*
+ * the files of the chart version named by the name and version params
+ */
+func chartVersionFiles(c *context) (map[string][]byte, error) {
+
+	cv, err := findChartVersion(c, c.Param("name"), c.Param("version"))
+	if err != nil {
+		return nil, err
+	}
+
+	return extractChart(c, cv)
+}
+
+/*
+ * look up a chart version in the index, if the caller can read the chart
+ */
+func findChartVersion(c *context, name string, version string) (*util.ChartVersion, error) {
+
+	err := authorize(c, auth.PermissionRead, name)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := c.backend.GetIndex()
+	if err != nil {
+		return nil, err
+	}
+	index, err := util.ParseIndex(data)
+	if err != nil {
+		return nil, err
+	}
+
+	cv := index.Get(name, version)
+	if cv == nil {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "chart version not found: "+name+" "+version)
+	}
+
+	return cv, nil
+}
+
+/*
+ * the files in a chart version's archive, extracted once and then served
+ * from the cache for as long as the archive matches its index digest
+ */
+func extractChart(c *context, cv *util.ChartVersion) (map[string][]byte, error) {
+
+	key := c.repo + "/" + cv.Filename() + "@" + cv.Digest
+	if files, ok := c.chartFiles.get(key); ok {
+		return files, nil
+	}
+
+	archive, err := c.backend.GetChart(cv.Filename())
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "chart archive not found: "+cv.Filename())
+	}
+
+	files, err := util.ReadChartFiles(archive)
+	if err == util.ErrTooLarge {
+		return nil, echo.NewHTTPError(
+			http.StatusUnprocessableEntity,
+			fmt.Sprintf("chart archive decompresses to more than %d bytes", util.MaxDecompressedChartSize))
+	}
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	// an archive that doesn't match the index can't be cached by its digest
+	if cv.Digest != "" && cv.Digest == util.Digest(archive) {
+		c.chartFiles.add(key, files)
+	}
+
+	return files, nil
+}
+
+// chartFilesCache holds the most recently extracted chart archives, up to
+// size bytes of files in total
+type chartFilesCache struct {
+	lock    sync.Mutex
+	size    int
+	used    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type chartFilesEntry struct {
+	key   string
+	files map[string][]byte
+	size  int
+}
+
+func newChartFilesCache(size int) *chartFilesCache {
+	return &chartFilesCache{
+		size:    size,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+func (c *chartFilesCache) get(key string) (map[string][]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+
+	return e.Value.(*chartFilesEntry).files, true
+}
+
+func (c *chartFilesCache) add(key string, files map[string][]byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		c.order.MoveToFront(e)
+		return
+	}
+
+	size := 0
+	for _, data := range files {
+		size += len(data)
+	}
+
+	// a chart that would push out everything else isn't worth keeping
+	if size > c.size {
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&chartFilesEntry{key: key, files: files, size: size})
+	c.used += size
+
+	for c.used > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		entry := oldest.Value.(*chartFilesEntry)
+		delete(c.entries, entry.key)
+		c.used -= entry.size
+	}
+}
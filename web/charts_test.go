@@ -0,0 +1,30 @@
+package web
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChartFilesCache_BoundedByBytes(t *testing.T) {
+
+	cache := newChartFilesCache(10)
+
+	// run
+	cache.add("a", map[string][]byte{"values.yaml": make([]byte, 4)})
+	cache.add("b", map[string][]byte{"values.yaml": make([]byte, 4)})
+	cache.get("a")
+	cache.add("c", map[string][]byte{"values.yaml": make([]byte, 4)})
+	cache.add("too-large", map[string][]byte{"values.yaml": make([]byte, 11)})
+
+	// check
+	_, ok := cache.get("a")
+	assert.True(t, ok, "expected recently used entry kept")
+	_, ok = cache.get("b")
+	assert.False(t, ok, "expected least recently used entry evicted")
+	_, ok = cache.get("c")
+	assert.True(t, ok, "expected newest entry kept")
+	_, ok = cache.get("too-large")
+	assert.False(t, ok, "expected entry larger than the cache not kept")
+	assert.Equal(t, 8, cache.used, "expected bytes of kept entries")
+}
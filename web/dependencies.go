@@ -0,0 +1,103 @@
+package web
+
+import (
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo"
+	"github.com/zlangbert/hrp/util"
+)
+
+// dependency check modes
+const (
+	dependencyCheckOff    = "off"
+	dependencyCheckWarn   = "warn"
+	dependencyCheckReject = "reject"
+)
+
+/*
+ * check that the chart's dependencies on this repository resolve to a chart
+ * version in it. Charts uploaded along with it in the batch count as being
+ * in the repository. Unresolved dependencies are returned as warnings, or
+ * rejected as an error, depending on the configured check.
+ */
+func checkDependencies(c *context, chart io.Reader, batch []*util.ChartMetadata) ([]string, error) {
+
+	if c.cfg.DependencyCheck == "" || c.cfg.DependencyCheck == dependencyCheckOff {
+		return nil, nil
+	}
+
+	dependencies, err := util.ReadChartDependencies(chart)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	url := strings.TrimSuffix(repoURL(c), "/")
+	var index *util.IndexFile
+	problems := []string{}
+	for _, dep := range dependencies {
+		if strings.TrimSuffix(dep.Repository, "/") != url {
+			continue
+		}
+
+		if index == nil {
+			index, err = dependencyIndex(c, batch)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		constraint, err := util.ParseVersionConstraint(dep.Version)
+		if strings.TrimSpace(dep.Version) == "" {
+			constraint, err = nil, nil
+		}
+		if err != nil {
+			problems = append(problems, "dependency "+dep.Name+" has an invalid version constraint "+dep.Version)
+			continue
+		}
+
+		if index.Resolve(dep.Name, constraint) == nil {
+			problems = append(problems, "dependency "+dep.Name+" "+dep.Version+" is not in this repository")
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil, nil
+	}
+	if c.cfg.DependencyCheck == dependencyCheckReject {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, strings.Join(problems, "; "))
+	}
+
+	for _, problem := range problems {
+		c.Logger().Warnf("chart upload: %s", problem)
+	}
+	return problems, nil
+}
+
+// the repository's index along with the charts of the batch being uploaded
+func dependencyIndex(c *context, batch []*util.ChartMetadata) (*util.IndexFile, error) {
+
+	data, err := c.backend.GetIndex()
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to load index")
+	}
+
+	index, err := util.ParseIndex(data)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to parse index")
+	}
+
+	for _, md := range batch {
+		index.Add(md, md.ChartFilename(), "")
+	}
+
+	return index, nil
+}
+
+// pass dependency warnings on in the response's Warning header
+func addDependencyWarnings(c *context, warnings []string) {
+	for _, warning := range warnings {
+		c.Response().Header().Add("Warning", `199 hrp "`+strings.Replace(warning, `"`, `'`, -1)+`"`)
+	}
+}
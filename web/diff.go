@@ -0,0 +1,61 @@
+package web
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo"
+	"github.com/zlangbert/hrp/diff"
+)
+
+// a diff between two chart versions
+type chartDiff struct {
+	Chart string `json:"chart"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+	*diff.ChartDiff
+}
+
+func diffChart(ec echo.Context) error {
+	c := ec.(*context)
+
+	name := c.Param("name")
+	from, to := c.QueryParam("from"), c.QueryParam("to")
+	if from == "" || to == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "missing 'from' or 'to' param")
+	}
+
+	fromVersion, err := findChartVersion(c, name, from)
+	if err != nil {
+		return err
+	}
+	toVersion, err := findChartVersion(c, name, to)
+	if err != nil {
+		return err
+	}
+
+	fromFiles, err := extractChart(c, fromVersion)
+	if err != nil {
+		return err
+	}
+	toFiles, err := extractChart(c, toVersion)
+	if err != nil {
+		return err
+	}
+
+	d, err := diff.Charts(name+"-"+from, name+"-"+to, fromFiles, toFiles)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+	}
+
+	// just the patch, for tools that read unified diffs
+	if c.QueryParam("format") == "patch" {
+		return c.Blob(http.StatusOK, "text/x-diff; charset=utf-8", []byte(d.Unified))
+	}
+
+	return c.JSON(http.StatusOK, &chartDiff{
+		Chart:     name,
+		From:      from,
+		To:        to,
+		ChartDiff: d,
+	})
+}
@@ -1,17 +1,45 @@
 package web
 
 import (
+	"bufio"
 	"github.com/labstack/echo"
+	"github.com/zlangbert/hrp/audit"
+	"github.com/zlangbert/hrp/auth"
+	"github.com/zlangbert/hrp/backend"
+	"github.com/zlangbert/hrp/util"
+	"io"
 	"net/http"
+	"path"
+	"strconv"
 )
 
+// lets clients tell whether their copy of the index is stale
+const indexGenerationHeader = "X-Hrp-Index-Generation"
+
 func health(c echo.Context) error {
 	return c.NoContent(200)
 }
 
 func index(ec echo.Context) error {
 	c := ec.(*context)
-	index, err := c.backend.GetIndex()
+
+	var index []byte
+	var err error
+	if g, ok := c.backend.(backend.GenerationalIndex); ok {
+		var generation int64
+		index, generation, err = g.GetIndexWithGeneration()
+		if err != nil {
+			return err
+		}
+		c.Response().Header().Set(indexGenerationHeader, strconv.FormatInt(generation, 10))
+	} else {
+		index, err = c.backend.GetIndex()
+		if err != nil {
+			return err
+		}
+	}
+
+	index, err = filterIndex(c, index)
 	if err != nil {
 		return err
 	}
@@ -23,6 +51,16 @@ func getChart(ec echo.Context) error {
 	c := ec.(*context)
 
 	name := c.Param("chart")
+
+	chartName, _, ok := util.ParseChartFilename(name)
+	if !ok {
+		chartName = name
+	}
+	err := authorize(c, auth.PermissionRead, chartName)
+	if err != nil {
+		return err
+	}
+
 	chart, err := c.backend.GetChart(name)
 	if err != nil {
 		return err
@@ -34,38 +72,263 @@ func getChart(ec echo.Context) error {
 func putChart(ec echo.Context) error {
 	c := ec.(*context)
 
-	file, err := c.FormFile("chart")
+	req, err := readChartUploads(c)
+	if err != nil {
+		return err
+	}
+	defer req.close()
+
+	// several charts, or a tar of them, are stored together
+	if req.batch {
+		return putCharts(c, req.charts, req.atomic)
+	}
+	upload := req.charts[0]
+
+	c.Logger().Infof("putting charts %s", upload.filename)
+
+	event := newAuditEvent(c, audit.ActionPush)
+	event.Filename = upload.filename
+	event.Digest = "sha256:" + upload.digest
+
+	err = pushChart(c, upload, event)
+	recordAudit(c, event, err)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusNotFound, "missing 'chart' param")
+		return err
 	}
 
-	c.Logger().Infof("putting charts %s", file.Filename)
+	return c.NoContent(200)
+}
+
+/*
+ * upload a chart as the raw request body, either a packaged chart or a
+ * chart source directory as an uncompressed tar that is packaged here
+ */
+func uploadChart(ec echo.Context) error {
+	c := ec.(*context)
+
+	limitUploadBody(c)
+	limit := int64(c.cfg.MaxChartSize)
 
-	src, err := file.Open()
+	r := bufio.NewReader(c.Request().Body)
+	head, err := r.Peek(512)
+	if isBodyTooLarge(err) {
+		return uploadReadError(c, "chart", err)
+	}
+
+	var upload *chartUpload
+	var md *util.ChartMetadata
+	switch {
+	case util.IsGzip(head):
+		upload, err = spoolChart("", r, limit)
+	case util.IsTar(head):
+		upload, err = spoolChartFrom("", limit, func(w io.Writer) error {
+			md, err = util.WriteChartPackage(w, util.NewLimitedReader(r, limit))
+			return err
+		})
+	default:
+		return echo.NewHTTPError(
+			http.StatusUnsupportedMediaType,
+			"body must be a packaged chart or an uncompressed tar of a chart directory")
+	}
+	if _, ok := err.(*echo.HTTPError); ok || err == util.ErrTooLarge || isBodyTooLarge(err) {
+		return uploadReadError(c, "chart", err)
+	}
 	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	defer upload.close()
+
+	if md == nil {
+		md, err = upload.metadata()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+	}
+
+	// the chart is stored under the name its metadata gives it, never anything else
+	filename := c.Param("filename")
+	if filename != "" && filename != md.ChartFilename() {
 		return echo.NewHTTPError(
-			http.StatusInternalServerError,
-			"failed opening file when uploading chart")
+			http.StatusBadRequest,
+			"chart filename must be "+md.ChartFilename())
+	}
+	upload.filename = md.ChartFilename()
+
+	c.Logger().Infof("putting charts %s", upload.filename)
+
+	event := newAuditEvent(c, audit.ActionPush)
+	event.Filename = upload.filename
+	event.Digest = "sha256:" + upload.digest
+
+	err = pushChart(c, upload, event)
+	recordAudit(c, event, err)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"filename": upload.filename,
+		"digest":   event.Digest,
+	})
+}
+
+/*
+ * authorize and store an uploaded chart and its optional provenance file,
+ * filling in the audit event with what the archive contains
+ */
+func pushChart(c *context, upload *chartUpload, event *audit.Event) error {
+
+	err := checkChart(c, upload, event)
+	if err != nil {
+		return err
 	}
-	defer src.Close()
 
-	err = c.backend.PutChart(file.Filename, src)
+	warnings, err := checkDependencies(c, upload.reader(), nil)
 	if err != nil {
+		return err
+	}
+	addDependencyWarnings(c, warnings)
+
+	// a batch backend writes the provenance file with the chart, so either
+	// both are stored or neither replaces what was there
+	batchBackend, ok := c.backend.(backend.BatchBackend)
+	if ok {
+		err = batchBackend.PutCharts([]*backend.ChartFile{{
+			Filename:   upload.filename,
+			File:       upload.reader(),
+			Size:       upload.size,
+			Provenance: upload.prov,
+		}}, true)[0]
+	} else {
+		err = c.backend.PutChart(upload.filename, upload.reader(), upload.size)
+	}
+	if err != nil {
+		c.Logger().Errorf("backend failed put chart %s: %s", upload.filename, err.Error())
 		return echo.NewHTTPError(
 			http.StatusInternalServerError,
 			"backend failed put chart")
 	}
 
-	return c.NoContent(200)
+	// the provenance file goes in once the chart is stored, so a failed
+	// upload can't replace the signature of the chart it didn't replace
+	if !ok && upload.prov != nil {
+		return writeProvenance(c, upload.filename, upload.prov)
+	}
+
+	return nil
+}
+
+/*
+ * everything an upload has to pass before it is stored: the archive's
+ * chart name is authorized and its provenance verified
+ */
+func checkChart(c *context, upload *chartUpload, event *audit.Event) error {
+
+	// charts are stored next to the index, so they can't be named anything else
+	filename := upload.filename
+	if path.Base(filename) != filename || path.Ext(filename) != ".tgz" {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid chart filename: "+filename)
+	}
+
+	md, mdErr := upload.metadata()
+	if mdErr == nil {
+		event.Chart = md.Name
+		event.Version = md.Version
+		if c.audit != nil && chartExists(c, md) {
+			event.Action = audit.ActionOverwrite
+		}
+	}
+
+	// authorize against the chart name in the archive, which the filename
+	// has to match so it can't overwrite another chart
+	if c.policy != nil {
+		if mdErr != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, mdErr.Error())
+		}
+		if filename != md.ChartFilename() {
+			return echo.NewHTTPError(
+				http.StatusBadRequest,
+				"chart filename must be "+md.ChartFilename())
+		}
+		err := authorize(c, auth.PermissionPush, md.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	if upload.prov == nil && c.cfg.ProvenanceRequired(c.repo) {
+		return echo.NewHTTPError(
+			http.StatusBadRequest,
+			"repository requires a 'prov' provenance file for every chart")
+	}
+	if upload.prov != nil {
+		if _, ok := c.backend.(backend.Store); !ok {
+			return echo.NewHTTPError(
+				http.StatusNotImplemented,
+				"backend does not support provenance files")
+		}
+		return verifyProvenance(c, filename, upload.digest, upload.prov)
+	}
+
+	return nil
+}
+
+func reindexStatus(ec echo.Context) error {
+	c := ec.(*context)
+
+	if c.reindexer == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "background reindexing is disabled")
+	}
+
+	err := authorize(c, auth.PermissionRead, auth.AllCharts)
+	if err != nil {
+		return err
+	}
+
+	status, ok := c.reindexer.Status(c.repo)
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "no background reindex has run yet")
+	}
+
+	return c.JSON(http.StatusOK, status)
 }
 
 func reindex(ec echo.Context) error {
 	c := ec.(*context)
 
-	err := c.backend.Reindex()
+	event := newAuditEvent(c, audit.ActionReindex)
+
+	err := authorize(c, auth.PermissionReindex, auth.AllCharts)
 	if err != nil {
-		return echo.NewHTTPError(500, "failed to reindex")
+		recordAudit(c, event, err)
+		return err
 	}
 
-	return c.NoContent(200)
+	// the reindex outlives the request, it is audited once it finishes
+	job, started := c.jobs.Start(c.repo, c.backend, func(job backend.ReindexJob, err error) {
+		recordAudit(c, event, err)
+	})
+	if started {
+		c.Logger().Infof("started reindex job %s", job.ID)
+	}
+
+	c.Response().Header().Set(echo.HeaderLocation, repoPath(c)+"/api/reindex/"+job.ID)
+	return c.JSON(http.StatusAccepted, job)
+}
+
+func reindexJob(ec echo.Context) error {
+	c := ec.(*context)
+
+	err := authorize(c, auth.PermissionRead, auth.AllCharts)
+	if err != nil {
+		return err
+	}
+
+	// jobs are only found through the repository they reindex
+	job, ok := c.jobs.Get(c.Param("id"))
+	if !ok || job.Repository != c.repo {
+		return echo.NewHTTPError(http.StatusNotFound, "reindex job not found")
+	}
+
+	return c.JSON(http.StatusOK, job)
 }
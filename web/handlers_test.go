@@ -0,0 +1,171 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIndex_GenerationHeader(t *testing.T) {
+
+	b := newMemoryBackend()
+	e, _ := testServer(testServerConfig(), b)
+
+	// run
+	before := serve(e, http.MethodGet, "/index.yaml", nil, "")
+	serve(e, http.MethodPut, "/api/charts", testChart("a", "1.0.0"), "application/gzip")
+	after := serve(e, http.MethodGet, "/index.yaml", nil, "")
+
+	// check
+	assert.Equal(t, http.StatusOK, before.Code)
+	assert.Equal(t, "0", before.Header().Get(indexGenerationHeader), "unexpected generation")
+	assert.Equal(t, "1", after.Header().Get(indexGenerationHeader), "expected generation bumped by the upload")
+	assert.Contains(t, after.Body.String(), "a-1.0.0.tgz")
+}
+
+func TestIndex_NoGeneration(t *testing.T) {
+
+	e, _ := testServer(testServerConfig(), &plainBackend{newMemoryBackend()})
+
+	// run
+	rec := serve(e, http.MethodGet, "/index.yaml", nil, "")
+
+	// check
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Header().Get(indexGenerationHeader), "expected no generation from a backend without one")
+}
+
+func TestUploadChart(t *testing.T) {
+
+	b := newMemoryBackend()
+	e, _ := testServer(testServerConfig(), b)
+
+	// run
+	rec := serve(e, http.MethodPut, "/api/charts", testChart("a", "1.0.0"), "application/gzip")
+
+	// check
+	assert.Equal(t, http.StatusOK, rec.Code)
+	result := map[string]string{}
+	json.Unmarshal(rec.Body.Bytes(), &result)
+	assert.Equal(t, "a-1.0.0.tgz", result["filename"], "expected chart named after its metadata")
+	assert.Contains(t, b.charts, "a-1.0.0.tgz", "expected chart stored")
+}
+
+func TestUploadChart_Filename(t *testing.T) {
+
+	b := newMemoryBackend()
+	e, _ := testServer(testServerConfig(), b)
+
+	// run
+	rec := serve(e, http.MethodPut, "/api/charts/a-1.0.0.tgz", testChart("a", "1.0.0"), "application/gzip")
+
+	// check
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, b.charts, "a-1.0.0.tgz", "expected chart stored")
+}
+
+func TestUploadChart_FilenameMismatch(t *testing.T) {
+
+	b := newMemoryBackend()
+	e, _ := testServer(testServerConfig(), b)
+
+	// run
+	rec := serve(e, http.MethodPut, "/api/charts/b-1.0.0.tgz", testChart("a", "1.0.0"), "application/gzip")
+
+	// check
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "chart filename must be a-1.0.0.tgz")
+	assert.Empty(t, b.charts, "expected nothing stored")
+}
+
+func TestUploadChart_InvalidMetadata(t *testing.T) {
+
+	b := newMemoryBackend()
+	e, _ := testServer(testServerConfig(), b)
+
+	// run
+	rec := serve(e, http.MethodPut, "/api/charts", testChartWithMetadata("a", "name: a\n"), "application/gzip")
+
+	// check
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Empty(t, b.charts, "expected nothing stored")
+}
+
+func TestUploadChart_UnsupportedBody(t *testing.T) {
+
+	e, _ := testServer(testServerConfig(), newMemoryBackend())
+
+	// run
+	rec := serve(e, http.MethodPut, "/api/charts", []byte("name: a\nversion: 1.0.0\n"), "text/yaml")
+
+	// check
+	assert.Equal(t, http.StatusUnsupportedMediaType, rec.Code)
+}
+
+func TestUploadChart_Source(t *testing.T) {
+
+	b := newMemoryBackend()
+	e, _ := testServer(testServerConfig(), b)
+	source := testTar(map[string][]byte{"a/Chart.yaml": []byte("name: a\nversion: 1.0.0\n")})
+
+	// run
+	rec := serve(e, http.MethodPut, "/api/charts", source, "application/x-tar")
+
+	// check
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, b.charts, "a-1.0.0.tgz", "expected packaged chart stored")
+}
+
+func TestUploadChart_MaxChartSize(t *testing.T) {
+
+	b := newMemoryBackend()
+	cfg := testServerConfig()
+	cfg.MaxChartSize = 64
+	e, _ := testServer(cfg, b)
+
+	// run
+	rec := serve(e, http.MethodPut, "/api/charts", testChart("a", "1.0.0"), "application/gzip")
+
+	// check
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	assert.Contains(t, rec.Body.String(), "maximum chart size")
+	assert.Empty(t, b.charts, "expected nothing stored")
+}
+
+func TestUploadChart_MaxChartSize_Source(t *testing.T) {
+
+	b := newMemoryBackend()
+	cfg := testServerConfig()
+	cfg.MaxChartSize = 64
+	e, _ := testServer(cfg, b)
+	source := testTar(map[string][]byte{
+		"a/Chart.yaml":  []byte("name: a\nversion: 1.0.0\n"),
+		"a/values.yaml": bytes.Repeat([]byte("#"), 1024),
+	})
+
+	// run
+	rec := serve(e, http.MethodPut, "/api/charts", source, "application/x-tar")
+
+	// check
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	assert.Empty(t, b.charts, "expected nothing stored")
+}
+
+func TestUploadChart_MaxUploadSize(t *testing.T) {
+
+	b := newMemoryBackend()
+	cfg := testServerConfig()
+	cfg.MaxUploadSize = 64
+	e, _ := testServer(cfg, b)
+
+	// run
+	rec := serve(e, http.MethodPut, "/api/charts", testChart("a", "1.0.0"), "application/gzip")
+
+	// check
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	assert.Contains(t, rec.Body.String(), "maximum upload size")
+	assert.Empty(t, b.charts, "expected nothing stored")
+}
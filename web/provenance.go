@@ -0,0 +1,142 @@
+package web
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo"
+	"github.com/zlangbert/hrp/audit"
+	"github.com/zlangbert/hrp/auth"
+	"github.com/zlangbert/hrp/backend"
+	"github.com/zlangbert/hrp/util"
+)
+
+// how large a provenance file can be, they hold a chart's digests and a signature
+const maxProvenanceSize = 1024 * 1024
+
+func putProvenance(ec echo.Context) error {
+	c := ec.(*context)
+
+	prov, filename, err := readFormFile(c, "prov")
+	if err != nil {
+		return err
+	}
+	if prov == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "missing 'prov' param")
+	}
+
+	chartFilename := strings.TrimSuffix(filename, util.ProvenanceExtension)
+
+	chartName, version, ok := util.ParseChartFilename(chartFilename)
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid provenance filename")
+	}
+
+	event := newAuditEvent(c, audit.ActionPush)
+	event.Filename = chartFilename + util.ProvenanceExtension
+	event.Chart = chartName
+	event.Version = version
+	event.Digest = "sha256:" + util.Digest(prov)
+
+	err = authorize(c, auth.PermissionPush, chartName)
+	if err == nil {
+		var chart []byte
+		chart, err = c.backend.GetChart(chartFilename)
+		if err != nil {
+			err = echo.NewHTTPError(
+				http.StatusNotFound,
+				"chart not found for provenance file")
+		} else {
+			err = storeProvenance(c, chartFilename, chart, prov)
+		}
+	}
+
+	recordAudit(c, event, err)
+	if err != nil {
+		return err
+	}
+
+	return c.NoContent(200)
+}
+
+/*
+ * verify a chart's provenance file if a keyring is configured, then store
+ * it next to the chart
+ */
+func storeProvenance(c *context, chartFilename string, chart []byte, prov []byte) error {
+
+	err := verifyProvenance(c, chartFilename, util.Digest(chart), prov)
+	if err != nil {
+		return err
+	}
+
+	return writeProvenance(c, chartFilename, prov)
+}
+
+// verify a provenance file against the digest of its chart
+func verifyProvenance(c *context, chartFilename string, chartDigest string, prov []byte) error {
+
+	if c.provenance == nil {
+		return nil
+	}
+
+	verification, err := c.provenance.VerifyDigest(chartDigest, chartFilename, prov)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	c.Logger().Infof("verified %s signed by %s", chartFilename, verification.SignedBy)
+
+	return nil
+}
+
+func writeProvenance(c *context, chartFilename string, prov []byte) error {
+
+	store, ok := c.backend.(backend.Store)
+	if !ok {
+		return echo.NewHTTPError(
+			http.StatusNotImplemented,
+			"backend does not support provenance files")
+	}
+
+	c.Logger().Infof("putting provenance %s", chartFilename+util.ProvenanceExtension)
+
+	err := store.PutFile(chartFilename+util.ProvenanceExtension, prov)
+	if err != nil {
+		return echo.NewHTTPError(
+			http.StatusInternalServerError,
+			"backend failed put provenance")
+	}
+
+	return nil
+}
+
+/*
+ * read an optional multipart file, returns nil data if the field is missing
+ */
+func readFormFile(c *context, field string) ([]byte, string, error) {
+
+	header, err := c.FormFile(field)
+	if err != nil {
+		return nil, "", nil
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		return nil, "", echo.NewHTTPError(
+			http.StatusInternalServerError,
+			"failed opening file when uploading "+field)
+	}
+	defer file.Close()
+
+	data, err := util.ReadAllLimited(file, maxProvenanceSize)
+	if err == util.ErrTooLarge {
+		return nil, "", uploadReadError(c, header.Filename, err)
+	}
+	if err != nil {
+		return nil, "", echo.NewHTTPError(
+			http.StatusInternalServerError,
+			"failed reading file when uploading "+field)
+	}
+
+	return data, header.Filename, nil
+}
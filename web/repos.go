@@ -0,0 +1,73 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo"
+	"github.com/zlangbert/hrp/auth"
+	"github.com/zlangbert/hrp/backend"
+)
+
+type repoRequest struct {
+	Name   string `json:"name"`
+	Prefix string `json:"prefix"`
+}
+
+func listRepos(ec echo.Context) error {
+	c := ec.(*context)
+
+	return c.JSON(http.StatusOK, map[string][]string{
+		"repositories": c.repos.Names(),
+	})
+}
+
+func createRepo(ec echo.Context) error {
+	c := ec.(*context)
+
+	if !c.cfg.AllowRepoCreation {
+		return echo.NewHTTPError(http.StatusForbidden, "repository creation is disabled")
+	}
+
+	err := authorize(c, auth.PermissionPush, auth.AllCharts)
+	if err != nil {
+		return err
+	}
+
+	req := &repoRequest{}
+	err = c.Bind(req)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid repository request")
+	}
+
+	c.Logger().Infof("creating repository %s", req.Name)
+
+	_, err = c.repos.Create(req.Name, req.Prefix)
+	if err == backend.ErrRepositoryNotSaved {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	return c.JSON(http.StatusCreated, req)
+}
+
+/*
+ * route middleware serving the request from the repository named by :repo
+ */
+func repoContext(h echo.HandlerFunc) echo.HandlerFunc {
+	return func(ec echo.Context) error {
+		c := ec.(*context)
+
+		name := c.Param("repo")
+		b, ok := c.repos.Get(name)
+		if !ok {
+			return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("repository not found: %s", name))
+		}
+		c.backend = b
+		c.repo = name
+
+		return h(c)
+	}
+}
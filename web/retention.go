@@ -0,0 +1,116 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+	"github.com/zlangbert/hrp/audit"
+	"github.com/zlangbert/hrp/auth"
+	"github.com/zlangbert/hrp/backend"
+	"github.com/zlangbert/hrp/retention"
+)
+
+// identity scheduled retention runs are audited as
+const retentionIdentity = "retention"
+
+func runRetention(ec echo.Context) error {
+	c := ec.(*context)
+
+	if c.retention == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "no retention rules configured")
+	}
+
+	err := authorize(c, auth.PermissionDelete, auth.AllCharts)
+	if err != nil {
+		recordAudit(c, newAuditEvent(c, audit.ActionDelete), err)
+		return err
+	}
+
+	dryRun := c.cfg.Retention.DryRun
+	if param := c.QueryParam("dry_run"); param != "" {
+		dryRun, err = strconv.ParseBool(param)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid 'dry_run' param")
+		}
+	}
+
+	c.Logger().Infof("running retention, dry run: %t", dryRun)
+
+	report, err := c.retention.Apply(c.backend, dryRun)
+	auditRetention(c.audit, c.repo, newAuditEvent(c, audit.ActionDelete), report, err)
+	if err == backend.ErrReadOnly {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "retention failed: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, report)
+}
+
+/*
+ * apply retention to the root and every named repository on an interval,
+ * read-only repositories are skipped
+ */
+func retentionLoop(app *context) {
+
+	ticker := time.NewTicker(app.cfg.Retention.Interval)
+	for range ticker.C {
+		targets := map[string]backend.Backend{"": app.backend}
+		for _, name := range app.repos.Names() {
+			if b, ok := app.repos.Get(name); ok {
+				targets[name] = b
+			}
+		}
+
+		for name, b := range targets {
+			report, err := app.retention.Apply(b, app.cfg.Retention.DryRun)
+			if err == backend.ErrReadOnly {
+				continue
+			}
+			if err != nil {
+				log.Errorf("retention failed for repository %q: %s", name, err.Error())
+			}
+			auditRetention(app.audit, name, &audit.Event{
+				Action:   audit.ActionDelete,
+				Identity: retentionIdentity,
+			}, report, err)
+		}
+	}
+}
+
+/*
+ * record a delete event per chart version removed by retention, or a single
+ * failure event, using template for the fields common to every event
+ */
+func auditRetention(logger *audit.Logger, repo string, template *audit.Event, report *retention.Report, err error) {
+
+	if logger == nil {
+		return
+	}
+
+	template.Repository = repo
+
+	if err != nil {
+		event := *template
+		event.Outcome = audit.OutcomeFailure
+		event.Error = err.Error()
+		logger.Log(&event)
+		return
+	}
+	if report.DryRun {
+		return
+	}
+
+	for _, deletion := range report.Deleted {
+		event := *template
+		event.Outcome = audit.OutcomeSuccess
+		event.Filename = deletion.Filename
+		event.Chart = deletion.Chart
+		event.Version = deletion.Version
+		logger.Log(&event)
+	}
+}
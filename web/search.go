@@ -0,0 +1,54 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo"
+	"github.com/zlangbert/hrp/auth"
+	"github.com/zlangbert/hrp/search"
+)
+
+func searchCharts(ec echo.Context) error {
+	c := ec.(*context)
+
+	query := search.Query{
+		Text:       c.QueryParam("q"),
+		Constraint: c.QueryParam("version"),
+		Sort:       c.QueryParam("sort"),
+		Order:      c.QueryParam("order"),
+	}
+
+	for name, value := range map[string]*int{"offset": &query.Offset, "limit": &query.Limit} {
+		if param := c.QueryParam(name); param != "" {
+			n, err := strconv.Atoi(param)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "invalid '"+name+"' param")
+			}
+			*value = n
+		}
+	}
+
+	// only charts the caller can read are found
+	if c.policy != nil {
+		query.Allowed = func(chart string) bool {
+			return c.policy.Allowed(c.identity, auth.PermissionRead, chart)
+		}
+	}
+
+	data, err := c.backend.GetIndex()
+	if err != nil {
+		return err
+	}
+	index, err := c.search.Get(c.repo, data)
+	if err != nil {
+		return err
+	}
+
+	result, err := index.Search(query)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, result)
+}
@@ -4,19 +4,52 @@ import (
 	"github.com/labstack/echo"
 	"github.com/labstack/echo/middleware"
 	"github.com/labstack/gommon/log"
+	"github.com/zlangbert/hrp/audit"
+	"github.com/zlangbert/hrp/auth"
 	"github.com/zlangbert/hrp/backend"
 	"github.com/zlangbert/hrp/config"
+	"github.com/zlangbert/hrp/retention"
+	"github.com/zlangbert/hrp/search"
+	"github.com/zlangbert/hrp/util"
 )
 
 type context struct {
 	echo.Context
 
-	cfg     *config.AppConfig
-	backend backend.Backend
+	cfg        *config.AppConfig
+	backend    backend.Backend
+	repos      *backend.Repositories
+	provenance *util.ProvenanceVerifier
+
+	// authentication and authorization, the policy is nil when disabled
+	authenticators []auth.Authenticator
+	policy         *auth.Policy
+	identity       *auth.Identity
+
+	// audit log of mutations, nil when disabled
+	audit *audit.Logger
+
+	// retention policy, nil when no rules are configured
+	retention *retention.Policy
+
+	// background reindexing, nil when disabled
+	reindexer *backend.ReindexScheduler
+
+	// reindexes requested through the api
+	jobs *backend.ReindexJobs
+
+	// search indexes of the served repositories
+	search *search.Cache
+
+	// recently extracted chart archives
+	chartFiles *chartFilesCache
+
+	// name of the repository being served, empty for the root repository
+	repo string
 }
 
 // Start starts the web server
-func Start(cfg *config.AppConfig, backend backend.Backend) {
+func Start(cfg *config.AppConfig, b backend.Backend, repos *backend.Repositories) {
 	e := echo.New()
 
 	if cfg.Debug {
@@ -24,11 +57,92 @@ func Start(cfg *config.AppConfig, backend backend.Backend) {
 		e.Logger.SetLevel(log.DEBUG)
 	}
 
+	app := &context{
+		cfg:        cfg,
+		backend:    b,
+		repos:      repos,
+		jobs:       backend.NewReindexJobs(),
+		search:     search.NewCache(),
+		chartFiles: newChartFilesCache(chartFilesCacheSize),
+	}
+
+	if cfg.ProvenanceKeyring != "" {
+		verifier, err := util.NewProvenanceVerifier(cfg.ProvenanceKeyring)
+		if err != nil {
+			e.Logger.Fatal(err)
+		}
+		app.provenance = verifier
+	}
+
+	if cfg.JWT.Issuer != "" {
+		authenticator, err := auth.NewJWTAuthenticator(cfg.JWT)
+		if err != nil {
+			e.Logger.Fatal(err)
+		}
+		app.authenticators = append(app.authenticators, authenticator)
+	}
+
+	if cfg.AuthPolicy != "" {
+		policy, err := auth.LoadPolicy(cfg.AuthPolicy)
+		if err != nil {
+			e.Logger.Fatal(err)
+		}
+		app.policy = policy
+		app.authenticators = append(app.authenticators, policy)
+	}
+
+	sinks := []audit.Sink{}
+	if cfg.AuditLog != "" {
+		sink, err := audit.NewFileSink(cfg.AuditLog)
+		if err != nil {
+			e.Logger.Fatal(err)
+		}
+		sinks = append(sinks, sink)
+	}
+	if cfg.AuditStore {
+		store, err := backend.NewAuditStore(cfg)
+		if err != nil {
+			e.Logger.Fatalf("can't store the audit log: %s", err.Error())
+		}
+		sinks = append(sinks, audit.NewStoreSink(store, ""))
+	}
+	if len(sinks) > 0 {
+		app.audit = audit.NewLogger(sinks...)
+	}
+
+	if len(cfg.Retention.Rules) > 0 {
+		policy, err := retention.NewPolicy(cfg.Retention.Rules)
+		if err != nil {
+			e.Logger.Fatal(err)
+		}
+		app.retention = policy
+
+		if cfg.Retention.Interval > 0 {
+			go retentionLoop(app)
+		}
+	}
+
+	if cfg.ReindexInterval > 0 {
+		app.reindexer = backend.NewReindexScheduler(b, repos, cfg.ReindexInterval)
+		app.reindexer.Start()
+	}
+
+	routes(e, app)
+
+	e.Logger.Fatal(e.Start(":1323"))
+}
+
+/*
+ * register the middleware and routes serving the app
+ */
+func routes(e *echo.Echo, app *context) {
+
 	// create custom context containing config
-	e.Use(appContext(cfg, backend))
+	e.Use(appContext(app))
 	e.Use(middleware.Recover())
+	e.Use(authenticate)
 
-	if cfg.Debug {
+	if app.cfg.Debug {
 		e.Use(middleware.Logger())
 	}
 
@@ -36,23 +150,57 @@ func Start(cfg *config.AppConfig, backend backend.Backend) {
 	e.GET("/index.yaml", index)
 	e.GET("/:chart", getChart)
 	e.POST("/chart", putChart)
+	e.PUT("/api/charts", uploadChart)
+	e.PUT("/api/charts/:filename", uploadChart)
 	e.POST("/reindex", reindex)
+	e.GET("/api/reindex/status", reindexStatus)
+	e.GET("/api/reindex/:id", reindexJob)
+	e.POST("/api/prov", putProvenance)
+	e.POST("/api/retention/run", runRetention)
+	e.GET("/api/search", searchCharts)
+	e.GET("/api/charts/:name/diff", diffChart)
+	e.GET("/api/charts/:name/:version/files", listChartFiles)
+	e.GET("/api/charts/:name/:version/files/*", getChartFile)
+	e.GET("/api/charts/:name/:version/values", getChartValues)
+	e.GET("/api/charts/:name/:version/readme", getChartReadme)
+	e.GET("/ui", uiCharts)
+	e.GET("/ui/charts/:name", uiChartVersion)
+	e.GET("/ui/charts/:name/:version", uiChartVersion)
 
-	e.Logger.Fatal(e.Start(":1323"))
+	// named repositories
+	e.GET("/api/repos", listRepos)
+	e.POST("/api/repos", createRepo)
+	e.GET("/:repo/index.yaml", index, repoContext)
+	e.GET("/:repo/:chart", getChart, repoContext)
+	e.POST("/:repo/chart", putChart, repoContext)
+	e.PUT("/:repo/api/charts", uploadChart, repoContext)
+	e.PUT("/:repo/api/charts/:filename", uploadChart, repoContext)
+	e.POST("/:repo/reindex", reindex, repoContext)
+	e.GET("/:repo/api/reindex/status", reindexStatus, repoContext)
+	e.GET("/:repo/api/reindex/:id", reindexJob, repoContext)
+	e.POST("/:repo/api/prov", putProvenance, repoContext)
+	e.POST("/:repo/api/retention/run", runRetention, repoContext)
+	e.GET("/:repo/api/search", searchCharts, repoContext)
+	e.GET("/:repo/api/charts/:name/diff", diffChart, repoContext)
+	e.GET("/:repo/api/charts/:name/:version/files", listChartFiles, repoContext)
+	e.GET("/:repo/api/charts/:name/:version/files/*", getChartFile, repoContext)
+	e.GET("/:repo/api/charts/:name/:version/values", getChartValues, repoContext)
+	e.GET("/:repo/api/charts/:name/:version/readme", getChartReadme, repoContext)
+	e.GET("/:repo/ui", uiCharts, repoContext)
+	e.GET("/:repo/ui/charts/:name", uiChartVersion, repoContext)
+	e.GET("/:repo/ui/charts/:name/:version", uiChartVersion, repoContext)
 }
 
 /*
- * custom request context to hold the backend
+ * custom request context to hold the backend, copied from the app context
+ * for every request
  */
-func appContext(cfg *config.AppConfig, backend backend.Backend) echo.MiddlewareFunc {
+func appContext(app *context) echo.MiddlewareFunc {
 	return func(h echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
-			cc := &context{
-				Context: c,
-				cfg:     cfg,
-				backend: backend,
-			}
-			return h(cc)
+			cc := *app
+			cc.Context = c
+			return h(&cc)
 		}
 	}
 }
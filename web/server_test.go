@@ -0,0 +1,305 @@
+package web
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+	"github.com/zlangbert/hrp/backend"
+	"github.com/zlangbert/hrp/config"
+	"github.com/zlangbert/hrp/search"
+	"github.com/zlangbert/hrp/util"
+)
+
+func TestReindex_Location(t *testing.T) {
+
+	cfg := testServerConfig()
+	cfg.BaseURL = "http://charts.example.com/helm/"
+	e, _ := testServer(cfg, newMemoryBackend())
+
+	// run
+	rec := serve(e, http.MethodPost, "/reindex", nil, "")
+
+	// check
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	job := &backend.ReindexJob{}
+	json.Unmarshal(rec.Body.Bytes(), job)
+	assert.Equal(t, "/helm/api/reindex/"+job.ID, rec.Header().Get(echo.HeaderLocation), "expected location below the base url's path")
+
+	// the proxy in front strips the base url's path
+	rec = serve(e, http.MethodGet, "/api/reindex/"+job.ID, nil, "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestReindexJob_OtherRepository(t *testing.T) {
+
+	e, app := testServer(testServerConfig(), newMemoryBackend())
+	job, _ := app.jobs.Start("stable", newMemoryBackend(), nil)
+
+	// run
+	rec := serve(e, http.MethodGet, "/api/reindex/"+job.ID, nil, "")
+
+	// check
+	assert.Equal(t, http.StatusNotFound, rec.Code, "expected jobs of named repositories only found through them")
+}
+
+//
+// helpers
+//
+
+func testServerConfig() *config.AppConfig {
+	cfg := config.New()
+	cfg.BaseURL = "http://localhost:1323"
+	cfg.BackendName = "s3"
+
+	return cfg
+}
+
+// an app serving b as its root repository, without named repositories
+func testServer(cfg *config.AppConfig, b backend.Backend) (*echo.Echo, *context) {
+
+	repos, _ := backend.NewRepositories(cfg, false)
+	app := &context{
+		cfg:        cfg,
+		backend:    b,
+		repos:      repos,
+		jobs:       backend.NewReindexJobs(),
+		search:     search.NewCache(),
+		chartFiles: newChartFilesCache(chartFilesCacheSize),
+	}
+
+	e := echo.New()
+	routes(e, app)
+
+	return e, app
+}
+
+func serve(e *echo.Echo, method string, path string, body []byte, contentType string) *httptest.ResponseRecorder {
+
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	if contentType != "" {
+		req.Header.Set(echo.HeaderContentType, contentType)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	return rec
+}
+
+// a file field of a multipart upload
+type testPart struct {
+	field    string
+	filename string
+	data     []byte
+}
+
+// a multipart upload of the parts, and its content type
+func testUpload(parts ...testPart) ([]byte, string) {
+
+	buf := &bytes.Buffer{}
+	w := multipart.NewWriter(buf)
+	for _, part := range parts {
+		fw, _ := w.CreateFormFile(part.field, part.filename)
+		fw.Write(part.data)
+	}
+	w.Close()
+
+	return buf.Bytes(), w.FormDataContentType()
+}
+
+// a packaged chart holding only its Chart.yaml
+func testChart(name string, version string) []byte {
+	return testChartWithMetadata(name, fmt.Sprintf("name: %s\nversion: %s\n", name, version))
+}
+
+func testChartWithMetadata(name string, chartYaml string) []byte {
+
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	tw.WriteHeader(&tar.Header{
+		Name:     name + "/Chart.yaml",
+		Mode:     0644,
+		Size:     int64(len(chartYaml)),
+		Typeflag: tar.TypeReg,
+	})
+	tw.Write([]byte(chartYaml))
+	tw.Close()
+	gz.Close()
+
+	return buf.Bytes()
+}
+
+// memoryBackend is an in memory Backend storing batches and provenance files
+type memoryBackend struct {
+	lock       sync.Mutex
+	charts     map[string][]byte
+	files      map[string][]byte
+	index      *util.IndexFile
+	generation int64
+
+	// charts failing to be put
+	failing map[string]bool
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{
+		charts:  map[string][]byte{},
+		files:   map[string][]byte{},
+		index:   util.NewIndexFile(),
+		failing: map[string]bool{},
+	}
+}
+
+func (b *memoryBackend) Initialize() error {
+	return nil
+}
+
+func (b *memoryBackend) GetIndex() ([]byte, error) {
+	data, _, err := b.GetIndexWithGeneration()
+	return data, err
+}
+
+func (b *memoryBackend) GetIndexWithGeneration() ([]byte, int64, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	data, err := b.index.Marshal()
+	return data, b.generation, err
+}
+
+func (b *memoryBackend) GetChart(name string) ([]byte, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	data, ok := b.charts[name]
+	if !ok {
+		return nil, fmt.Errorf("not found: %s", name)
+	}
+	return data, nil
+}
+
+func (b *memoryBackend) PutChart(filename string, file io.Reader, size int64) error {
+	return b.PutCharts([]*backend.ChartFile{{Filename: filename, File: file, Size: size}}, true)[0]
+}
+
+func (b *memoryBackend) PutCharts(charts []*backend.ChartFile, atomic bool) []error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	errs := make([]error, len(charts))
+	archives := make([][]byte, len(charts))
+	mds := make([]*util.ChartMetadata, len(charts))
+	for n, chart := range charts {
+		archives[n], errs[n] = ioutil.ReadAll(chart.File)
+		if errs[n] == nil {
+			mds[n], errs[n] = util.LoadChartMetadata(archives[n])
+		}
+		if b.failing[chart.Filename] {
+			errs[n] = errors.New("put failed")
+		}
+	}
+
+	if atomic && anyFailed(errs) {
+		for n := range errs {
+			if errs[n] == nil {
+				errs[n] = backend.ErrBatchAborted
+			}
+		}
+		return errs
+	}
+
+	for n, chart := range charts {
+		if errs[n] != nil {
+			continue
+		}
+		b.charts[chart.Filename] = archives[n]
+		if chart.Provenance != nil {
+			b.files[chart.Filename+util.ProvenanceExtension] = chart.Provenance
+		}
+		b.index.Add(mds[n], util.ChartURL("http://localhost:1323", chart.Filename), util.Digest(archives[n]))
+	}
+	b.index.SortEntries()
+	b.generation++
+
+	return errs
+}
+
+func (b *memoryBackend) DeleteCharts(filenames ...string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for _, filename := range filenames {
+		delete(b.charts, filename)
+		if cv := b.index.FindByFilename(filename); cv != nil {
+			b.index.Remove(cv.Name, cv.Version)
+		}
+	}
+	b.generation++
+
+	return nil
+}
+
+func (b *memoryBackend) Reindex() error {
+	return nil
+}
+
+func (b *memoryBackend) GetFile(name string) ([]byte, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	data, ok := b.files[name]
+	if !ok {
+		return nil, backend.ErrFileNotFound
+	}
+	return data, nil
+}
+
+func (b *memoryBackend) PutFile(name string, data []byte) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.files[name] = data
+	return nil
+}
+
+// plainBackend hides everything but the Backend interface of a memoryBackend
+type plainBackend struct {
+	b *memoryBackend
+}
+
+func (p *plainBackend) Initialize() error {
+	return p.b.Initialize()
+}
+
+func (p *plainBackend) GetIndex() ([]byte, error) {
+	return p.b.GetIndex()
+}
+
+func (p *plainBackend) GetChart(name string) ([]byte, error) {
+	return p.b.GetChart(name)
+}
+
+func (p *plainBackend) PutChart(filename string, file io.Reader, size int64) error {
+	return p.b.PutChart(filename, file, size)
+}
+
+func (p *plainBackend) DeleteCharts(filenames ...string) error {
+	return p.b.DeleteCharts(filenames...)
+}
+
+func (p *plainBackend) Reindex() error {
+	return p.b.Reindex()
+}
@@ -0,0 +1,175 @@
+package web
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/labstack/echo"
+	"github.com/zlangbert/hrp/auth"
+	"github.com/zlangbert/hrp/util"
+)
+
+// a chart in the ui's chart list
+type uiChartSummary struct {
+	Latest   *util.ChartVersion
+	Versions int
+}
+
+// a chart version page
+type uiChartDetails struct {
+	Chart    *util.ChartVersion
+	Versions []*util.ChartVersion
+	Readme   string
+	Values   string
+	RepoName string
+	RepoURL  string
+}
+
+/*
+ * list the charts the caller can read, with their latest version
+ */
+func uiCharts(ec echo.Context) error {
+	c := ec.(*context)
+
+	index, err := uiIndex(c)
+	if err != nil {
+		return err
+	}
+
+	charts := []uiChartSummary{}
+	for _, versions := range index.Entries {
+		if len(versions) > 0 {
+			charts = append(charts, uiChartSummary{Latest: versions[0], Versions: len(versions)})
+		}
+	}
+	sort.Slice(charts, func(a, b int) bool {
+		return charts[a].Latest.Name < charts[b].Latest.Name
+	})
+
+	return renderUI(c, uiChartsTemplate, charts)
+}
+
+/*
+ * show a chart version, the latest one if no version is given, with the
+ * readme and default values from its archive
+ */
+func uiChartVersion(ec echo.Context) error {
+	c := ec.(*context)
+
+	name := c.Param("name")
+	err := authorize(c, auth.PermissionRead, name)
+	if err != nil {
+		return err
+	}
+
+	index, err := uiIndex(c)
+	if err != nil {
+		return err
+	}
+
+	versions := index.Entries[name]
+	if len(versions) == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "chart not found: "+name)
+	}
+
+	cv := versions[0]
+	if version := c.Param("version"); version != "" {
+		cv = index.Get(name, version)
+		if cv == nil {
+			return echo.NewHTTPError(http.StatusNotFound, "chart version not found: "+name+" "+version)
+		}
+	}
+
+	files, err := extractChart(c, cv)
+	if err != nil {
+		return err
+	}
+
+	// both files are optional
+	readme, _ := chartReadme(files)
+	values := files["values.yaml"]
+
+	repoName := c.repo
+	if repoName == "" {
+		repoName = "hrp"
+	}
+
+	return renderUI(c, uiChartVersionTemplate, &uiChartDetails{
+		Chart:    cv,
+		Versions: versions,
+		Readme:   string(readme),
+		Values:   string(values),
+		RepoName: repoName,
+		RepoURL:  repoURL(c),
+	})
+}
+
+/*
+ * the repository index, without the charts the caller can't read
+ */
+func uiIndex(c *context) (*util.IndexFile, error) {
+
+	data, err := c.backend.GetIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err = filterIndex(c, data)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := util.ParseIndex(data)
+	if err != nil {
+		return nil, err
+	}
+	index.SortEntries()
+
+	return index, nil
+}
+
+// the url helm adds the repository being served by
+func repoURL(c *context) string {
+	base := strings.TrimSuffix(c.cfg.BaseURL, "/")
+	if c.repo == "" {
+		return base
+	}
+	return base + "/" + c.repo
+}
+
+// the path the repository being served is at, below the base url's path
+func repoPath(c *context) string {
+	base := ""
+	if u, err := url.Parse(c.cfg.BaseURL); err == nil {
+		base = strings.TrimSuffix(u.Path, "/")
+	}
+	if c.repo == "" {
+		return base
+	}
+	return base + "/" + c.repo
+}
+
+func renderUI(c *context, t *template.Template, data interface{}) error {
+
+	// links are relative to the ui of the repository being served
+	root := "/ui"
+	if c.repo != "" {
+		root = "/" + c.repo + "/ui"
+	}
+
+	buf := &bytes.Buffer{}
+	err := t.ExecuteTemplate(buf, "layout", map[string]interface{}{
+		"Root": root,
+		"Repo": c.repo,
+		"Data": data,
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.HTML(http.StatusOK, buf.String())
+}
@@ -0,0 +1,144 @@
+package web
+
+import (
+	"html/template"
+	"time"
+)
+
+/*
+ * the ui is rendered on the server from these templates, which are compiled
+ * into the binary along with their styles, so it needs no external assets
+ */
+
+var uiFuncs = template.FuncMap{
+	"date": func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.UTC().Format("2006-01-02 15:04")
+	},
+}
+
+var (
+	uiChartsTemplate       = uiTemplate(uiChartsHTML)
+	uiChartVersionTemplate = uiTemplate(uiChartVersionHTML)
+)
+
+func uiTemplate(page string) *template.Template {
+	t := template.Must(template.New("layout").Funcs(uiFuncs).Parse(uiLayoutHTML))
+	return template.Must(t.Parse(page))
+}
+
+const uiLayoutHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{template "title" .}} - hrp</title>
+<style>
+body { margin: 0; font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; color: #24292e; background: #f6f8fa; }
+header { background: #0f1689; color: #fff; padding: 12px 24px; }
+header a { color: #fff; text-decoration: none; font-weight: 600; }
+main { max-width: 960px; margin: 24px auto; padding: 0 24px; }
+a { color: #0366d6; }
+table { width: 100%; border-collapse: collapse; background: #fff; }
+th, td { text-align: left; padding: 8px 12px; border-bottom: 1px solid #e1e4e8; vertical-align: top; }
+th { background: #fafbfc; }
+section { background: #fff; border: 1px solid #e1e4e8; border-radius: 4px; padding: 16px; margin-bottom: 16px; }
+h2 { margin-top: 0; font-size: 18px; }
+pre { background: #f6f8fa; padding: 12px; overflow-x: auto; font-size: 13px; white-space: pre-wrap; }
+dl { display: grid; grid-template-columns: max-content auto; gap: 4px 16px; margin: 0; }
+dt { font-weight: 600; }
+dd { margin: 0; }
+.muted { color: #6a737d; }
+.deprecated { color: #b31d28; font-weight: 600; }
+.layout { display: grid; grid-template-columns: 1fr 240px; gap: 16px; }
+</style>
+</head>
+<body>
+<header><a href="{{.Root}}">hrp{{if .Repo}} / {{.Repo}}{{end}}</a></header>
+<main>
+{{template "content" .}}
+</main>
+</body>
+</html>
+`
+
+const uiChartsHTML = `{{define "title"}}Charts{{end}}
+{{define "content"}}
+<h1>Charts</h1>
+{{if .Data}}
+<table>
+<tr><th>Chart</th><th>Latest version</th><th>App version</th><th>Description</th><th>Versions</th></tr>
+{{range .Data}}
+<tr>
+<td><a href="{{$.Root}}/charts/{{.Latest.Name}}">{{.Latest.Name}}</a>{{if .Latest.Deprecated}} <span class="deprecated">deprecated</span>{{end}}</td>
+<td>{{.Latest.Version}}</td>
+<td>{{.Latest.AppVersion}}</td>
+<td>{{.Latest.Description}}</td>
+<td>{{.Versions}}</td>
+</tr>
+{{end}}
+</table>
+{{else}}
+<p class="muted">The repository has no charts yet.</p>
+{{end}}
+{{end}}
+`
+
+const uiChartVersionHTML = `{{define "title"}}{{.Data.Chart.Name}} {{.Data.Chart.Version}}{{end}}
+{{define "content"}}
+{{with .Data}}
+<h1>{{.Chart.Name}} <span class="muted">{{.Chart.Version}}</span></h1>
+{{if .Chart.Deprecated}}<p class="deprecated">This chart is deprecated.</p>{{end}}
+<p>{{.Chart.Description}}</p>
+<div class="layout">
+<div>
+<section>
+<h2>Install</h2>
+<pre>helm repo add {{.RepoName}} {{.RepoURL}}
+helm repo update
+helm install {{.RepoName}}/{{.Chart.Name}} --version {{.Chart.Version}}</pre>
+</section>
+<section>
+<h2>Chart.yaml</h2>
+<dl>
+<dt>Name</dt><dd>{{.Chart.Name}}</dd>
+<dt>Version</dt><dd>{{.Chart.Version}}</dd>
+{{if .Chart.AppVersion}}<dt>App version</dt><dd>{{.Chart.AppVersion}}</dd>{{end}}
+{{if .Chart.APIVersion}}<dt>API version</dt><dd>{{.Chart.APIVersion}}</dd>{{end}}
+{{if .Chart.Home}}<dt>Home</dt><dd><a href="{{.Chart.Home}}">{{.Chart.Home}}</a></dd>{{end}}
+{{if .Chart.Sources}}<dt>Sources</dt><dd>{{range .Chart.Sources}}<a href="{{.}}">{{.}}</a><br>{{end}}</dd>{{end}}
+{{if .Chart.Keywords}}<dt>Keywords</dt><dd>{{range $n, $k := .Chart.Keywords}}{{if $n}}, {{end}}{{$k}}{{end}}</dd>{{end}}
+{{if .Chart.Maintainers}}<dt>Maintainers</dt><dd>{{range .Chart.Maintainers}}{{.Name}}{{if .Email}} &lt;{{.Email}}&gt;{{end}}<br>{{end}}</dd>{{end}}
+{{if .Chart.Engine}}<dt>Engine</dt><dd>{{.Chart.Engine}}</dd>{{end}}
+<dt>Created</dt><dd>{{date .Chart.Created}}</dd>
+<dt>Digest</dt><dd><code>{{.Chart.Digest}}</code></dd>
+</dl>
+</section>
+<section>
+<h2>README</h2>
+{{if .Readme}}<pre>{{.Readme}}</pre>{{else}}<p class="muted">The chart has no README.md.</p>{{end}}
+</section>
+<section>
+<h2>Default values</h2>
+{{if .Values}}<pre>{{.Values}}</pre>{{else}}<p class="muted">The chart has no values.yaml.</p>{{end}}
+</section>
+</div>
+<div>
+<section>
+<h2>Versions</h2>
+<table>
+{{range .Versions}}
+<tr>
+<td><a href="{{$.Root}}/charts/{{.Name}}/{{.Version}}">{{.Version}}</a></td>
+<td class="muted">{{date .Created}}</td>
+</tr>
+{{end}}
+</table>
+</section>
+</div>
+</div>
+{{end}}
+{{end}}
+`